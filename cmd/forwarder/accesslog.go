@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/heroku/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// accessRecord collects what's known about a /logs request for its access log
+// line. The handler creates it and process fills in what it learns.
+type accessRecord struct {
+	Start             time.Time
+	RequestID         string
+	AuthUser          string
+	Stage             string
+	DrainToken        string
+	RemoteAddr        string
+	ContentEncoding   string
+	CompressedBytes   *countingReader
+	UncompressedBytes *countingReader
+	NumFrames         int64 // frames received
+	NumLogs           int64 // logs forwarded, once any were dropped
+	HostnameTruncs    int64
+	AppnameTruncs     int64
+	ProcidTruncs      int64
+	MsgidTruncs       int64
+	Status            int
+	FixTime           time.Duration
+	DeliveryWait      time.Duration
+}
+
+type accessRecordKey struct{}
+
+// accessRecordFromContext returns the request's access record, or a throwaway
+// one if it doesn't have one, so callers needn't check.
+func accessRecordFromContext(ctx context.Context) *accessRecord {
+	if rec, ok := ctx.Value(accessRecordKey{}).(*accessRecord); ok {
+		return rec
+	}
+	return &accessRecord{}
+}
+
+func contextWithAccessRecord(ctx context.Context, rec *accessRecord) context.Context {
+	return context.WithValue(ctx, accessRecordKey{}, rec)
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.Reader
+	N int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.N += int64(n)
+	return n, err
+}
+
+func (r *countingReader) count() int64 {
+	if r == nil {
+		return 0
+	}
+	return r.N
+}
+
+// accessLogger writes one JSON line per request to a sink. Successful
+// requests are sampled at SampleRate, failed ones are always logged.
+type accessLogger struct {
+	SampleRate float64
+	logger     *log.Logger
+	rand       func() float64
+	written    metrics.Counter // counts lines written
+	skipped    metrics.Counter // counts lines skipped by sampling
+}
+
+// newAccessLogger creates an accessLogger writing to sink, which is "stdout",
+// "stderr" or the path of a file to append to.
+func newAccessLogger(sink string, sampleRate float64, registry metrics.Registry) (*accessLogger, error) {
+	var w io.Writer
+	switch sink {
+	case "stdout":
+		w = os.Stdout
+	case "stderr":
+		w = os.Stderr
+	default:
+		f, err := os.OpenFile(sink, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+
+	logger := log.New()
+	logger.Out = w
+	logger.Formatter = &log.JSONFormatter{}
+
+	return &accessLogger{
+		SampleRate: sampleRate,
+		logger:     logger,
+		rand:       rand.Float64,
+		written:    metrics.GetOrRegisterCounter("log-iss.access_log.written.g", registry),
+		skipped:    metrics.GetOrRegisterCounter("log-iss.access_log.skipped.g", registry),
+	}, nil
+}
+
+// Log writes rec, subject to sampling. It is safe to call on a nil
+// *accessLogger, which does nothing.
+func (a *accessLogger) Log(rec *accessRecord) {
+	if a == nil {
+		return
+	}
+	if rec.Status < 400 && a.rand() >= a.SampleRate {
+		a.skipped.Inc(1)
+		return
+	}
+
+	a.logger.WithFields(log.Fields{
+		"ns":                   "access",
+		"request_id":           rec.RequestID,
+		"auth_user":            rec.AuthUser,
+		"credential_stage":     rec.Stage,
+		"logdrain_token":       rec.DrainToken,
+		"remote_addr":          rec.RemoteAddr,
+		"content_encoding":     rec.ContentEncoding,
+		"bytes_compressed":     rec.CompressedBytes.count(),
+		"bytes_uncompressed":   rec.UncompressedBytes.count(),
+		"frames":               rec.NumFrames,
+		"logs":                 rec.NumLogs,
+		"hostname_truncations": rec.HostnameTruncs,
+		"appname_truncations":  rec.AppnameTruncs,
+		"procid_truncations":   rec.ProcidTruncs,
+		"msgid_truncations":    rec.MsgidTruncs,
+		"status":               rec.Status,
+		"fix_ms":               durationMs(rec.FixTime),
+		"delivery_wait_ms":     durationMs(rec.DeliveryWait),
+		"duration_ms":          durationMs(time.Since(rec.Start)),
+	}).Info()
+	a.written.Inc(1)
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/heroku/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessLoggerFileSink(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "access.log")
+
+	a, err := newAccessLogger(path, 1, metrics.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := &countingReader{Reader: strings.NewReader("hello")}
+	ioutil.ReadAll(body)
+	a.Log(&accessRecord{
+		Start:             time.Now(),
+		RequestID:         "req-1",
+		AuthUser:          "user",
+		Stage:             "current",
+		DrainToken:        "d.1",
+		UncompressedBytes: body,
+		NumFrames:         3,
+		NumLogs:           2,
+		MsgidTruncs:       1,
+		Status:            200,
+		FixTime:           1500 * time.Microsecond,
+	})
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var line map[string]interface{}
+	assert.NoError(json.Unmarshal(b, &line))
+	assert.Equal("access", line["ns"])
+	assert.Equal("req-1", line["request_id"])
+	assert.Equal("user", line["auth_user"])
+	assert.Equal("current", line["credential_stage"])
+	assert.Equal("d.1", line["logdrain_token"])
+	assert.Equal(float64(0), line["bytes_compressed"])
+	assert.Equal(float64(5), line["bytes_uncompressed"])
+	assert.Equal(float64(3), line["frames"])
+	assert.Equal(float64(2), line["logs"])
+	assert.Equal(float64(1), line["msgid_truncations"])
+	assert.Equal(float64(200), line["status"])
+	assert.Equal(1.5, line["fix_ms"])
+}
+
+func TestAccessLoggerSampling(t *testing.T) {
+	assert := assert.New(t)
+	a, err := newAccessLogger("stdout", 0.25, metrics.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	a.logger.Out = &buf
+
+	a.rand = func() float64 { return 0.5 }
+	a.Log(&accessRecord{Status: 202})
+	assert.Equal(0, buf.Len())
+	assert.Equal(int64(1), a.skipped.Count())
+
+	// Failures are always logged
+	a.Log(&accessRecord{Status: 429})
+	assert.Equal(1, strings.Count(buf.String(), "\n"))
+
+	a.rand = func() float64 { return 0.1 }
+	a.Log(&accessRecord{Status: 200})
+	assert.Equal(2, strings.Count(buf.String(), "\n"))
+	assert.Equal(int64(2), a.written.Count())
+
+	var nilLogger *accessLogger
+	nilLogger.Log(&accessRecord{})
+}
+
+func TestHTTPProcessFillsAccessRecord(t *testing.T) {
+	assert := assert.New(t)
+	config := getConfig()
+	s := newHTTPServer(*config, nil, fix, &captureDeliverer{})
+
+	rec := &accessRecord{}
+	req := simpleHttpRequest()
+	req = req.WithContext(contextWithAccessRecord(req.Context(), rec))
+	in := []byte("64 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - - hi\n")
+	err, _ := s.process(req, bytes.NewReader(in), "1.2.3.4", "", "", "", nil)
+	assert.NoError(err)
+	assert.Equal(int64(1), rec.NumFrames)
+	assert.Equal(int64(1), rec.NumLogs)
+	assert.True(rec.FixTime > 0)
+
+	// Requests without a record still work
+	err, _ = s.process(simpleHttpRequest(), bytes.NewReader(in), "1.2.3.4", "", "", "", nil)
+	assert.NoError(err)
+}
+
+// Frames that are dropped still count as received.
+func TestHTTPProcessCountsDroppedFrames(t *testing.T) {
+	assert := assert.New(t)
+	config := getConfig()
+	config.Deduper = newDeduper(time.Minute, config.MetricsRegistry)
+	s := newHTTPServer(*config, nil, fix, &captureDeliverer{})
+
+	rec := &accessRecord{}
+	req := simpleHttpRequest()
+	req = req.WithContext(contextWithAccessRecord(req.Context(), rec))
+	in := logplexFrames(
+		"<13>1 2013-06-07T13:17:49Z host app web.1 - - same\n",
+		"<13>1 2013-06-07T13:17:50Z host app web.1 - - same\n",
+	)
+	err, _ := s.process(req, bytes.NewReader(in), "1.2.3.4", "", "", "", nil)
+	assert.NoError(err)
+	assert.Equal(int64(2), rec.NumFrames)
+	assert.Equal(int64(1), rec.NumLogs)
+	assert.Equal(int64(2), s.pLogsReceived.Count())
+	assert.Equal(int64(1), s.pLogsSent.Count())
+}
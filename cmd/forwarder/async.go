@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/heroku/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+var errQueueFull = errors.New("Queue is over its high-water mark")
+
+// asyncDeliverer queues payloads for the forwarders without waiting for them
+// to be written, so requests can be acknowledged as soon as they're queued.
+// Payloads are refused once the queue holds HighWater or more of them.
+type asyncDeliverer struct {
+	Inbox     chan payload
+	HighWater int
+	inflight  int64 // logs accepted but not yet written
+
+	accepted  metrics.Counter // counts logs accepted onto the queue
+	delivered metrics.Counter // counts accepted logs written by a forwarder
+	dropped   metrics.Counter // counts accepted logs still unwritten when draining gave up
+	rejected  metrics.Counter // counts logs refused because the queue was over the high-water mark
+	depth     metrics.Gauge   // queue depth as of the last Deliver
+}
+
+func newAsyncDeliverer(config IssConfig, inbox chan payload) *asyncDeliverer {
+	return newRouteAsyncDeliverer(config, inbox, "")
+}
+
+// newRouteAsyncDeliverer creates the queue in front of the forwarders of
+// route, with metrics named for it, or of FORWARD_DEST if route is empty.
+func newRouteAsyncDeliverer(config IssConfig, inbox chan payload, route string) *asyncDeliverer {
+	prefix := routeMetricPrefix(route, "async")
+	highWater := config.AsyncHighWater
+	if highWater <= 0 || highWater > cap(inbox) {
+		highWater = cap(inbox)
+	}
+
+	return &asyncDeliverer{
+		Inbox:     inbox,
+		HighWater: highWater,
+		accepted:  metrics.GetOrRegisterCounter(prefix+"accepted.g", config.MetricsRegistry),
+		delivered: metrics.GetOrRegisterCounter(prefix+"delivered.g", config.MetricsRegistry),
+		dropped:   metrics.GetOrRegisterCounter(prefix+"dropped.g", config.MetricsRegistry),
+		rejected:  metrics.GetOrRegisterCounter(prefix+"rejected.g", config.MetricsRegistry),
+		depth:     metrics.GetOrRegisterGauge(prefix+"depth.g", config.MetricsRegistry),
+	}
+}
+
+// Deliver queues p, returning errQueueFull instead of blocking if the queue
+// is over its high-water mark.
+func (a *asyncDeliverer) Deliver(p payload) error {
+	depth := len(a.Inbox)
+	a.depth.Update(int64(depth))
+	if depth >= a.HighWater {
+		a.rejected.Inc(p.NumLogs)
+		return errQueueFull
+	}
+
+	atomic.AddInt64(&a.inflight, p.NumLogs)
+	select {
+	case a.Inbox <- p:
+	default:
+		atomic.AddInt64(&a.inflight, -p.NumLogs)
+		a.rejected.Inc(p.NumLogs)
+		return errQueueFull
+	}
+	a.accepted.Inc(p.NumLogs)
+
+	go a.await(p)
+	return nil
+}
+
+func (a *asyncDeliverer) await(p payload) {
+	<-p.WaitCh
+	atomic.AddInt64(&a.inflight, -p.NumLogs)
+	a.delivered.Inc(p.NumLogs)
+	for _, c := range p.Sent {
+		c.Inc(p.NumLogs)
+	}
+}
+
+// Inflight returns the number of accepted logs that haven't been written yet.
+func (a *asyncDeliverer) Inflight() int64 {
+	return atomic.LoadInt64(&a.inflight)
+}
+
+// Drain waits up to timeout for accepted logs to be written, counting any
+// that are left as dropped.
+func (a *asyncDeliverer) Drain(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for a.Inflight() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := a.Inflight(); n > 0 {
+		a.dropped.Inc(n)
+		log.WithFields(log.Fields{"ns": "async", "at": "drain", "dropped": n}).Error("Gave up waiting for queued logs to be written")
+	}
+}
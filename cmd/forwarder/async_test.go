@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/heroku/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAsyncDeliverer(capacity int, highWater int) *asyncDeliverer {
+	config := IssConfig{AsyncHighWater: highWater, MetricsRegistry: metrics.NewRegistry()}
+	return newAsyncDeliverer(config, make(chan payload, capacity))
+}
+
+func testAsyncPayload(numLogs int64) payload {
+	p := NewPayload("1.2.3.4", "", []byte("hi"))
+	p.NumLogs = numLogs
+	return p
+}
+
+func TestAsyncDelivererHighWater(t *testing.T) {
+	assert := assert.New(t)
+	a := newTestAsyncDeliverer(4, 2)
+
+	assert.NoError(a.Deliver(testAsyncPayload(3)))
+	assert.NoError(a.Deliver(testAsyncPayload(3)))
+	assert.Equal(errQueueFull, a.Deliver(testAsyncPayload(5)))
+
+	assert.Equal(int64(6), a.accepted.Count())
+	assert.Equal(int64(5), a.rejected.Count())
+	assert.Equal(int64(6), a.Inflight())
+
+	// Taking a payload off the queue makes room again
+	<-a.Inbox
+	assert.NoError(a.Deliver(testAsyncPayload(1)))
+}
+
+func TestAsyncDelivererHighWaterDefaultsToCapacity(t *testing.T) {
+	assert.Equal(t, 4, newTestAsyncDeliverer(4, 0).HighWater)
+	assert.Equal(t, 4, newTestAsyncDeliverer(4, 10).HighWater)
+}
+
+func TestAsyncDelivererDelivered(t *testing.T) {
+	assert := assert.New(t)
+	a := newTestAsyncDeliverer(4, 4)
+
+	assert.NoError(a.Deliver(testAsyncPayload(2)))
+	p := <-a.Inbox
+	p.WaitCh <- struct{}{}
+
+	a.Drain(time.Second)
+	assert.Equal(int64(2), a.delivered.Count())
+	assert.Equal(int64(0), a.dropped.Count())
+	assert.Equal(int64(0), a.Inflight())
+}
+
+func TestAsyncDelivererDrainDropped(t *testing.T) {
+	assert := assert.New(t)
+	a := newTestAsyncDeliverer(4, 4)
+
+	assert.NoError(a.Deliver(testAsyncPayload(2)))
+	a.Drain(20 * time.Millisecond)
+	assert.Equal(int64(0), a.delivered.Count())
+	assert.Equal(int64(2), a.dropped.Count())
+}
+
+func TestHTTPProcessAsyncAck(t *testing.T) {
+	assert := assert.New(t)
+	config := getConfig()
+	config.AsyncAck = true
+	a := newTestAsyncDeliverer(1, 1)
+	s := newHTTPServer(*config, nil, fix, a)
+
+	in := []byte("64 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - - hi\n")
+	err, status := s.process(simpleHttpRequest(), bytes.NewReader(in), "1.2.3.4", "", "", "", nil)
+	assert.NoError(err)
+	assert.Equal(http.StatusAccepted, status)
+
+	err, status = s.process(simpleHttpRequest(), bytes.NewReader(in), "1.2.3.4", "", "", "", nil)
+	assert.Error(err)
+	assert.Equal(http.StatusTooManyRequests, status)
+
+	// Queued logs are only counted as sent once they're written
+	assert.Equal(int64(1), s.pLogsEnqueued.Count())
+	assert.Equal(int64(0), s.pLogsSent.Count())
+	p := <-a.Inbox
+	p.WaitCh <- struct{}{}
+	waitUntil(t, "the logs to be counted as sent", func() bool { return s.pLogsSent.Count() == 1 })
+}
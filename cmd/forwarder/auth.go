@@ -21,11 +21,39 @@ import (
 // credentials are used by basic auth and include the hash of a valid password, plus
 // a "stage" string which is used to emit metrics that are useful when managing credrolls, so that
 // we can track whether or not deprecated passwords are still in use.
+// Credentials may also be limited to a window of time, and deprecate themselves
+// once DeprecatedAfter has passed, so that a credroll needn't be finished by hand.
 type credential struct {
-	Name       string `json:"name"`
-	Stage      string `json:"stage"`
-	Deprecated bool   `json:"deprecated"`
-	Hmac       string `json:"hmac"`
+	Name            string     `json:"name"`
+	Stage           string     `json:"stage"`
+	Deprecated      bool       `json:"deprecated"`
+	Hmac            string     `json:"hmac"`
+	RateLimit       string     `json:"rate_limit,omitempty"` // optional per user limit, as in RATE_LIMITS
+	NotBefore       *time.Time `json:"not_before,omitempty"`
+	ExpiresAt       *time.Time `json:"expires_at,omitempty"`
+	DeprecatedAfter *time.Time `json:"deprecated_after,omitempty"`
+
+	metricsName string // name to count the credential under in metrics, if not Name
+}
+
+var (
+	errCredentialNotYetValid = errors.New("credential not yet valid")
+	errCredentialExpired     = errors.New("credential expired")
+)
+
+// at returns c as it stands at now: deprecated once past DeprecatedAfter, or
+// an error if now is outside of NotBefore and ExpiresAt.
+func (c credential) at(now time.Time) (credential, error) {
+	if c.NotBefore != nil && now.Before(*c.NotBefore) {
+		return c, errCredentialNotYetValid
+	}
+	if c.ExpiresAt != nil && !now.Before(*c.ExpiresAt) {
+		return c, errCredentialExpired
+	}
+	if c.DeprecatedAfter != nil && !now.Before(*c.DeprecatedAfter) {
+		c.Deprecated = true
+	}
+	return c, nil
 }
 
 func newAuth(config AuthConfig, registry metrics.Registry) (*BasicAuth, error) {
@@ -33,8 +61,12 @@ func newAuth(config AuthConfig, registry metrics.Registry) (*BasicAuth, error) {
 		return nil, errors.New("RedisKey must be set if RedisUrl is set")
 	}
 
-	if config.RedisUrl == "" && config.Tokens == "" {
-		return nil, errors.New("At least one of RedisUrl or Tokens must be set.")
+	if config.RedisUrl == "" && (config.CredentialChannel != "" || config.CredentialKeyspaceNotifications) {
+		return nil, errors.New("RedisUrl must be set to subscribe to credential changes")
+	}
+
+	if config.RedisUrl == "" && config.Tokens == "" && config.BearerTokens == "" && config.HmacAuthKeys == "" && config.JwtJwks == "" && config.ClientCerts == "" {
+		return nil, errors.New("At least one of RedisUrl, Tokens, BearerTokens, HmacAuthKeys, JwtJwks or ClientCerts must be set.")
 	}
 
 	result, err := NewBasicAuthFromString(config.Tokens, config.HmacKey, registry)
@@ -54,6 +86,10 @@ func newAuth(config AuthConfig, registry metrics.Registry) (*BasicAuth, error) {
 	}
 	client := redis.NewClient(opt)
 
+	result.Lock()
+	result.refreshing = true
+	result.Unlock()
+
 	// Refresh forever.
 	go result.startRefresh(client, config, registry)
 
@@ -61,22 +97,50 @@ func newAuth(config AuthConfig, registry metrics.Registry) (*BasicAuth, error) {
 }
 
 func (auth *BasicAuth) startRefresh(client *redis.Client, config AuthConfig, registry metrics.Registry) {
+	notices := make(chan credentialNotice, 1)
+	if channels := credentialChannels(config, client.Options().DB); len(channels) > 0 {
+		go subscribeCredentials(client, channels, notices, registry)
+	}
+
+	ticker := time.NewTicker(config.RefreshInterval)
+	auth.refreshLoop(client, config, ticker.C, notices, registry)
+}
+
+// refreshLoop refreshes credentials right away, then on every tick and every
+// notice of a change, until ticks is closed.
+func (auth *BasicAuth) refreshLoop(client redis.Cmdable, config AuthConfig, ticks <-chan time.Time, notices <-chan credentialNotice, registry metrics.Registry) {
 	pChanges := metrics.GetOrRegisterCounter("log-iss.auth_refresh.changes.g", registry)
 	pFailures := metrics.GetOrRegisterCounter("log-iss.auth_refresh.failures.g", registry)
 	pSuccesses := metrics.GetOrRegisterCounter("log-iss.auth_refresh.successes.g", registry)
-	ticker := time.NewTicker(config.RefreshInterval)
+	pLatency := metrics.GetOrRegisterTimer("log-iss.auth_refresh.push.latency.g", registry)
 
-	for ; true; <-ticker.C {
+	var notice credentialNotice
+	for {
 		changed, err := auth.refresh(client, config.HmacKey, config.RedisKey, config.Tokens)
 		if err == nil {
+			auth.Lock()
+			auth.lastRefresh = time.Now()
+			auth.Unlock()
 			pSuccesses.Inc(1)
 			if changed {
 				pChanges.Inc(1)
 			}
-			continue
+			if !notice.PublishedAt.IsZero() {
+				pLatency.UpdateSince(notice.PublishedAt)
+			}
+		} else {
+			log.WithFields(log.Fields{"ns": "auth", "at": "error", "refresh": true, "message": err.Error()}).Info()
+			pFailures.Inc(1)
+		}
+
+		notice = credentialNotice{}
+		select {
+		case _, ok := <-ticks:
+			if !ok {
+				return
+			}
+		case notice = <-notices:
 		}
-		log.WithFields(log.Fields{"ns": "auth", "at": "error", "refresh": true, "message": err.Error()}).Info()
-		pFailures.Inc(1)
 	}
 }
 
@@ -124,9 +188,13 @@ func (ba *BasicAuth) refresh(client redis.Cmdable, hmacKey string, redisKey stri
 // password for the same user and is safe for concurrent use.
 type BasicAuth struct {
 	sync.RWMutex
-	creds    map[string][]credential
-	hmacKey  string
-	registry metrics.Registry
+	creds       map[string][]credential
+	hmacKey     string
+	registry    metrics.Registry
+	created     time.Time
+	refreshing  bool      // whether credentials are refreshed from Redis
+	lastRefresh time.Time // last successful refresh
+	now         func() time.Time
 }
 
 // NewBasicAuthFromString creates and populates a BasicAuth from the provided
@@ -162,7 +230,21 @@ func NewBasicAuth(registry metrics.Registry, hmacKey string) *BasicAuth {
 		creds:    make(map[string][]credential),
 		hmacKey:  hmacKey,
 		registry: registry,
+		created:  time.Now(),
+		now:      time.Now,
+	}
+}
+
+// LastRefresh returns when credentials were last refreshed from Redis, or
+// when ba was created if they haven't been yet. ok is false if credentials
+// aren't refreshed at all.
+func (ba *BasicAuth) LastRefresh() (t time.Time, ok bool) {
+	ba.RLock()
+	defer ba.RUnlock()
+	if ba.lastRefresh.IsZero() {
+		return ba.created, ba.refreshing
 	}
+	return ba.lastRefresh, ba.refreshing
 }
 
 // AddPrincipal add's a user/password combo to the list of valid combinations
@@ -178,8 +260,18 @@ func (ba *BasicAuth) AddPrincipal(user string, hmac string, stage string) {
 
 // Authenticate returns the credential used to authenticate if the Request has a valid BasicAuth signature and
 // that signature encodes a known username/password combo.
-func (ba *BasicAuth) Authenticate(r *http.Request) *credential {
+func (ba *BasicAuth) Authenticate(r *http.Request) (cred *credential) {
+	_, span := startSpan(r.Context(), "BasicAuth.Authenticate", spanKindInternal)
+	defer func() {
+		span.SetAttribute("log_iss.authenticated", cred != nil)
+		if cred != nil {
+			span.SetAttribute("log_iss.credential_stage", cred.Stage)
+		}
+		span.End()
+	}()
+
 	user, pass, ok := r.BasicAuth()
+	span.SetAttribute("log_iss.auth_user", user)
 	if !ok {
 		log.WithFields(log.Fields{"ns": "auth", "at": "failure", "no_basic_auth": true}).Info()
 		return nil
@@ -194,16 +286,39 @@ func (ba *BasicAuth) Authenticate(r *http.Request) *credential {
 		return nil
 	}
 
+	// A password may match several credentials mid-roll, only one of
+	// which need be valid.
+	var invalid *credential
+	var invalidErr error
+	now := ba.now()
 	for _, c := range credentials {
 		if c.Hmac == hmacEncode(ba.hmacKey, pass) {
-			countName := fmt.Sprintf("log-iss.auth.%s.%s.successes.g", user, c.Stage)
-			counter := metrics.GetOrRegisterCounter(countName, ba.registry)
-			counter.Inc(1)
+			c, err := c.at(now)
+			if err != nil {
+				if invalid == nil {
+					invalid, invalidErr = &c, err
+				}
+				continue
+			}
+			countAuthSuccess(ba.registry, user, c.Stage)
 			return &c
 		}
 	}
-	countName := fmt.Sprintf("log-iss.auth.%s.failures.g", user)
-	counter := metrics.GetOrRegisterCounter(countName, ba.registry)
-	counter.Inc(1)
+
+	if invalid != nil {
+		fields := log.Fields{"ns": "auth", "at": "failure", "user": user, "stage": invalid.Stage}
+		if invalidErr == errCredentialExpired {
+			fields["credential_expired"] = true
+			fields["expires_at"] = invalid.ExpiresAt.Format(time.RFC3339)
+			metrics.GetOrRegisterCounter(fmt.Sprintf("log-iss.auth.%s.%s.expired.g", user, invalid.Stage), ba.registry).Inc(1)
+		} else {
+			fields["credential_not_yet_valid"] = true
+			fields["not_before"] = invalid.NotBefore.Format(time.RFC3339)
+			metrics.GetOrRegisterCounter(fmt.Sprintf("log-iss.auth.%s.%s.not_yet_valid.g", user, invalid.Stage), ba.registry).Inc(1)
+		}
+		log.WithFields(fields).Info()
+		return nil
+	}
+	countAuthFailure(ba.registry, user)
 	return nil
 }
@@ -7,6 +7,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/elliotchance/redismock"
 	"github.com/go-redis/redis"
 	"github.com/heroku/go-metrics"
@@ -224,3 +225,157 @@ func TestAuthenticate(t *testing.T) {
 		})
 	}
 }
+
+func TestRefreshLoopAppliesNotices(t *testing.T) {
+	assert := assert.New(t)
+	r := redismock.NewMock()
+	r.On("HGetAll").Return(redis.NewStringStringMapCmd("HGetAll")).Once()
+	r.On("HGetAll").Return(redis.NewStringStringMapResult(map[string]string{
+		"newuser": marshal([]credential{{Stage: "current", Hmac: hmacEncode("hmacKey", "newpassword")}}),
+	}, nil))
+
+	registry := metrics.NewRegistry()
+	auth := defaultCreds()
+	ticks := make(chan time.Time)
+	notices := make(chan credentialNotice)
+	done := make(chan struct{})
+	go func() {
+		auth.refreshLoop(r, AuthConfig{HmacKey: "hmacKey", RedisKey: "key", Tokens: "user:password"}, ticks, notices, registry)
+		close(done)
+	}()
+
+	notices <- credentialNotice{PublishedAt: time.Now().Add(-2 * time.Second)}
+	close(ticks)
+	<-done
+
+	assert.Equal(newSecretCreds().creds, auth.creds)
+	assert.Equal(int64(2), metrics.GetOrRegisterCounter("log-iss.auth_refresh.successes.g", registry).Count())
+	assert.Equal(int64(1), metrics.GetOrRegisterCounter("log-iss.auth_refresh.changes.g", registry).Count())
+	latency := metrics.GetOrRegisterTimer("log-iss.auth_refresh.push.latency.g", registry)
+	assert.Equal(int64(1), latency.Count())
+	assert.True(latency.Max() >= int64(2*time.Second))
+}
+
+func TestSubscribeCredentials(t *testing.T) {
+	assert := assert.New(t)
+	m := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: m.Addr()})
+	defer client.Close()
+
+	registry := metrics.NewRegistry()
+	auth := defaultCreds()
+	notices := make(chan credentialNotice, 1)
+	go subscribeCredentials(client, []string{"credentials"}, notices, registry)
+	ticks := make(chan time.Time)
+	done := make(chan struct{})
+	go func() {
+		auth.refreshLoop(client, AuthConfig{HmacKey: "hmacKey", RedisKey: "key", Tokens: "user:password"}, ticks, notices, registry)
+		close(done)
+	}()
+
+	// The first refresh finds nothing, as the key doesn't exist yet
+	successes := metrics.GetOrRegisterCounter("log-iss.auth_refresh.successes.g", registry)
+	waitUntil(t, "the first refresh", func() bool {
+		return m.PubSubNumSub("credentials")["credentials"] == 1 && successes.Count() == 1
+	})
+
+	m.HSet("key", "newuser", marshal([]credential{{Stage: "current", Hmac: hmacEncode("hmacKey", "newpassword")}}))
+	m.Publish("credentials", time.Now().Format(time.RFC3339Nano))
+	changes := metrics.GetOrRegisterCounter("log-iss.auth_refresh.changes.g", registry)
+	waitUntil(t, "the credentials to be reloaded", func() bool { return changes.Count() == 1 })
+	close(ticks)
+	<-done
+
+	assert.Equal(newSecretCreds().creds, auth.creds)
+	assert.Equal(int64(1), metrics.GetOrRegisterCounter("log-iss.auth_refresh.push.notifications.g", registry).Count())
+	assert.Equal(int64(1), metrics.GetOrRegisterTimer("log-iss.auth_refresh.push.latency.g", registry).Count())
+}
+
+// waitUntil polls cond for up to two seconds, failing t if it never holds.
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	for i := 0; !cond(); i++ {
+		if i == 200 {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestParseCredentialNotice(t *testing.T) {
+	assert := assert.New(t)
+	published := time.Date(2019, 2, 1, 12, 0, 0, 500000000, time.UTC)
+
+	n := parseCredentialNotice(&redis.Message{Payload: published.Format(time.RFC3339Nano)})
+	assert.True(published.Equal(n.PublishedAt))
+	n = parseCredentialNotice(&redis.Message{Payload: "1549022400.5"})
+	assert.True(published.Equal(n.PublishedAt))
+
+	// Keyspace notifications only name the event
+	n = parseCredentialNotice(&redis.Message{Channel: "__keyspace@0__:key", Payload: "hset"})
+	assert.True(n.PublishedAt.IsZero())
+}
+
+func TestCredentialChannels(t *testing.T) {
+	assert := assert.New(t)
+	assert.Empty(credentialChannels(AuthConfig{RedisKey: "key"}, 0))
+	assert.Equal([]string{"creds", "__keyspace@3__:key"}, credentialChannels(AuthConfig{
+		RedisKey:                        "key",
+		CredentialChannel:               "creds",
+		CredentialKeyspaceNotifications: true,
+	}, 3))
+
+	_, err := newAuth(AuthConfig{Tokens: "user:password", CredentialChannel: "creds"}, metrics.NewRegistry())
+	assert.Error(err)
+
+	notices := make(chan credentialNotice, 1)
+	first := credentialNotice{PublishedAt: time.Unix(1, 0)}
+	notifyCredentials(notices, first)
+	notifyCredentials(notices, credentialNotice{PublishedAt: time.Unix(2, 0)})
+	assert.Equal(first, <-notices)
+}
+
+func TestAuthenticateValidityWindow(t *testing.T) {
+	assert := assert.New(t)
+	r := redismock.NewMock()
+	r.On("HGetAll").Return(redis.NewStringStringMapResult(map[string]string{
+		"user": `[
+			{"stage":"previous","hmac":"` + hmacEncode("hmacKey", "old") + `","deprecated_after":"2019-02-01T00:00:00Z","expires_at":"2019-03-01T00:00:00Z"},
+			{"stage":"next","hmac":"` + hmacEncode("hmacKey", "new") + `","not_before":"2019-02-01T00:00:00Z"}
+		]`,
+	}, nil))
+
+	registry := metrics.NewRegistry()
+	auth := NewBasicAuth(registry, "hmacKey")
+	_, err := auth.refresh(r, "hmacKey", "key", "")
+	if !assert.NoError(err) {
+		return
+	}
+
+	authenticate := func(now string, password string) *credential {
+		auth.now = func() time.Time {
+			t, _ := time.Parse(time.RFC3339, now)
+			return t
+		}
+		req, _ := http.NewRequest("POST", "http://localhost", nil)
+		req.SetBasicAuth("user", password)
+		return auth.Authenticate(req)
+	}
+
+	if cred := authenticate("2019-01-15T00:00:00Z", "old"); assert.NotNil(cred) {
+		assert.False(cred.Deprecated)
+	}
+	assert.Nil(authenticate("2019-01-15T00:00:00Z", "new"))
+	assert.Equal(int64(1), metrics.GetOrRegisterCounter("log-iss.auth.user.next.not_yet_valid.g", registry).Count())
+
+	if cred := authenticate("2019-02-15T00:00:00Z", "old"); assert.NotNil(cred) {
+		assert.True(cred.Deprecated)
+	}
+	assert.NotNil(authenticate("2019-02-15T00:00:00Z", "new"))
+
+	assert.Nil(authenticate("2019-03-01T00:00:00Z", "old"))
+	assert.Equal(int64(1), metrics.GetOrRegisterCounter("log-iss.auth.user.previous.expired.g", registry).Count())
+	assert.Equal(int64(0), metrics.GetOrRegisterCounter("log-iss.auth.user.failures.g", registry).Count())
+
+	// The stored credentials aren't changed by deprecation
+	assert.False(auth.creds["user"][0].Deprecated)
+}
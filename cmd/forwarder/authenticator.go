@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/heroku/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// Authorization schemes, lower cased
+const (
+	authSchemeBasic  = "basic"
+	authSchemeBearer = "bearer"
+	authSchemeHMAC   = "hmac-sha256"
+)
+
+// authenticator returns the credential a request was authenticated with, or
+// nil if it couldn't be authenticated.
+type authenticator interface {
+	Authenticate(r *http.Request) *credential
+}
+
+// schemeAuth picks an authenticator by the scheme of the Authorization
+// header. Requests without one go to the basic authenticator, if any.
+type schemeAuth map[string]authenticator
+
+func (a schemeAuth) Authenticate(r *http.Request) *credential {
+	scheme := strings.ToLower(strings.SplitN(r.Header.Get("Authorization"), " ", 2)[0])
+	if auth, ok := a[scheme]; ok {
+		return auth.Authenticate(r)
+	}
+	if auth, ok := a[authSchemeBasic]; ok && scheme == "" {
+		return auth.Authenticate(r)
+	}
+	log.WithFields(log.Fields{"ns": "auth", "at": "failure", "scheme": scheme}).Info()
+	return nil
+}
+
+// newAuthenticator combines basic with whichever bearer token, JWT, HMAC and
+// client certificate authenticators are configured.
+func newAuthenticator(config AuthConfig, basic *BasicAuth, registry metrics.Registry) (authenticator, error) {
+	a := schemeAuth{authSchemeBasic: basic}
+
+	if config.BearerTokens != "" {
+		bearer, err := newBearerAuth(config.BearerTokens, config.HmacKey, registry)
+		if err != nil {
+			return nil, err
+		}
+		a[authSchemeBearer] = bearer
+	}
+
+	if config.JwtJwks != "" {
+		jwt, err := newJWTAuth(config, registry)
+		if err != nil {
+			return nil, err
+		}
+		// Static bearer tokens that aren't JWTs still work alongside them
+		jwt.Fallback = a[authSchemeBearer]
+		a[authSchemeBearer] = jwt
+		if config.JwtRefreshInterval > 0 {
+			go jwt.startRefresh(config.JwtRefreshInterval)
+		}
+	}
+
+	if config.HmacAuthKeys != "" {
+		signed, err := newHMACAuth(config.HmacAuthKeys, config.HmacAuthWindow, config.HmacAuthMaxBodyBytes, registry)
+		if err != nil {
+			return nil, err
+		}
+		a[authSchemeHMAC] = signed
+	}
+
+	// Client certificates take precedence over any Authorization header
+	if config.ClientCerts != "" {
+		return newCertAuth(config.ClientCerts, a, registry)
+	}
+
+	return a, nil
+}
+
+// authUser names who a request was authenticated as: the basic auth user, or
+// the credential name for other schemes.
+func authUser(r *http.Request, cred *credential) string {
+	if user, _, ok := r.BasicAuth(); ok {
+		return user
+	}
+	if cred != nil {
+		return cred.Name
+	}
+	return ""
+}
+
+// metricsUser returns the name a request's user is counted under in metrics.
+func metricsUser(r *http.Request, cred *credential) string {
+	if cred != nil && cred.metricsName != "" {
+		return cred.metricsName
+	}
+	return authUser(r, cred)
+}
+
+func countAuthSuccess(registry metrics.Registry, user string, stage string) {
+	metrics.GetOrRegisterCounter(fmt.Sprintf("log-iss.auth.%s.%s.successes.g", user, stage), registry).Inc(1)
+}
+
+func countAuthFailure(registry metrics.Registry, user string) {
+	metrics.GetOrRegisterCounter(fmt.Sprintf("log-iss.auth.%s.failures.g", user), registry).Inc(1)
+}
+
+// countSchemeAuthFailure counts a failure of a scheme whose credentials
+// aren't known by user, apart from the per-user counts.
+func countSchemeAuthFailure(registry metrics.Registry, scheme string) {
+	metrics.GetOrRegisterCounter(fmt.Sprintf("log-iss.auth.scheme.%s.failures.g", scheme), registry).Inc(1)
+}
+
+// parseSecrets parses "NAME[/STAGE[/deprecated]]:SECRET|..." into credentials
+// keyed by secret. Stage defaults to "env".
+func parseSecrets(s string) (map[string]credential, error) {
+	secrets := make(map[string]credential)
+	for _, e := range strings.Split(s, "|") {
+		parts := strings.SplitN(e, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Unable to create credentials from '%s'", e)
+		}
+
+		ident := strings.Split(parts[0], "/")
+		cred := credential{Name: ident[0], Stage: "env"}
+		if len(ident) > 1 && ident[1] != "" {
+			cred.Stage = ident[1]
+		}
+		if len(ident) > 2 {
+			if ident[2] != "deprecated" || len(ident) > 3 {
+				return nil, fmt.Errorf("Unable to create credentials from '%s'", e)
+			}
+			cred.Deprecated = true
+		}
+		secrets[parts[1]] = cred
+	}
+	return secrets, nil
+}
+
+// bearerAuth authenticates requests with static bearer tokens, as in
+// "Authorization: Bearer TOKEN". Only HMACs of the tokens are kept.
+type bearerAuth struct {
+	tokens   map[string]credential // keyed by HMAC of the token
+	hmacKey  string
+	registry metrics.Registry
+}
+
+func newBearerAuth(tokens string, hmacKey string, registry metrics.Registry) (*bearerAuth, error) {
+	secrets, err := parseSecrets(tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	ba := &bearerAuth{tokens: make(map[string]credential), hmacKey: hmacKey, registry: registry}
+	for token, cred := range secrets {
+		cred.Hmac = hmacEncode(hmacKey, token)
+		ba.tokens[cred.Hmac] = cred
+	}
+	return ba, nil
+}
+
+func (ba *bearerAuth) Authenticate(r *http.Request) (cred *credential) {
+	_, span := startSpan(r.Context(), "BearerAuth.Authenticate", spanKindInternal)
+	defer func() {
+		span.SetAttribute("log_iss.authenticated", cred != nil)
+		span.End()
+	}()
+
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 {
+		countSchemeAuthFailure(ba.registry, authSchemeBearer)
+		return nil
+	}
+
+	c, ok := ba.tokens[hmacEncode(ba.hmacKey, strings.TrimSpace(parts[1]))]
+	if !ok {
+		log.WithFields(log.Fields{"ns": "auth", "at": "failure", "scheme": authSchemeBearer}).Info()
+		countSchemeAuthFailure(ba.registry, authSchemeBearer)
+		return nil
+	}
+	countAuthSuccess(ba.registry, c.Name, c.Stage)
+	return &c
+}
+
+// hmacKey is a secret shared with a sender that signs its requests.
+type hmacKey struct {
+	secret []byte
+	cred   credential
+}
+
+// hmacAuth authenticates signed requests, as in
+//
+//	Authorization: HMAC-SHA256 keyId=ID,timestamp=UNIX,signature=HEX
+//
+// where the signature is the hex HMAC-SHA256, with the key's secret, of
+//
+//	METHOD "\n" REQUEST-URI "\n" TIMESTAMP "\n" HEX-SHA256-OF-BODY
+//
+// Requests with timestamps more than Window away from now are rejected, as
+// are signatures already seen within the window.
+type hmacAuth struct {
+	sync.Mutex
+	Window    time.Duration
+	MaxBody   int64              // largest body that is read to check its digest
+	keys      map[string]hmacKey // keyed by key id
+	seen      map[string]time.Time
+	lastSweep time.Time
+	registry  metrics.Registry
+	now       func() time.Time
+	replays   metrics.Counter // counts rejected replays
+	expired   metrics.Counter // counts timestamps outside the window
+}
+
+func newHMACAuth(keys string, window time.Duration, maxBody int64, registry metrics.Registry) (*hmacAuth, error) {
+	secrets, err := parseSecrets(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	ha := &hmacAuth{
+		Window:   window,
+		MaxBody:  maxBody,
+		keys:     make(map[string]hmacKey),
+		seen:     make(map[string]time.Time),
+		registry: registry,
+		now:      time.Now,
+		replays:  metrics.GetOrRegisterCounter("log-iss.auth.hmac.replays.g", registry),
+		expired:  metrics.GetOrRegisterCounter("log-iss.auth.hmac.expired.g", registry),
+	}
+	for secret, cred := range secrets {
+		ha.keys[cred.Name] = hmacKey{secret: []byte(secret), cred: cred}
+	}
+	return ha, nil
+}
+
+// parseHMACAuthorization parses the params of an HMAC-SHA256 Authorization
+// header.
+func parseHMACAuthorization(h string) (keyID string, ts int64, sig []byte, err error) {
+	parts := strings.SplitN(h, " ", 2)
+	if len(parts) != 2 {
+		return "", 0, nil, errors.New("missing params")
+	}
+
+	params := make(map[string]string)
+	for _, p := range strings.Split(parts[1], ",") {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = strings.Trim(kv[1], `"`)
+		}
+	}
+
+	keyID = params["keyId"]
+	if keyID == "" {
+		return "", 0, nil, errors.New("missing keyId")
+	}
+	ts, err = strconv.ParseInt(params["timestamp"], 10, 64)
+	if err != nil {
+		return "", 0, nil, errors.New("invalid timestamp")
+	}
+	sig, err = hex.DecodeString(params["signature"])
+	if err != nil || len(sig) == 0 {
+		return "", 0, nil, errors.New("invalid signature")
+	}
+	return keyID, ts, sig, nil
+}
+
+// hmacSignature computes the signature of a request with the given body.
+func hmacSignature(secret []byte, method string, requestURI string, ts int64, body []byte) []byte {
+	digest := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(method + "\n" + requestURI + "\n" + strconv.FormatInt(ts, 10) + "\n" + hex.EncodeToString(digest[:])))
+	return mac.Sum(nil)
+}
+
+func (ha *hmacAuth) Authenticate(r *http.Request) (cred *credential) {
+	_, span := startSpan(r.Context(), "HMACAuth.Authenticate", spanKindInternal)
+	defer func() {
+		span.SetAttribute("log_iss.authenticated", cred != nil)
+		span.End()
+	}()
+
+	fail := func(keyID string, reason string) *credential {
+		log.WithFields(log.Fields{"ns": "auth", "at": "failure", "scheme": authSchemeHMAC, "key_id": keyID, "reason": reason}).Info()
+		countSchemeAuthFailure(ha.registry, authSchemeHMAC)
+		return nil
+	}
+
+	keyID, ts, sig, err := parseHMACAuthorization(r.Header.Get("Authorization"))
+	if err != nil {
+		return fail(keyID, err.Error())
+	}
+	key, ok := ha.keys[keyID]
+	if !ok {
+		return fail(keyID, "unknown keyId")
+	}
+
+	now := ha.now()
+	signedAt := time.Unix(ts, 0)
+	if signedAt.Before(now.Add(-ha.Window)) || signedAt.After(now.Add(ha.Window)) {
+		ha.expired.Inc(1)
+		return fail(keyID, "timestamp outside window")
+	}
+
+	// The body is read here to check its digest and put back for the handler,
+	// so it's limited before the signature can be checked.
+	if r.ContentLength > ha.MaxBody {
+		return fail(keyID, "body too large")
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, ha.MaxBody+1))
+	if err != nil {
+		return fail(keyID, "unable to read body")
+	}
+	if int64(len(body)) > ha.MaxBody {
+		return fail(keyID, "body too large")
+	}
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if !hmac.Equal(sig, hmacSignature(key.secret, r.Method, r.URL.RequestURI(), ts, body)) {
+		return fail(keyID, "signature mismatch")
+	}
+
+	if !ha.markSeen(string(sig), signedAt.Add(ha.Window), now) {
+		ha.replays.Inc(1)
+		return fail(keyID, "replayed")
+	}
+
+	c := key.cred
+	countAuthSuccess(ha.registry, c.Name, c.Stage)
+	return &c
+}
+
+// markSeen records a signature until it expires, returning false if it was
+// already recorded.
+func (ha *hmacAuth) markSeen(sig string, expires time.Time, now time.Time) bool {
+	ha.Lock()
+	defer ha.Unlock()
+
+	if now.Sub(ha.lastSweep) >= ha.Window {
+		ha.lastSweep = now
+		for s, exp := range ha.seen {
+			if now.After(exp) {
+				delete(ha.seen, s)
+			}
+		}
+	}
+
+	if _, ok := ha.seen[sig]; ok {
+		return false
+	}
+	ha.seen[sig] = expires
+	return true
+}
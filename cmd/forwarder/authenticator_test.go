@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/heroku/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func signedRequest(t *testing.T, keyID string, secret string, ts time.Time, body string) *http.Request {
+	r, err := http.NewRequest("POST", "http://localhost/logs?index=1", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := hmacSignature([]byte(secret), "POST", "/logs?index=1", ts.Unix(), []byte(body))
+	r.Header.Set("Authorization", fmt.Sprintf("HMAC-SHA256 keyId=%s,timestamp=%d,signature=%s", keyID, ts.Unix(), hex.EncodeToString(sig)))
+	return r
+}
+
+func TestParseSecrets(t *testing.T) {
+	assert := assert.New(t)
+
+	secrets, err := parseSecrets("a:s1|b/current:s2|c/previous/deprecated:s3")
+	assert.NoError(err)
+	assert.Equal(map[string]credential{
+		"s1": {Name: "a", Stage: "env"},
+		"s2": {Name: "b", Stage: "current"},
+		"s3": {Name: "c", Stage: "previous", Deprecated: true},
+	}, secrets)
+
+	for _, s := range []string{"", "a", "a:", ":s", "a/b/old:s", "a/b/deprecated/x:s"} {
+		_, err := parseSecrets(s)
+		assert.Error(err, s)
+	}
+}
+
+func TestSchemeAuth(t *testing.T) {
+	assert := assert.New(t)
+	registry := metrics.NewRegistry()
+
+	basic, err := NewBasicAuthFromString("user:password", "hmacKey", registry)
+	assert.NoError(err)
+	auth, err := newAuthenticator(AuthConfig{HmacKey: "hmacKey", BearerTokens: "drain/current:tok"}, basic, registry)
+	assert.NoError(err)
+
+	r, _ := http.NewRequest("POST", "http://localhost/logs", nil)
+	r.SetBasicAuth("user", "password")
+	if cred := auth.Authenticate(r); assert.NotNil(cred) {
+		assert.Equal("env", cred.Stage)
+		assert.Equal("user", authUser(r, cred))
+	}
+
+	r.Header.Set("Authorization", "bEaReR tok")
+	if cred := auth.Authenticate(r); assert.NotNil(cred) {
+		assert.Equal(credential{Name: "drain", Stage: "current", Hmac: hmacEncode("hmacKey", "tok")}, *cred)
+		assert.Equal("drain", authUser(r, cred))
+	}
+	assert.Equal(int64(1), metrics.GetOrRegisterCounter("log-iss.auth.drain.current.successes.g", registry).Count())
+
+	r.Header.Set("Authorization", "Bearer nope")
+	assert.Nil(auth.Authenticate(r))
+	assert.Equal(int64(1), metrics.GetOrRegisterCounter("log-iss.auth.scheme.bearer.failures.g", registry).Count())
+	assert.Nil(registry.Get("log-iss.auth.bearer.failures.g"), "a user could be called bearer")
+
+	// HMAC signing isn't configured
+	r.Header.Set("Authorization", "HMAC-SHA256 keyId=a")
+	assert.Nil(auth.Authenticate(r))
+
+	r.Header.Del("Authorization")
+	assert.Nil(auth.Authenticate(r))
+}
+
+func TestHMACAuth(t *testing.T) {
+	assert := assert.New(t)
+	registry := metrics.NewRegistry()
+	ha, err := newHMACAuth("sender/next/deprecated:secret", 5*time.Minute, 16, registry)
+	assert.NoError(err)
+	now := time.Now()
+	ha.now = func() time.Time { return now }
+
+	r := signedRequest(t, "sender", "secret", now.Add(-time.Minute), "body")
+	if cred := ha.Authenticate(r); assert.NotNil(cred) {
+		assert.Equal(credential{Name: "sender", Stage: "next", Deprecated: true}, *cred)
+	}
+	b, _ := ioutil.ReadAll(r.Body)
+	assert.Equal("body", string(b), "body is restored for the handler")
+
+	// The same signature can't be used twice
+	assert.Nil(ha.Authenticate(signedRequest(t, "sender", "secret", now.Add(-time.Minute), "body")))
+	assert.Equal(int64(1), ha.replays.Count())
+
+	assert.Nil(ha.Authenticate(signedRequest(t, "sender", "secret", now.Add(-6*time.Minute), "body")))
+	assert.Nil(ha.Authenticate(signedRequest(t, "sender", "secret", now.Add(6*time.Minute), "body")))
+	assert.Equal(int64(2), ha.expired.Count())
+
+	assert.Nil(ha.Authenticate(signedRequest(t, "sender", "wrong", now, "body")))
+	assert.Nil(ha.Authenticate(signedRequest(t, "other", "secret", now, "body")))
+
+	// The body is covered by the signature
+	r = signedRequest(t, "sender", "secret", now, "body")
+	r.Body = ioutil.NopCloser(strings.NewReader("tampered"))
+	assert.Nil(ha.Authenticate(r))
+
+	// Bodies over MaxBody aren't read, whether or not their length is known
+	assert.Nil(ha.Authenticate(signedRequest(t, "sender", "secret", now, strings.Repeat("a", 17))))
+	r = signedRequest(t, "sender", "secret", now, strings.Repeat("a", 17))
+	r.ContentLength = -1
+	assert.Nil(ha.Authenticate(r))
+	assert.NotNil(ha.Authenticate(signedRequest(t, "sender", "secret", now.Add(time.Second), strings.Repeat("a", 16))))
+
+	assert.Equal(int64(8), metrics.GetOrRegisterCounter("log-iss.auth.scheme.hmac-sha256.failures.g", registry).Count())
+
+	// Old signatures are swept once they're outside the window
+	now = now.Add(10 * time.Minute)
+	assert.NotNil(ha.Authenticate(signedRequest(t, "sender", "secret", now, "body")))
+	assert.Len(ha.seen, 1)
+}
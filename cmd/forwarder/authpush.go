@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/heroku/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// How long to wait between attempts to subscribe to credential changes
+const credentialSubscribeRetry = 5 * time.Second
+
+// credentialNotice tells refreshLoop that credentials have changed in Redis.
+type credentialNotice struct {
+	PublishedAt time.Time // when the change was published, if known
+}
+
+// credentialChannels lists the Redis channels that announce changes to the
+// credentials: the configured pub/sub channel, and the keyspace notification
+// channel of RedisKey if enabled.
+func credentialChannels(config AuthConfig, db int) []string {
+	var channels []string
+	if config.CredentialChannel != "" {
+		channels = append(channels, config.CredentialChannel)
+	}
+	if config.CredentialKeyspaceNotifications {
+		channels = append(channels, fmt.Sprintf("__keyspace@%d__:%s", db, config.RedisKey))
+	}
+	return channels
+}
+
+// parseCredentialNotice reads the publish time from a message, which is an
+// RFC 3339 timestamp or a number of seconds since the epoch. Other payloads,
+// such as keyspace notification events, still announce a change but have no
+// publish time.
+func parseCredentialNotice(msg *redis.Message) credentialNotice {
+	payload := strings.TrimSpace(msg.Payload)
+	if t, err := time.Parse(time.RFC3339Nano, payload); err == nil {
+		return credentialNotice{PublishedAt: t}
+	}
+	if secs, err := strconv.ParseFloat(payload, 64); err == nil && secs > 0 {
+		return credentialNotice{PublishedAt: time.Unix(0, int64(secs*float64(time.Second)))}
+	}
+	return credentialNotice{}
+}
+
+// notifyCredentials passes n on without blocking. A notice that's already
+// pending covers this change too, and has the earlier publish time.
+func notifyCredentials(notices chan<- credentialNotice, n credentialNotice) {
+	select {
+	case notices <- n:
+	default:
+	}
+}
+
+// subscribeCredentials sends a notice for every message on channels, forever.
+// Messages published while disconnected are missed, which polling makes up
+// for.
+func subscribeCredentials(client *redis.Client, channels []string, notices chan<- credentialNotice, registry metrics.Registry) {
+	pNotifications := metrics.GetOrRegisterCounter("log-iss.auth_refresh.push.notifications.g", registry)
+	pErrors := metrics.GetOrRegisterCounter("log-iss.auth_refresh.push.errors.g", registry)
+
+	pubsub := client.Subscribe(channels...)
+	defer pubsub.Close()
+	for {
+		_, err := pubsub.Receive()
+		if err == nil {
+			break
+		}
+		log.WithFields(log.Fields{"ns": "auth", "at": "error", "subscribe": true, "message": err.Error()}).Info()
+		pErrors.Inc(1)
+		time.Sleep(credentialSubscribeRetry)
+	}
+	log.WithFields(log.Fields{"ns": "auth", "at": "subscribed", "channels": strings.Join(channels, ",")}).Info()
+
+	for msg := range pubsub.Channel() {
+		pNotifications.Inc(1)
+		notifyCredentials(notices, parseCredentialNotice(msg))
+	}
+}
@@ -1,10 +1,7 @@
 package main
 
 import (
-	"crypto/tls"
-	"crypto/x509"
-	"fmt"
-	"io/ioutil"
+	"errors"
 	"strings"
 	"time"
 
@@ -14,31 +11,122 @@ import (
 )
 
 type IssConfig struct {
-	Deploy                    string        `env:"DEPLOY,required"`
-	ForwardDest               string        `env:"FORWARD_DEST,required"`
-	ForwardDestConnectTimeout time.Duration `env:"FORWARD_DEST_CONNECT_TIMEOUT,default=10s"`
-	ForwardCount              int           `env:"FORWARD_COUNT,default=4"`
-	HttpPort                  string        `env:"PORT,required"`
-	EnforceSsl                bool          `env:"ENFORCE_SSL,default=false"`
-	PemFile                   string        `env:"PEMFILE"`
-	LibratoSource             string        `env:"LIBRATO_SOURCE"`
-	LibratoOwner              string        `env:"LIBRATO_OWNER"`
-	LibratoToken              string        `env:"LIBRATO_TOKEN"`
-	Dyno                      string        `env:"DYNO"`
-	MetadataId                string        `env:"METADATA_ID"`
-	Debug                     bool          `env:"LOG_ISS_DEBUG"`
-	QueryFieldParams          []string      `env:"LOG_ISS_FIELD_PARAMS"`
-	QueryParams               []string      `env:"LOG_ISS_QUERY_PARAMS"`
-	TlsConfig                 *tls.Config
-	MetricsRegistry           metrics.Registry
+	Deploy                      string        `env:"DEPLOY,required"`
+	ForwardDests                []string      `env:"FORWARD_DEST,required"`
+	ForwardDestConnectTimeout   time.Duration `env:"FORWARD_DEST_CONNECT_TIMEOUT,default=10s"`
+	ForwardDestKeepAlive        time.Duration `env:"FORWARD_DEST_KEEPALIVE,default=30s"`
+	ForwardDestHandshakeTimeout time.Duration `env:"FORWARD_DEST_TLS_HANDSHAKE_TIMEOUT,default=10s"`
+	ForwardDestBackoffMin       time.Duration `env:"FORWARD_DEST_BACKOFF_MIN,default=200ms"`
+	ForwardDestBackoffMax       time.Duration `env:"FORWARD_DEST_BACKOFF_MAX,default=30s"`
+	ForwardDestBackoffJitter    float64       `env:"FORWARD_DEST_BACKOFF_JITTER,default=0.5"`
+	ForwardFailoverThreshold    int           `env:"FORWARD_FAILOVER_THRESHOLD,default=3"`
+	ForwardFailbackInterval     time.Duration `env:"FORWARD_FAILBACK_INTERVAL,default=30s"`
+	ForwardCount                int           `env:"FORWARD_COUNT,default=4"`
+	SpoolDir                    string        `env:"SPOOL_DIR"`
+	SpoolMaxBytes               int64         `env:"SPOOL_MAX_BYTES,default=1073741824"`
+	SpoolMaxAge                 time.Duration `env:"SPOOL_MAX_AGE,default=24h"`
+	SpoolSegmentBytes           int64         `env:"SPOOL_SEGMENT_BYTES,default=16777216"`
+	SpoolFsync                  bool          `env:"SPOOL_FSYNC,default=false"`
+	AsyncAck                    bool          `env:"ASYNC_ACK,default=false"`
+	AsyncHighWater              int           `env:"ASYNC_HIGH_WATER,default=800"`
+	AsyncDrainTimeout           time.Duration `env:"ASYNC_DRAIN_TIMEOUT,default=10s"`
+	RateLimits                  []string      `env:"RATE_LIMITS"`
+	PrometheusMetrics           bool          `env:"PROMETHEUS_METRICS,default=false"`
+	PrometheusMetricsPort       string        `env:"PROMETHEUS_METRICS_PORT"`
+	TraceEndpoint               string        `env:"OTEL_EXPORTER_OTLP_ENDPOINT"`
+	TraceServiceName            string        `env:"OTEL_SERVICE_NAME,default=log-iss"`
+	TraceSampleRatio            float64       `env:"TRACE_SAMPLE_RATIO,default=1"`
+	ReadyMinConnectedForwarders int           `env:"READY_MIN_CONNECTED_FORWARDERS,default=1"`
+	ReadyMaxInboxFill           float64       `env:"READY_MAX_INBOX_FILL,default=0.9"`
+	ReadyMaxWriteAge            time.Duration `env:"READY_MAX_WRITE_AGE,default=1m"`
+	ReadyMaxCredentialAge       time.Duration `env:"READY_MAX_CREDENTIAL_AGE,default=10m"`
+	AccessLog                   string        `env:"ACCESS_LOG"`
+	AccessLogSampleRate         float64       `env:"ACCESS_LOG_SAMPLE_RATE,default=1"`
+	HttpPort                    string        `env:"PORT,required"`
+	HttpTlsCertFile             string        `env:"HTTP_TLS_CERT_FILE"`
+	HttpTlsKeyFile              string        `env:"HTTP_TLS_KEY_FILE"`
+	HttpTlsClientCAFile         string        `env:"HTTP_TLS_CLIENT_CA_FILE"`
+	HttpTlsClientAuth           string        `env:"HTTP_TLS_CLIENT_AUTH,default=optional"`
+	HttpTlsMinVersion           string        `env:"HTTP_TLS_MIN_VERSION,default=1.2"`
+	SyslogTcpPort               string        `env:"SYSLOG_TCP_PORT"`
+	SyslogUdpPort               string        `env:"SYSLOG_UDP_PORT"`
+	SyslogTlsPort               string        `env:"SYSLOG_TLS_PORT"`
+	SyslogTlsCertFile           string        `env:"SYSLOG_TLS_CERT_FILE"`
+	SyslogTlsKeyFile            string        `env:"SYSLOG_TLS_KEY_FILE"`
+	SyslogTlsClientCAFile       string        `env:"SYSLOG_TLS_CLIENT_CA_FILE"`
+	SyslogAllowedCIDRs          []string      `env:"SYSLOG_ALLOWED_CIDRS"`
+	SyslogMaxMessageBytes       int           `env:"SYSLOG_MAX_MESSAGE_BYTES,default=65536"`
+	EnforceSsl                  bool          `env:"ENFORCE_SSL,default=false"`
+	PemFile                     string        `env:"PEMFILE"`
+	ForwardTls                  bool          `env:"FORWARD_TLS,default=false"`
+	ForwardTlsCertFile          string        `env:"FORWARD_TLS_CERT_FILE"`
+	ForwardTlsKeyFile           string        `env:"FORWARD_TLS_KEY_FILE"`
+	ForwardTlsServerName        string        `env:"FORWARD_TLS_SERVER_NAME"`
+	ForwardTlsVerify            string        `env:"FORWARD_TLS_VERIFY,default=full"`
+	ForwardTlsMinVersion        string        `env:"FORWARD_TLS_MIN_VERSION,default=1.2"`
+	ForwardTlsCipherSuites      []string      `env:"FORWARD_TLS_CIPHER_SUITES"`
+	ForwardTlsReloadInterval    time.Duration `env:"FORWARD_TLS_RELOAD_INTERVAL,default=1m"`
+	OutputFormat                string        `env:"OUTPUT_FORMAT,default=rfc5424"`
+	OutputFraming               string        `env:"OUTPUT_FRAMING,default=octet-counting"`
+	LibratoSource               string        `env:"LIBRATO_SOURCE"`
+	LibratoOwner                string        `env:"LIBRATO_OWNER"`
+	LibratoToken                string        `env:"LIBRATO_TOKEN"`
+	Dyno                        string        `env:"DYNO"`
+	MetadataId                  string        `env:"METADATA_ID"`
+	MetadataInvalidValues       string        `env:"METADATA_INVALID_VALUES,default=sanitize"`
+	ValidationMode              string        `env:"VALIDATION_MODE,default=off"`
+	ValidationRejectRequests    bool          `env:"VALIDATION_REJECT_REQUESTS,default=false"`
+	RulesFile                   string        `env:"RULES_FILE"`
+	RouteDests                  []string      `env:"ROUTE_DESTS"`
+	Redact                      []string      `env:"REDACT"`
+	RedactPatternsFile          string        `env:"REDACT_PATTERNS_FILE"`
+	RedactAction                string        `env:"REDACT_ACTION,default=mask"`
+	RedactHmacKey               string        `env:"REDACT_HMAC_KEY"`
+	SampleRates                 []string      `env:"SAMPLE_RATES"`
+	SampleExemptSeverity        int           `env:"SAMPLE_EXEMPT_SEVERITY,default=3"`
+	DedupWindow                 time.Duration `env:"DEDUP_WINDOW,default=0"`
+	Debug                       bool          `env:"LOG_ISS_DEBUG"`
+	QueryFieldParams            []string      `env:"LOG_ISS_FIELD_PARAMS"`
+	QueryParams                 []string      `env:"LOG_ISS_QUERY_PARAMS"`
+	TlsConfig                   *tlsReloader
+	HttpTlsConfig               *serverTLSReloader
+	OutputEncoder               *outputEncoder
+	RateLimiter                 *rateLimiter
+	Validator                   *validator
+	Rules                       *ruleSet
+	RouteDestinations           map[string][]string
+	Redactor                    *redactor
+	Sampler                     *sampler
+	Deduper                     *deduper
+	Tracer                      *tracer
+	AccessLogger                *accessLogger
+	MetricsRegistry             metrics.Registry
 }
 
 type AuthConfig struct {
-	HmacKey         string        `env:"HMAC_KEY,required"`
-	RedisUrl        string        `env:"REDIS_URL"`
-	RedisKey        string        `env:"REDIS_KEY"`
-	RefreshInterval time.Duration `env:"CREDENTIAL_REFRESH_INTERVAL,default=1m,strict"`
-	Tokens          string        `env:"TOKEN_MAP"`
+	HmacKey              string        `env:"HMAC_KEY,required"`
+	RedisUrl             string        `env:"REDIS_URL"`
+	RedisKey             string        `env:"REDIS_KEY"`
+	RefreshInterval      time.Duration `env:"CREDENTIAL_REFRESH_INTERVAL,default=1m,strict"`
+	Tokens               string        `env:"TOKEN_MAP"`
+	BearerTokens         string        `env:"BEARER_TOKENS"`
+	HmacAuthKeys         string        `env:"HMAC_AUTH_KEYS"`
+	HmacAuthWindow       time.Duration `env:"HMAC_AUTH_WINDOW,default=5m,strict"`
+	HmacAuthMaxBodyBytes int64         `env:"HMAC_AUTH_MAX_BODY_BYTES,default=10485760,strict"`
+	ClientCerts          string        `env:"HTTP_TLS_CLIENT_CERTS"`
+
+	CredentialChannel               string `env:"CREDENTIAL_CHANNEL"`
+	CredentialKeyspaceNotifications bool   `env:"CREDENTIAL_KEYSPACE_NOTIFICATIONS,default=false"`
+
+	JwtJwks            string        `env:"JWT_JWKS"`
+	JwtRefreshInterval time.Duration `env:"JWT_JWKS_REFRESH_INTERVAL,default=5m,strict"`
+	JwtIssuer          string        `env:"JWT_ISSUER"`
+	JwtAudience        string        `env:"JWT_AUDIENCE"`
+	JwtClockSkew       time.Duration `env:"JWT_CLOCK_SKEW,default=1m,strict"`
+	JwtNameClaim       string        `env:"JWT_NAME_CLAIM,default=sub"`
+	JwtStageClaim      string        `env:"JWT_STAGE_CLAIM,default=stage"`
+	JwtDeprecatedClaim string        `env:"JWT_DEPRECATED_CLAIM,default=deprecated"`
+	JwtMetricsNames    []string      `env:"JWT_METRICS_NAMES"`
 }
 
 func NewAuthConfig() (AuthConfig, error) {
@@ -54,18 +142,126 @@ func NewIssConfig() (IssConfig, error) {
 		return config, err
 	}
 
-	if config.PemFile != "" {
-		pemFileData, err := ioutil.ReadFile(config.PemFile)
+	if config.AsyncAck && config.SpoolDir != "" {
+		return config, errors.New("ASYNC_ACK can't be used with SPOOL_DIR, which already acknowledges logs once spooled")
+	}
+
+	if config.ForwardDestBackoffJitter < 0 || config.ForwardDestBackoffJitter > 1 {
+		return config, errors.New("FORWARD_DEST_BACKOFF_JITTER must be between 0 and 1")
+	}
+
+	if config.AccessLogSampleRate < 0 || config.AccessLogSampleRate > 1 {
+		return config, errors.New("ACCESS_LOG_SAMPLE_RATE must be between 0 and 1")
+	}
+
+	if config.SampleExemptSeverity < 0 || config.SampleExemptSeverity > 7 {
+		return config, errors.New("SAMPLE_EXEMPT_SEVERITY must be between 0 and 7")
+	}
+
+	if err := validateMetadataConfig(config); err != nil {
+		return config, err
+	}
+
+	config.MetricsRegistry = metrics.NewRegistry()
+
+	if config.ForwardTls || config.PemFile != "" || config.ForwardTlsCertFile != "" {
+		minVersion, err := parseTLSVersion(config.ForwardTlsMinVersion)
+		if err != nil {
+			return config, err
+		}
+
+		cipherSuites, err := parseCipherSuites(config.ForwardTlsCipherSuites)
+		if err != nil {
+			return config, err
+		}
+
+		config.TlsConfig, err = newTLSReloader(tlsSettings{
+			CAFile:       config.PemFile,
+			CertFile:     config.ForwardTlsCertFile,
+			KeyFile:      config.ForwardTlsKeyFile,
+			ServerName:   config.ForwardTlsServerName,
+			Verify:       config.ForwardTlsVerify,
+			MinVersion:   minVersion,
+			CipherSuites: cipherSuites,
+		}, config.ForwardTlsReloadInterval, config.MetricsRegistry)
+		if err != nil {
+			return config, err
+		}
+	}
+
+	if config.HttpTlsCertFile != "" || config.HttpTlsKeyFile != "" {
+		minVersion, err := parseTLSVersion(config.HttpTlsMinVersion)
 		if err != nil {
-			return config, fmt.Errorf("Unable to read pemfile: %s", err)
+			return config, err
 		}
 
-		cp := x509.NewCertPool()
-		if ok := cp.AppendCertsFromPEM(pemFileData); !ok {
-			return config, fmt.Errorf("Error parsing PEM: %s", config.PemFile)
+		config.HttpTlsConfig, err = newServerTLSReloader(serverTLSSettings{
+			CertFile:     config.HttpTlsCertFile,
+			KeyFile:      config.HttpTlsKeyFile,
+			ClientCAFile: config.HttpTlsClientCAFile,
+			ClientAuth:   config.HttpTlsClientAuth,
+			MinVersion:   minVersion,
+		}, config.MetricsRegistry)
+		if err != nil {
+			return config, err
 		}
+	}
 
-		config.TlsConfig = &tls.Config{RootCAs: cp}
+	config.OutputEncoder, err = newOutputEncoder(config.OutputFormat, config.OutputFraming)
+	if err != nil {
+		return config, err
+	}
+
+	config.RateLimiter, err = newRateLimiter(config.RateLimits, config.MetricsRegistry)
+	if err != nil {
+		return config, err
+	}
+
+	config.Validator, err = newValidator(config.ValidationMode, config.ValidationRejectRequests, config.MetricsRegistry)
+	if err != nil {
+		return config, err
+	}
+
+	config.RouteDestinations, err = parseRouteDests(config.RouteDests)
+	if err != nil {
+		return config, err
+	}
+
+	if len(config.Redact) > 0 || config.RedactPatternsFile != "" {
+		config.Redactor, err = newRedactor(config.Redact, config.RedactPatternsFile, config.RedactAction, config.RedactHmacKey, config.MetricsRegistry)
+		if err != nil {
+			return config, err
+		}
+	}
+
+	if config.RulesFile != "" {
+		config.Rules, err = newRuleSet(config.RulesFile, config.RouteDestinations, config.MetricsRegistry)
+		if err != nil {
+			return config, err
+		}
+	}
+
+	if len(config.SampleRates) > 0 {
+		config.Sampler, err = newSampler(config.SampleRates, config.SampleExemptSeverity, config.MetricsRegistry)
+		if err != nil {
+			return config, err
+		}
+	}
+
+	if config.DedupWindow > 0 {
+		config.Deduper = newDeduper(config.DedupWindow, config.MetricsRegistry)
+	}
+
+	if config.AccessLog != "" {
+		config.AccessLogger, err = newAccessLogger(config.AccessLog, config.AccessLogSampleRate, config.MetricsRegistry)
+		if err != nil {
+			return config, err
+		}
+	}
+
+	if config.TraceEndpoint != "" {
+		exporter := newOTLPExporter(config.TraceEndpoint, config.TraceServiceName)
+		config.Tracer = newTracer(exporter, config.TraceSampleRatio, config.MetricsRegistry)
 	}
 
 	sp := make([]string, 0, 2)
@@ -78,7 +274,5 @@ func NewIssConfig() (IssConfig, error) {
 
 	config.LibratoSource = strings.Join(sp, ".")
 
-	config.MetricsRegistry = metrics.NewRegistry()
-
 	return config, nil
 }
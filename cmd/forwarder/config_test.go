@@ -26,3 +26,72 @@ func setupDefaultEnv() {
 	os.Setenv("FORWARD_DEST", "127.0.0.1:5001")
 	os.Setenv("PORT", "8080")
 }
+
+func TestMultipleForwardDests(t *testing.T) {
+	assert := assert.New(t)
+
+	setupDefaultEnv()
+	os.Setenv("FORWARD_DEST", "10.0.0.1:601;10.0.0.2:601")
+	defer os.Setenv("FORWARD_DEST", "127.0.0.1:5001")
+
+	config, err := NewIssConfig()
+	if err != nil {
+		assert.FailNow(err.Error())
+	}
+
+	assert.Equal([]string{"10.0.0.1:601", "10.0.0.2:601"}, config.ForwardDests)
+	assert.Equal(3, config.ForwardFailoverThreshold)
+}
+
+func TestAsyncAckWithSpool(t *testing.T) {
+	setupDefaultEnv()
+	os.Setenv("ASYNC_ACK", "1")
+	os.Setenv("SPOOL_DIR", t.TempDir())
+	defer os.Unsetenv("ASYNC_ACK")
+	defer os.Unsetenv("SPOOL_DIR")
+
+	_, err := NewIssConfig()
+	assert.Error(t, err)
+}
+
+func TestForwardDestBackoffJitterRange(t *testing.T) {
+	setupDefaultEnv()
+	defer os.Unsetenv("FORWARD_DEST_BACKOFF_JITTER")
+
+	for _, jitter := range []string{"-0.1", "1.5"} {
+		os.Setenv("FORWARD_DEST_BACKOFF_JITTER", jitter)
+		_, err := NewIssConfig()
+		assert.Error(t, err, jitter)
+	}
+	os.Setenv("FORWARD_DEST_BACKOFF_JITTER", "1")
+	_, err := NewIssConfig()
+	assert.NoError(t, err)
+}
+
+func TestAccessLogSampleRateRange(t *testing.T) {
+	setupDefaultEnv()
+	defer os.Unsetenv("ACCESS_LOG_SAMPLE_RATE")
+
+	for _, rate := range []string{"-0.1", "1.5"} {
+		os.Setenv("ACCESS_LOG_SAMPLE_RATE", rate)
+		_, err := NewIssConfig()
+		assert.Error(t, err, rate)
+	}
+	os.Setenv("ACCESS_LOG_SAMPLE_RATE", "0.5")
+	_, err := NewIssConfig()
+	assert.NoError(t, err)
+}
+
+func TestSampleExemptSeverityRange(t *testing.T) {
+	setupDefaultEnv()
+	defer os.Unsetenv("SAMPLE_EXEMPT_SEVERITY")
+
+	for _, severity := range []string{"-1", "8"} {
+		os.Setenv("SAMPLE_EXEMPT_SEVERITY", severity)
+		_, err := NewIssConfig()
+		assert.Error(t, err, severity)
+	}
+	os.Setenv("SAMPLE_EXEMPT_SEVERITY", "7")
+	_, err := NewIssConfig()
+	assert.NoError(t, err)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// destination is a single entry from FORWARD_DEST along with the health
+// state used to decide whether forwarders should be sending to it.
+type destination struct {
+	ID        int
+	Addr      string
+	failures  int       // consecutive connect/write failures
+	downUntil time.Time // zero unless the destination has been failed over
+}
+
+// destinationSet is the ordered list of forward destinations. Forwarders
+// always prefer the earliest healthy destination in the list, failing over
+// to the next one after repeated errors and failing back once the
+// preferred destination has been down for longer than retryAfter.
+// It is safe for concurrent use.
+type destinationSet struct {
+	sync.Mutex
+	dests      []*destination
+	threshold  int
+	retryAfter time.Duration
+	now        func() time.Time
+}
+
+func newDestinationSet(addrs []string, threshold int, retryAfter time.Duration) *destinationSet {
+	if threshold < 1 {
+		threshold = 1
+	}
+
+	ds := &destinationSet{
+		dests:      make([]*destination, 0, len(addrs)),
+		threshold:  threshold,
+		retryAfter: retryAfter,
+		now:        time.Now,
+	}
+	for i, addr := range addrs {
+		ds.dests = append(ds.dests, &destination{ID: i, Addr: addr})
+	}
+	return ds
+}
+
+// Len returns the number of configured destinations.
+func (ds *destinationSet) Len() int {
+	return len(ds.dests)
+}
+
+// isUp must be called with the lock held.
+func (ds *destinationSet) isUp(d *destination, now time.Time) bool {
+	return d.downUntil.IsZero() || !now.Before(d.downUntil)
+}
+
+// Pick returns the destination a forwarder should connect to. That is the
+// first destination that isn't currently failed over, or, if every
+// destination is down, the one that will be retried soonest.
+func (ds *destinationSet) Pick() *destination {
+	ds.Lock()
+	defer ds.Unlock()
+
+	now := ds.now()
+	var soonest *destination
+	for _, d := range ds.dests {
+		if ds.isUp(d, now) {
+			return d
+		}
+		if soonest == nil || d.downUntil.Before(soonest.downUntil) {
+			soonest = d
+		}
+	}
+	return soonest
+}
+
+// Preferred returns true if a destination listed before current is usable
+// again, meaning a forwarder connected to current should fail back.
+func (ds *destinationSet) Preferred(current *destination) bool {
+	ds.Lock()
+	defer ds.Unlock()
+
+	now := ds.now()
+	for _, d := range ds.dests {
+		if d == current {
+			return false
+		}
+		if ds.isUp(d, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// Success records a successful write to d. Connecting alone is not enough
+// to clear a failed over destination, since some failures only surface once
+// a write is attempted.
+func (ds *destinationSet) Success(d *destination) {
+	ds.Lock()
+	defer ds.Unlock()
+
+	d.failures = 0
+	d.downUntil = time.Time{}
+}
+
+// Failure records a failed connect or write to d. Returns true if this
+// failure caused d to be failed over.
+func (ds *destinationSet) Failure(d *destination) bool {
+	ds.Lock()
+	defer ds.Unlock()
+
+	d.failures++
+	if d.failures < ds.threshold {
+		return false
+	}
+	d.downUntil = ds.now().Add(ds.retryAfter)
+	return true
+}
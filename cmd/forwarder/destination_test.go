@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func newTestDestinationSet(addrs ...string) (*destinationSet, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(1500000000, 0)}
+	ds := newDestinationSet(addrs, 3, 30*time.Second)
+	ds.now = clock.Now
+	return ds, clock
+}
+
+func TestDestinationSetPicksFirstHealthy(t *testing.T) {
+	assert := assert.New(t)
+	ds, _ := newTestDestinationSet("primary:601", "secondary:601")
+
+	primary := ds.Pick()
+	assert.Equal("primary:601", primary.Addr)
+
+	// Failures below the threshold don't fail over
+	assert.False(ds.Failure(primary))
+	assert.False(ds.Failure(primary))
+	assert.Equal("primary:601", ds.Pick().Addr)
+
+	assert.True(ds.Failure(primary))
+	assert.Equal("secondary:601", ds.Pick().Addr)
+}
+
+func TestDestinationSetFailsBack(t *testing.T) {
+	assert := assert.New(t)
+	ds, clock := newTestDestinationSet("primary:601", "secondary:601")
+
+	primary := ds.dests[0]
+	secondary := ds.dests[1]
+	for i := 0; i < 3; i++ {
+		ds.Failure(primary)
+	}
+	assert.Equal(secondary, ds.Pick())
+	assert.False(ds.Preferred(secondary))
+
+	clock.Advance(31 * time.Second)
+	assert.True(ds.Preferred(secondary))
+	assert.Equal(primary, ds.Pick())
+
+	// A single failure while retrying puts the primary straight back down
+	assert.True(ds.Failure(primary))
+	assert.Equal(secondary, ds.Pick())
+
+	clock.Advance(31 * time.Second)
+	ds.Success(primary)
+	assert.Equal(primary, ds.Pick())
+	assert.False(ds.Failure(primary))
+}
+
+func TestDestinationSetAllDown(t *testing.T) {
+	assert := assert.New(t)
+	ds, clock := newTestDestinationSet("primary:601", "secondary:601")
+
+	for i := 0; i < 3; i++ {
+		ds.Failure(ds.dests[0])
+	}
+	clock.Advance(10 * time.Second)
+	for i := 0; i < 3; i++ {
+		ds.Failure(ds.dests[1])
+	}
+
+	// Everything is down, so keep trying the one that will recover first
+	assert.Equal(ds.dests[0], ds.Pick())
+}
+
+func TestDestinationSetSingle(t *testing.T) {
+	assert := assert.New(t)
+	ds, _ := newTestDestinationSet("only:601")
+
+	for i := 0; i < 5; i++ {
+		ds.Failure(ds.dests[0])
+	}
+	assert.Equal(ds.dests[0], ds.Pick())
+	assert.False(ds.Preferred(ds.dests[0]))
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/tls"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// dialer connects forwarders to a destination, over TLS when a tlsReloader
+// is set, applying the same connect timeout and keepalive settings either
+// way.
+type dialer struct {
+	ConnectTimeout   time.Duration // limit on establishing the TCP connection
+	KeepAlive        time.Duration // TCP keepalive period, negative to disable
+	HandshakeTimeout time.Duration // limit on the TLS handshake
+	TLS              *tlsReloader
+}
+
+func newDialer(config IssConfig) *dialer {
+	return &dialer{
+		ConnectTimeout:   config.ForwardDestConnectTimeout,
+		KeepAlive:        config.ForwardDestKeepAlive,
+		HandshakeTimeout: config.ForwardDestHandshakeTimeout,
+		TLS:              config.TlsConfig,
+	}
+}
+
+func (d *dialer) Dial(addr string) (net.Conn, error) {
+	nd := &net.Dialer{Timeout: d.ConnectTimeout, KeepAlive: d.KeepAlive}
+	c, err := nd.Dial("tcp", addr)
+	if err != nil || d.TLS == nil {
+		return c, err
+	}
+
+	config := d.TLS.Config()
+	if config.ServerName == "" {
+		// tls.Client doesn't fill this in for us the way tls.Dial does
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	tc := tls.Client(c, config)
+	if d.HandshakeTimeout > 0 {
+		c.SetDeadline(time.Now().Add(d.HandshakeTimeout))
+	}
+	if err := tc.Handshake(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+	return tc, nil
+}
+
+// backoff computes exponentially increasing delays between connection
+// attempts, with up to Jitter (a fraction between 0 and 1) of each delay
+// randomly taken off so that forwarders don't reconnect in lockstep.
+type backoff struct {
+	Min     time.Duration
+	Max     time.Duration
+	Jitter  float64
+	attempt uint
+	rand    func() float64
+}
+
+func newBackoff(config IssConfig) *backoff {
+	return &backoff{
+		Min:    config.ForwardDestBackoffMin,
+		Max:    config.ForwardDestBackoffMax,
+		Jitter: config.ForwardDestBackoffJitter,
+		rand:   rand.Float64,
+	}
+}
+
+// Next returns the delay before the next attempt.
+func (b *backoff) Next() time.Duration {
+	d := b.Min
+	for i := uint(0); i < b.attempt && d < b.Max; i++ {
+		d *= 2
+	}
+	if d > b.Max {
+		d = b.Max
+	}
+	b.attempt++
+
+	if b.Jitter > 0 {
+		d -= time.Duration(b.Jitter * b.rand() * float64(d))
+	}
+	return d
+}
+
+// Reset starts the delays over from Min.
+func (b *backoff) Reset() {
+	b.attempt = 0
+}
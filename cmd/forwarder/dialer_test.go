@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/heroku/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+// silentListener accepts connections and never writes to them, like a
+// blackholed TLS destination.
+func silentListener(t *testing.T) (net.Listener, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conns := make(chan net.Conn, 10)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns <- c
+		}
+	}()
+
+	return l, func() {
+		l.Close()
+		close(conns)
+		for c := range conns {
+			c.Close()
+		}
+	}
+}
+
+func TestDialerTLSHandshakeTimeout(t *testing.T) {
+	assert := assert.New(t)
+	l, stop := silentListener(t)
+	defer stop()
+
+	tr, err := newTLSReloader(tlsSettings{MinVersion: tls.VersionTLS12}, 0, metrics.NewRegistry())
+	if !assert.NoError(err) {
+		return
+	}
+
+	d := &dialer{ConnectTimeout: time.Second, HandshakeTimeout: 100 * time.Millisecond, TLS: tr}
+
+	start := time.Now()
+	c, err := d.Dial(l.Addr().String())
+	assert.Error(err)
+	assert.Nil(c)
+	assert.True(time.Since(start) < time.Second, "handshake should have timed out after 100ms")
+}
+
+func TestDialerPlaintext(t *testing.T) {
+	assert := assert.New(t)
+	l, stop := silentListener(t)
+	defer stop()
+
+	d := &dialer{ConnectTimeout: time.Second, KeepAlive: time.Second, HandshakeTimeout: 100 * time.Millisecond}
+	c, err := d.Dial(l.Addr().String())
+	if assert.NoError(err) {
+		assert.IsType(&net.TCPConn{}, c)
+		c.Close()
+	}
+}
+
+func TestDialerConnectError(t *testing.T) {
+	assert := assert.New(t)
+	l, stop := silentListener(t)
+	addr := l.Addr().String()
+	stop()
+
+	d := &dialer{ConnectTimeout: 100 * time.Millisecond}
+	_, err := d.Dial(addr)
+	assert.Error(err)
+}
+
+func TestDialerUsesHostAsServerName(t *testing.T) {
+	assert := assert.New(t)
+	ca := newTestCert(t, "ca", nil)
+	server := newTestCert(t, "localhost", &ca)
+	client := newTestCert(t, "log-iss", &ca)
+	addr, _, stop := tlsTestServer(t, ca, server)
+	defer stop()
+
+	tr, err := newTLSReloader(tlsSettings{}, 0, metrics.NewRegistry())
+	if !assert.NoError(err) {
+		return
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	tr.config.RootCAs = pool
+	tr.config.Certificates = []tls.Certificate{client.tlsCertificate(t)}
+
+	_, port, _ := net.SplitHostPort(addr)
+	d := &dialer{ConnectTimeout: time.Second, HandshakeTimeout: time.Second, TLS: tr}
+	c, err := d.Dial(net.JoinHostPort("localhost", port))
+	if assert.NoError(err) {
+		c.Close()
+	}
+	assert.Equal("", tr.config.ServerName, "the shared config should not be modified")
+}
+
+func TestBackoff(t *testing.T) {
+	assert := assert.New(t)
+	b := &backoff{Min: 100 * time.Millisecond, Max: time.Second, rand: func() float64 { return 0.5 }}
+
+	assert.Equal(100*time.Millisecond, b.Next())
+	assert.Equal(200*time.Millisecond, b.Next())
+	assert.Equal(400*time.Millisecond, b.Next())
+	assert.Equal(800*time.Millisecond, b.Next())
+	assert.Equal(time.Second, b.Next())
+	assert.Equal(time.Second, b.Next())
+
+	b.Reset()
+	b.Jitter = 0.5
+	assert.Equal(75*time.Millisecond, b.Next())
+	assert.Equal(150*time.Millisecond, b.Next())
+}
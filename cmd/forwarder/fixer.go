@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/bmizerany/lpx"
 )
@@ -22,15 +23,16 @@ const (
 	maxMsgidLength    = 32
 )
 
-var nilVal = []byte("- ")
-
 //var queryParams = []string{"index", "source", "sourcetype", "metrics-destination", "log-destination"}
 
-// Get metadata from the http request.
-// Returns an empty byte array if there isn't any.
-func getMetadata(req *http.Request, cred *credential, metadataId string, config *IssConfig) (string, bool) {
-	var metadataWriter strings.Builder
+// Get metadata from the http request, as an RFC 5424 SD-ELEMENT with
+// escaped param values. Returns an empty string if there isn't any, and the
+// number of values that had to be sanitized. Invalid values are an
+// invalidMetadataError instead if config.MetadataInvalidValues is "reject".
+func getMetadata(req *http.Request, cred *credential, metadataId string, config *IssConfig) (string, bool, int64, error) {
+	var metadataWriter bytes.Buffer
 	var foundMetadata bool
+	var sanitized int64
 
 	// Calculate metadata query parameters
 	if metadataId != "" {
@@ -40,13 +42,21 @@ func getMetadata(req *http.Request, cred *credential, metadataId string, config
 		metadataWriter.Grow(1024)
 		fieldsBuilder.Grow(256)
 
-		metadataWriter.WriteString("[")
-		metadataWriter.WriteString(metadataId)
+		element := sdElement{ID: metadataId}
 
 		for _, k := range append(config.QueryParams, config.QueryFieldParams...) {
 			v := req.FormValue(k)
 			if v != "" {
-				if containsString(config.QueryFieldParams, k) {
+				isField := containsString(config.QueryFieldParams, k)
+				var changed bool
+				v, changed = sanitizeSDParamValue(v, isField)
+				if changed {
+					if config.MetadataInvalidValues == metadataReject {
+						return "", false, 0, invalidMetadataError{Param: k}
+					}
+					sanitized++
+				}
+				if isField {
 					if fieldsBuilder.Len() > 0 {
 						fieldsBuilder.WriteString(",")
 					}
@@ -54,11 +64,7 @@ func getMetadata(req *http.Request, cred *credential, metadataId string, config
 					fieldsBuilder.WriteString("=")
 					fieldsBuilder.WriteString(v)
 				} else {
-					metadataWriter.WriteString(" ")
-					metadataWriter.WriteString(k)
-					metadataWriter.WriteString(`="`)
-					metadataWriter.WriteString(v)
-					metadataWriter.WriteString(`"`)
+					element.Params = append(element.Params, sdParam{Name: k, Value: v})
 				}
 				foundMetadata = true
 			}
@@ -69,125 +75,262 @@ func getMetadata(req *http.Request, cred *credential, metadataId string, config
 			if fieldsBuilder.Len() > 0 {
 				fieldsBuilder.WriteString(",")
 			}
+			name, _ := sanitizeSDParamValue(cred.Name, true)
 			fieldsBuilder.WriteString(`credential_deprecated=true,credential_name=`)
-			fieldsBuilder.WriteString(cred.Name)
+			fieldsBuilder.WriteString(name)
 			foundMetadata = true
 		}
 
 		if foundMetadata {
 			if fieldsBuilder.Len() > 0 {
-				metadataWriter.WriteString(` fields="`)
-				metadataWriter.WriteString(fieldsBuilder.String())
-				metadataWriter.WriteString(`"`)
+				element.Params = append(element.Params, sdParam{Name: "fields", Value: fieldsBuilder.String()})
 			}
-
-			metadataWriter.WriteString("]")
+			writeStructuredData(&metadataWriter, []sdElement{element})
 		}
 	}
 
-	return metadataWriter.String(), foundMetadata
+	return metadataWriter.String(), foundMetadata, sanitized, nil
 }
 
-// Write a header field into the messageWriter buffer. Truncates to maxLength
-// Returns true if the input string was truncated, and false otherwise.
-func writeField(messageWriter *bytes.Buffer, str []byte, maxLength int) bool {
+// Truncate a header field to maxLength.
+// Returns true if the input was truncated, and false otherwise.
+func truncateField(str []byte, maxLength int) ([]byte, bool) {
 	if len(str) > maxLength {
-		messageWriter.Write(str[0:maxLength])
-		return true
+		return str[0:maxLength], true
+	}
+	return str, false
+}
+
+// lpxHeaderFields is the number of space-delimited fields lpx reads for each
+// frame: the octet count, then the header.
+const lpxHeaderFields = 7
+
+// frameLengthReader is the reader lpx parses a body from, keeping track of
+// the octet count of the current frame and the bytes read for the frame
+// after it. lpx reads the whole header even when the octet count is shorter,
+// and then no message, so the two differ for such frames.
+type frameLengthReader struct {
+	*bufio.Reader
+	fields   int // fields read from the body
+	declared int64
+	consumed int64
+}
+
+func (r *frameLengthReader) ReadBytes(delim byte) ([]byte, error) {
+	b, err := r.Reader.ReadBytes(delim)
+	if r.fields%lpxHeaderFields == 0 {
+		r.declared, _ = strconv.ParseInt(string(bytes.TrimRight(b, " ")), 10, 64)
+		r.consumed = 0
 	} else {
-		messageWriter.Write(str)
-		return false
+		r.consumed += int64(len(b))
 	}
+	r.fields++
+	return b, err
+}
+
+func (r *frameLengthReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.consumed += int64(n)
+	return n, err
+}
+
+// mismatched returns true if the current frame's octet count wasn't the
+// length read for it.
+func (r *frameLengthReader) mismatched() bool {
+	return r.declared != r.consumed
 }
 
 type fixResult struct {
 	hasMetadata    bool
-	numLogs        int64
+	numFrames      int64 // frames parsed from the request
+	numLogs        int64 // logs in bytes and routes, after any were dropped
 	bytes          []byte
 	hostnameTruncs int64
 	appnameTruncs  int64
 	procidTruncs   int64
 	msgidTruncs    int64
+
+	metadataSanitized int64          // metadata values with invalid characters replaced
+	invalidFrames     []invalidFrame // frames that failed validation
+	routes            map[string]routedLogs
+	routedLogs        int64       // logs in routes, rather than bytes
+	dedup             *dedupBatch // to commit once the logs are delivered
 }
 
-// Fix function to convert post data to length prefixed syslog frames
+// Fix function to convert post data to framed syslog messages, in the format
+// and framing given by config.OutputEncoder
 // Returns:
 // * boolean indicating whether metadata was present in the query parameters.
-// * integer representing the number of logplex frames parsed from the HTTP request.
+// * integers representing the number of logplex frames parsed from the HTTP request, and of logs left once any are dropped.
 // * byte array of syslog data.
 // * error if something went wrong.
 func fix(req *http.Request, r io.Reader, remoteAddr string, logplexDrainToken string, metadataId string, cred *credential, config *IssConfig) (fixResult, error) {
 	var messageWriter bytes.Buffer
-	var messageLenWriter bytes.Buffer
+	var framedWriter bytes.Buffer
+	var sdWriter bytes.Buffer
+	var truncated bool
+
+	encoder := config.OutputEncoder
+	if encoder == nil {
+		encoder = defaultOutputEncoder
+	}
+
+	metadataString, hasMetadata, metadataSanitized, err := getMetadata(req, cred, metadataId, config)
+	if err != nil {
+		return fixResult{}, err
+	}
 
-	metadataString, hasMetadata := getMetadata(req, cred, metadataId, config)
+	// The remote address may come from X-Forwarded-For, so is escaped too
+	if remoteAddr != "" {
+		writeStructuredData(&sdWriter, []sdElement{{ID: "origin", Params: []sdParam{{Name: "ip", Value: remoteAddr}}}})
+	}
+	if hasMetadata {
+		sdWriter.WriteString(metadataString)
+	}
 
-	lp := lpx.NewReader(bufio.NewReader(r))
+	lengths := &frameLengthReader{Reader: bufio.NewReader(r)}
+	lp := lpx.NewReader(lengths)
+	numFrames := int64(0)
 	numLogs := int64(0)
 	hostnameTruncs := int64(0)
 	appnameTruncs := int64(0)
 	procidTruncs := int64(0)
 	msgidTruncs := int64(0)
-	for lp.Next() {
+	var invalidFrames []invalidFrame
+	now := time.Now()
+
+	var ruleCtx *ruleContext
+	var routed map[string]*bytes.Buffer
+	var routes map[string]routedLogs
+	routedLogCount := int64(0)
+	var dedup *dedupBatch
+	if config.Deduper != nil {
+		dedup = config.Deduper.Batch()
+	}
+	if config.Rules != nil {
+		ruleCtx = &ruleContext{Req: req, DrainToken: logplexDrainToken, AuthUser: authUser(req, cred)}
+	}
+
+	// emit formats and frames f into the body, or that of its route
+	emit := func(f *syslogFrame, dest string) {
 		numLogs++
+		encoder.Format(&messageWriter, f)
+		if dest == "" {
+			encoder.Frame(&framedWriter, &messageWriter)
+		} else {
+			if routed == nil {
+				routed = make(map[string]*bytes.Buffer)
+				routes = make(map[string]routedLogs)
+			}
+			w := routed[dest]
+			if w == nil {
+				w = new(bytes.Buffer)
+				routed[dest] = w
+			}
+			encoder.Frame(w, &messageWriter)
+			rl := routes[dest]
+			rl.NumLogs++
+			routes[dest] = rl
+			routedLogCount++
+		}
+		messageWriter.Reset()
+	}
+
+	for index := 0; lp.Next(); index++ {
+		numFrames++
 		header := lp.Header()
 
-		// LEN SP PRI VERSION SP TIMESTAMP SP HOSTNAME SP APP-NAME SP PROCID SP MSGID SP STRUCTURED-DATA MSG
-		messageWriter.Write(header.PrivalVersion)
-		messageWriter.WriteString(" ")
-		messageWriter.Write(header.Time)
-		messageWriter.WriteString(" ")
+		f := syslogFrame{
+			PrivalVersion: header.PrivalVersion,
+			Time:          header.Time,
+			SD:            sdWriter.Bytes(),
+			Msg:           lp.Bytes(),
+
+			LengthMismatch: lengths.mismatched(),
+		}
+
 		host := header.Hostname
 		if string(header.Hostname) == logplexDefaultHost && logplexDrainToken != "" {
 			host = []byte(logplexDrainToken)
 		}
-		if writeField(&messageWriter, host, maxHostnameLength) {
+		if f.Hostname, truncated = truncateField(host, maxHostnameLength); truncated {
 			hostnameTruncs++
 		}
-		messageWriter.WriteString(" ")
-		if writeField(&messageWriter, header.Name, maxAppnameLength) {
+		if f.Appname, truncated = truncateField(header.Name, maxAppnameLength); truncated {
 			appnameTruncs++
 		}
-		messageWriter.WriteString(" ")
-		if writeField(&messageWriter, header.Procid, maxProcidLength) {
+		if f.Procid, truncated = truncateField(header.Procid, maxProcidLength); truncated {
 			procidTruncs++
 		}
-		messageWriter.WriteString(" ")
-		if writeField(&messageWriter, header.Msgid, maxMsgidLength) {
+		if f.Msgid, truncated = truncateField(header.Msgid, maxMsgidLength); truncated {
 			msgidTruncs++
 		}
-		messageWriter.WriteString(" ")
-		if remoteAddr != "" {
-			messageWriter.WriteString("[origin ip=\"")
-			messageWriter.WriteString(remoteAddr)
-			messageWriter.WriteString("\"]")
+
+		if config.Validator.enabled() {
+			violations, keep := config.Validator.Check(&f, index, now)
+			if len(violations) > 0 {
+				invalidFrames = append(invalidFrames, invalidFrame{Index: index, Violations: violations})
+			}
+			if !keep {
+				continue
+			}
 		}
 
-		// Write metadata
-		if hasMetadata {
-			messageWriter.WriteString(metadataString)
+		if config.Redactor != nil && !config.Redactor.Redact(&f) {
+			continue
 		}
 
-		b := lp.Bytes()
-		if len(b) >= 2 && bytes.Equal(b[0:2], nilVal) {
-			messageWriter.Write(b[1:])
-		} else if len(b) > 0 {
-			messageWriter.WriteString(" ")
-			messageWriter.Write(b)
+		dest := ""
+		if config.Rules != nil {
+			var keep bool
+			if dest, keep = config.Rules.Apply(&f, ruleCtx); !keep {
+				continue
+			}
+		}
+
+		if dedup != nil {
+			summary, keep := dedup.Apply(&f, dest, now)
+			if summary != nil {
+				emit(&summary.Frame, summary.Dest)
+			}
+			if !keep {
+				continue
+			}
 		}
 
-		messageLenWriter.WriteString(strconv.Itoa(messageWriter.Len()))
-		messageLenWriter.WriteString(" ")
-		messageWriter.WriteTo(&messageLenWriter)
+		if config.Sampler != nil && !config.Sampler.Apply(&f, logplexDrainToken, now) {
+			continue
+		}
+
+		emit(&f, dest)
+	}
+	for dest, w := range routed {
+		rl := routes[dest]
+		rl.Body = w.Bytes()
+		routes[dest] = rl
+	}
+
+	// Refusing the request, rather than just dropping the invalid frames,
+	// lets the sender know which frames to fix
+	if len(invalidFrames) > 0 && config.Validator.Mode == validationReject && config.Validator.RejectRequests && lp.Err() == nil {
+		config.Validator.rejections.Inc(1)
+		return fixResult{}, invalidFramesError{Frames: invalidFrames}
 	}
 
 	return fixResult{
 		hasMetadata:    hasMetadata,
+		numFrames:      numFrames,
 		numLogs:        numLogs,
-		bytes:          messageLenWriter.Bytes(),
+		bytes:          framedWriter.Bytes(),
 		hostnameTruncs: hostnameTruncs,
 		appnameTruncs:  appnameTruncs,
 		procidTruncs:   procidTruncs,
 		msgidTruncs:    msgidTruncs,
+
+		metadataSanitized: metadataSanitized,
+		invalidFrames:     invalidFrames,
+		routes:            routes,
+		routedLogs:        routedLogCount,
+		dedup:             dedup,
 	}, lp.Err()
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"testing"
@@ -51,6 +52,7 @@ func TestTruncationOfFields(t *testing.T) {
 			name:  "truncate HOSTNAME",
 			bytes: []byte(fmt.Sprintf("311 <13>1 2013-06-07T13:17:49.468822+00:00 %s heroku web.7 - ", strings.Repeat("a", 256))),
 			expected: fixResult{
+				numFrames:      1,
 				numLogs:        1,
 				bytes:          []byte(fmt.Sprintf("310 <13>1 2013-06-07T13:17:49.468822+00:00 %s heroku web.7 - ", strings.Repeat("a", 255))),
 				hostnameTruncs: 1,
@@ -60,6 +62,7 @@ func TestTruncationOfFields(t *testing.T) {
 			name:  "truncate APP-NAME",
 			bytes: []byte(fmt.Sprintf("102 <13>1 2013-06-07T13:17:49.468822+00:00 host %s web.7 - ", strings.Repeat("a", 49))),
 			expected: fixResult{
+				numFrames:     1,
 				numLogs:       1,
 				bytes:         []byte(fmt.Sprintf("101 <13>1 2013-06-07T13:17:49.468822+00:00 host %s web.7 - ", strings.Repeat("a", 48))),
 				appnameTruncs: 1,
@@ -69,6 +72,7 @@ func TestTruncationOfFields(t *testing.T) {
 			name:  "truncate PROCID",
 			bytes: []byte(fmt.Sprintf("183 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku %s - ", strings.Repeat("a", 129))),
 			expected: fixResult{
+				numFrames:    1,
 				numLogs:      1,
 				bytes:        []byte(fmt.Sprintf("182 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku %s - ", strings.Repeat("a", 128))),
 				procidTruncs: 1,
@@ -78,6 +82,7 @@ func TestTruncationOfFields(t *testing.T) {
 			name:  "truncate MSGID",
 			bytes: []byte(fmt.Sprintf("91 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 %s ", strings.Repeat("a", 33))),
 			expected: fixResult{
+				numFrames:   1,
 				numLogs:     1,
 				bytes:       []byte(fmt.Sprintf("90 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 %s ", strings.Repeat("a", 32))),
 				msgidTruncs: 1,
@@ -227,3 +232,51 @@ func getConfig() *IssConfig {
 
 	return &config
 }
+
+func TestFixEscapesMetadata(t *testing.T) {
+	assert := assert.New(t)
+	config := getConfig()
+	config.QueryParams = []string{"index"}
+	config.QueryFieldParams = []string{"custom1"}
+
+	q := url.Values{
+		"index":   {`i"][origin ip="6.6.6.6`},
+		"custom1": {"a,credential_deprecated=true"},
+	}
+	req, _ := http.NewRequest("POST", "/logs?"+q.Encode(), nil)
+	in := []byte("64 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - - hi\n")
+	r, err := fix(req, bytes.NewReader(in), `1.2.3.4"]`, "", "metadata@123", nil, config)
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.Contains(string(r.bytes), `[origin ip="1.2.3.4\"\]"][metadata@123 index="i\"\][origin ip=\"6.6.6.6" fields="custom1=a_credential_deprecated_true"]`)
+	assert.Equal(int64(1), r.metadataSanitized)
+
+	// The structured data parses back to the values that were sent
+	sd := r.bytes[bytes.Index(r.bytes, []byte("[")):]
+	elements, rest, err := parseStructuredData(sd)
+	if assert.NoError(err) && assert.Len(elements, 2) {
+		assert.Equal(sdParam{"ip", `1.2.3.4"]`}, elements[0].Params[0])
+		assert.Equal(sdParam{"index", q.Get("index")}, elements[1].Params[0])
+		assert.Equal(" hi\n", string(rest))
+	}
+}
+
+func TestFixRejectsInvalidMetadata(t *testing.T) {
+	assert := assert.New(t)
+	config := getConfig()
+	config.QueryParams = []string{"index"}
+	config.MetadataInvalidValues = metadataReject
+
+	req, _ := http.NewRequest("POST", "/logs?index=i%0Aj", nil)
+	in := []byte("64 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - - hi\n")
+	_, err := fix(req, bytes.NewReader(in), "1.2.3.4", "", "metadata@123", nil, config)
+	assert.Equal(invalidMetadataError{Param: "index"}, err)
+
+	// Escaping alone is enough for quotes and brackets
+	req, _ = http.NewRequest("POST", `/logs?index=%22%5D`, nil)
+	r, err := fix(req, bytes.NewReader(in), "1.2.3.4", "", "metadata@123", nil, config)
+	assert.NoError(err)
+	assert.Contains(string(r.bytes), `[metadata@123 index="\"\]"]`)
+}
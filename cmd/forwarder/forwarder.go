@@ -1,9 +1,10 @@
 package main
 
 import (
-	"crypto/tls"
 	"fmt"
 	"net"
+	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/heroku/go-metrics"
@@ -15,28 +16,118 @@ type deliverer interface {
 }
 
 type forwarderSet struct {
-	Config  IssConfig
-	Inbox   chan payload
-	timeout metrics.Counter // counts how many times we times out waiting for delivery notification
-	full    metrics.Counter // counts how many times the queue was full
+	Config     IssConfig
+	Inbox      chan payload
+	dests      *destinationSet
+	forwarders []*forwarder
+	timeout    metrics.Counter // counts how many times we times out waiting for delivery notification
+	full       metrics.Counter // counts how many times the queue was full
 }
 
 func newForwarderSet(config IssConfig) *forwarderSet {
-	return &forwarderSet{
+	return newForwarderSetFrom(config, 0)
+}
+
+// newForwarderSetFrom creates a forwarderSet whose forwarders are numbered
+// from firstID, so that several sets can report metrics side by side.
+func newForwarderSetFrom(config IssConfig, firstID int) *forwarderSet {
+	fs := &forwarderSet{
 		Config:  config,
 		Inbox:   make(chan payload, 1000),
+		dests:   newDestinationSet(config.ForwardDests, config.ForwardFailoverThreshold, config.ForwardFailbackInterval),
 		timeout: metrics.GetOrRegisterCounter("log-iss.forwardset.deliver.timeout.g", config.MetricsRegistry),
 		full:    metrics.GetOrRegisterCounter("log-iss.forwardset.deliver.full.g", config.MetricsRegistry),
 	}
+	for i := 0; i < config.ForwardCount; i++ {
+		fs.forwarders = append(fs.forwarders, newForwarder(config, fs.Inbox, fs.dests, firstID+i))
+	}
+	return fs
 }
 
 func (fs *forwarderSet) Run() {
-	for i := 0; i < fs.Config.ForwardCount; i++ {
-		forwarder := newForwarder(fs.Config, fs.Inbox, i)
+	for _, forwarder := range fs.forwarders {
 		go forwarder.Run()
 	}
 }
 
+// States returns the state of every forwarder.
+func (fs *forwarderSet) States() []forwarderState {
+	states := make([]forwarderState, len(fs.forwarders))
+	for i, f := range fs.forwarders {
+		states[i] = f.State()
+	}
+	return states
+}
+
+// deliveryChain is a forwarderSet with whichever of SPOOL_DIR and ASYNC_ACK
+// are configured in front of it, delivering through the outermost.
+type deliveryChain struct {
+	deliverer
+	forwarders *forwarderSet
+	spool      *spool
+	async      *asyncDeliverer
+}
+
+// newDeliveryChain creates the chain for route, or for FORWARD_DEST if route
+// is empty, with forwarders numbered from firstID. A route's spool is kept in
+// a directory of its own under SPOOL_DIR.
+func newDeliveryChain(config IssConfig, route string, firstID int) (*deliveryChain, error) {
+	c := &deliveryChain{forwarders: newForwarderSetFrom(config, firstID)}
+	c.deliverer = c.forwarders
+
+	if config.SpoolDir != "" {
+		if route != "" {
+			config.SpoolDir = filepath.Join(config.SpoolDir, "routes", route)
+		}
+		s, err := newRouteSpool(config, c.forwarders.Inbox, route)
+		if err != nil {
+			return nil, err
+		}
+		c.spool, c.deliverer = s, s
+	}
+
+	if config.AsyncAck {
+		c.async = newRouteAsyncDeliverer(config, c.forwarders.Inbox, route)
+		c.deliverer = c.async
+	}
+	return c, nil
+}
+
+// Run starts the forwarders, and the spool draining into them.
+func (c *deliveryChain) Run() {
+	go c.forwarders.Run()
+	if c.spool != nil {
+		go c.spool.Run()
+	}
+}
+
+// Close waits up to timeout for queued logs to be written, and closes the
+// spool, leaving what's in it for after a restart.
+func (c *deliveryChain) Close(timeout time.Duration) {
+	if c.async != nil {
+		c.async.Drain(timeout)
+	}
+	if c.spool != nil {
+		if err := c.spool.Close(); err != nil {
+			log.WithField("at", "spool-close").Error(err)
+		}
+	}
+}
+
+// closeDeliveryChains closes chains at the same time, so that draining them
+// takes no longer than timeout however many routes there are.
+func closeDeliveryChains(timeout time.Duration, chains ...*deliveryChain) {
+	var wg sync.WaitGroup
+	for _, c := range chains {
+		wg.Add(1)
+		go func(c *deliveryChain) {
+			defer wg.Done()
+			c.Close(timeout)
+		}(c)
+	}
+	wg.Wait()
+}
+
 func (fs *forwarderSet) Deliver(p payload) (err error) {
 	deadline := time.After(time.Second * 5)
 
@@ -62,6 +153,11 @@ type forwarder struct {
 	ID           int
 	Config       IssConfig
 	Inbox        chan payload
+	dests        *destinationSet
+	dest         *destination // destination c is connected to
+	dialer       *dialer
+	backoff      *backoff
+	destMetrics  []destinationMetrics
 	c            net.Conn
 	duration     metrics.Timer   // tracks how long it takes to forward messages
 	cDisconnects metrics.Counter // counts disconnects
@@ -70,14 +166,59 @@ type forwarder struct {
 	wErrors      metrics.Counter // counts write errors
 	wSuccesses   metrics.Counter // counts write successes
 	wBytes       metrics.Counter // counts written bytes
+
+	stateMu sync.Mutex
+	state   forwarderState
+}
+
+// Forwarder connection states
+const (
+	forwarderStarting   = "starting"
+	forwarderConnecting = "connecting"
+	forwarderConnected  = "connected"
+)
+
+// forwarderState is what a forwarder reports about itself for readiness
+// checks.
+type forwarderState struct {
+	ID          int
+	State       string
+	Destination string
+	Since       time.Time // when State last changed
+	LastWrite   time.Time // zero if nothing has been written yet
+	LastError   string
+}
+
+// destinationMetrics are the per-destination counters of a single forwarder.
+type destinationMetrics struct {
+	cSuccesses metrics.Counter // counts connection successes
+	cErrors    metrics.Counter // counts connection errors
+	wErrors    metrics.Counter // counts write errors
+	wSuccesses metrics.Counter // counts write successes
 }
 
-func newForwarder(config IssConfig, inbox chan payload, id int) *forwarder {
+func newForwarder(config IssConfig, inbox chan payload, dests *destinationSet, id int) *forwarder {
 	me := fmt.Sprintf("log-iss.forwarder.%d", id)
+
+	dm := make([]destinationMetrics, dests.Len())
+	for i := range dm {
+		dme := fmt.Sprintf("%s.dest.%d", me, i)
+		dm[i] = destinationMetrics{
+			cSuccesses: metrics.GetOrRegisterCounter(dme+".connect.successes.g", config.MetricsRegistry),
+			cErrors:    metrics.GetOrRegisterCounter(dme+".connect.errors.g", config.MetricsRegistry),
+			wErrors:    metrics.GetOrRegisterCounter(dme+".write.errors.g", config.MetricsRegistry),
+			wSuccesses: metrics.GetOrRegisterCounter(dme+".write.successes.g", config.MetricsRegistry),
+		}
+	}
+
 	return &forwarder{
 		ID:           id,
 		Config:       config,
 		Inbox:        inbox,
+		dests:        dests,
+		destMetrics:  dm,
+		dialer:       newDialer(config),
+		backoff:      newBackoff(config),
 		duration:     metrics.GetOrRegisterTimer(me+".duration.g", config.MetricsRegistry),
 		cDisconnects: metrics.GetOrRegisterCounter(me+".disconnects.g", config.MetricsRegistry),
 		cSuccesses:   metrics.GetOrRegisterCounter(me+".connect.successes.g", config.MetricsRegistry),
@@ -85,13 +226,57 @@ func newForwarder(config IssConfig, inbox chan payload, id int) *forwarder {
 		wErrors:      metrics.GetOrRegisterCounter(me+".write.errors.g", config.MetricsRegistry),
 		wSuccesses:   metrics.GetOrRegisterCounter(me+".write.successes.g", config.MetricsRegistry),
 		wBytes:       metrics.GetOrRegisterCounter(me+".write.bytes.g", config.MetricsRegistry),
+		state:        forwarderState{ID: id, State: forwarderStarting, Since: time.Now()},
+	}
+}
+
+// State returns a copy of the forwarder's state. It is safe to call from any
+// goroutine.
+func (f *forwarder) State() forwarderState {
+	f.stateMu.Lock()
+	defer f.stateMu.Unlock()
+	return f.state
+}
+
+func (f *forwarder) setState(state string, dest string, err error) {
+	f.stateMu.Lock()
+	defer f.stateMu.Unlock()
+	if f.state.State != state {
+		f.state.Since = time.Now()
+	}
+	f.state.State = state
+	f.state.Destination = dest
+	if err != nil {
+		f.state.LastError = err.Error()
 	}
 }
 
+func (f *forwarder) setLastWrite(t time.Time) {
+	f.stateMu.Lock()
+	defer f.stateMu.Unlock()
+	f.state.LastWrite = t
+}
+
 func (f *forwarder) Run() {
+	// Connect up front, so that readiness reflects whether the destinations
+	// can be reached before any logs arrive.
+	f.connect()
+
 	for p := range f.Inbox {
 		start := time.Now()
+
+		wait := f.Config.Tracer.StartAt(p.Trace, "forwarderSet.Inbox", spanKindInternal, p.QueuedAt)
+		wait.SetAttribute("log_iss.forwarder_id", f.ID)
+		wait.EndAt(start)
+
+		span := f.Config.Tracer.StartAt(p.Trace, "forwarder.write", spanKindInternal, start)
+		span.SetAttribute("log_iss.forwarder_id", f.ID)
+		span.SetAttribute("log_iss.log_count", p.NumLogs)
+		span.SetAttribute("log_iss.bytes", int64(len(p.Body)))
 		f.write(p)
+		span.SetAttribute("log_iss.destination", f.dest.Addr)
+		span.End()
+
 		p.WaitCh <- struct{}{}
 		f.duration.UpdateSince(start)
 	}
@@ -102,28 +287,38 @@ func (f *forwarder) connect() {
 		return
 	}
 
-	rate := time.Tick(200 * time.Millisecond)
 	for {
-		var c net.Conn
-		var err error
-
-		if f.Config.TlsConfig != nil {
-			c, err = tls.Dial("tcp", f.Config.ForwardDest, f.Config.TlsConfig)
-		} else {
-			c, err = net.DialTimeout("tcp", f.Config.ForwardDest, f.Config.ForwardDestConnectTimeout)
-		}
-
+		dest := f.dests.Pick()
+		f.setState(forwarderConnecting, dest.Addr, nil)
+		c, err := f.dialer.Dial(dest.Addr)
 		if err != nil {
+			f.setState(forwarderConnecting, dest.Addr, err)
 			f.cErrors.Inc(1)
-			log.WithFields(log.Fields{"id": f.ID, "message": err}).Error("Forwarder Connection Error")
+			f.destMetrics[dest.ID].cErrors.Inc(1)
+			log.WithFields(log.Fields{"id": f.ID, "dest": dest.Addr, "message": err}).Error("Forwarder Connection Error")
+			f.failure(dest)
 			f.disconnect()
 		} else {
 			f.cSuccesses.Inc(1)
-			log.WithFields(log.Fields{"id": f.ID, "remote_addr": c.RemoteAddr().String()}).Info("Forwarder Connection Success")
+			f.destMetrics[dest.ID].cSuccesses.Inc(1)
+			log.WithFields(log.Fields{"id": f.ID, "dest": dest.Addr, "remote_addr": c.RemoteAddr().String()}).Info("Forwarder Connection Success")
 			f.c = c
+			f.dest = dest
+			f.setState(forwarderConnected, dest.Addr, nil)
+			f.backoff.Reset()
 			return
 		}
-		<-rate
+		time.Sleep(f.backoff.Next())
+	}
+}
+
+// failure records a connect or write error against dest and logs when that
+// causes it to be failed over.
+func (f *forwarder) failure(dest *destination) {
+	if f.dests.Failure(dest) && f.dests.Len() > 1 {
+		// Start over from the shortest delay on the next destination
+		f.backoff.Reset()
+		log.WithFields(log.Fields{"id": f.ID, "dest": dest.Addr}).Warn("Forwarder Destination Failed Over")
 	}
 }
 
@@ -132,21 +327,33 @@ func (f *forwarder) disconnect() {
 		f.c.Close()
 	}
 	f.c = nil
+	f.dest = nil
 	f.cDisconnects.Inc(1)
 }
 
 func (f *forwarder) write(p payload) {
+	if f.c != nil && f.dests.Preferred(f.dest) {
+		log.WithFields(log.Fields{"id": f.ID, "dest": f.dest.Addr}).Info("Forwarder Failing Back")
+		f.disconnect()
+	}
+
 	for {
 		f.connect()
 
 		f.c.SetWriteDeadline(time.Now().Add(1 * time.Second))
 		if n, err := f.c.Write(p.Body); err != nil {
 			f.wErrors.Inc(1)
+			f.destMetrics[f.dest.ID].wErrors.Inc(1)
+			f.setState(forwarderConnecting, f.dest.Addr, err)
 			log.WithFields(log.Fields{"id": f.ID, "request_id": p.RequestID, "err": err, "remote": f.c.RemoteAddr().String()}).Error("Error writing payload")
+			f.failure(f.dest)
 			f.disconnect()
 		} else {
 			f.wSuccesses.Inc(1)
+			f.destMetrics[f.dest.ID].wSuccesses.Inc(1)
+			f.dests.Success(f.dest)
 			f.wBytes.Inc(int64(n))
+			f.setLastWrite(time.Now())
 			return
 		}
 	}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// readiness decides whether log-iss should be sent traffic, based on the
+// state of its forwarders, their inbox and the credentials.
+type readiness struct {
+	Config     IssConfig
+	forwarders *forwarderSet
+	routes     map[string]*forwarderSet // the forwarders of each of ROUTE_DESTS
+	auth       *BasicAuth
+	started    time.Time
+	now        func() time.Time
+}
+
+func newReadiness(config IssConfig, forwarders *forwarderSet, auth *BasicAuth) *readiness {
+	return &readiness{
+		Config:     config,
+		forwarders: forwarders,
+		auth:       auth,
+		started:    time.Now(),
+		now:        time.Now,
+	}
+}
+
+// readinessReport is the JSON body of /ready responses.
+type readinessReport struct {
+	Ready       bool                   `json:"ready"`
+	Reasons     []string               `json:"reasons,omitempty"`
+	Forwarders  []forwarderReport      `json:"forwarders,omitempty"`
+	Inbox       *inboxReport           `json:"inbox,omitempty"`
+	Routes      map[string]routeReport `json:"routes,omitempty"`
+	Credentials *credentialsReport     `json:"credentials,omitempty"`
+}
+
+// routeReport is the state of the forwarders of a route, as for FORWARD_DEST.
+type routeReport struct {
+	Forwarders []forwarderReport `json:"forwarders,omitempty"`
+	Inbox      *inboxReport      `json:"inbox,omitempty"`
+}
+
+type forwarderReport struct {
+	ID                  int        `json:"id"`
+	State               string     `json:"state"`
+	Destination         string     `json:"destination,omitempty"`
+	Since               time.Time  `json:"since"`
+	LastWrite           *time.Time `json:"last_write,omitempty"`
+	LastWriteAgeSeconds *float64   `json:"last_write_age_seconds,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+}
+
+type inboxReport struct {
+	Depth    int `json:"depth"`
+	Capacity int `json:"capacity"`
+}
+
+type credentialsReport struct {
+	LastRefresh       time.Time `json:"last_refresh"`
+	RefreshAgeSeconds float64   `json:"refresh_age_seconds"`
+}
+
+// Report checks every threshold in the config, treating log-iss as not ready
+// while it's shutting down.
+func (rd *readiness) Report(shuttingDown bool) readinessReport {
+	now := rd.now()
+	report := readinessReport{Ready: true}
+	notReady := func(format string, args ...interface{}) {
+		report.Ready = false
+		report.Reasons = append(report.Reasons, fmt.Sprintf(format, args...))
+	}
+
+	if shuttingDown {
+		notReady("shutting down")
+	}
+
+	if rd.forwarders != nil {
+		report.Forwarders, report.Inbox = rd.checkForwarders(rd.forwarders, now, notReady)
+	}
+	if len(rd.routes) > 0 {
+		report.Routes = make(map[string]routeReport, len(rd.routes))
+		names := make([]string, 0, len(rd.routes))
+		for name := range rd.routes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			var rr routeReport
+			rr.Forwarders, rr.Inbox = rd.checkForwarders(rd.routes[name], now, func(format string, args ...interface{}) {
+				notReady("route %s: "+format, append([]interface{}{name}, args...)...)
+			})
+			report.Routes[name] = rr
+		}
+	}
+
+	if rd.auth != nil {
+		if t, ok := rd.auth.LastRefresh(); ok {
+			age := now.Sub(t)
+			report.Credentials = &credentialsReport{LastRefresh: t, RefreshAgeSeconds: age.Seconds()}
+			if max := rd.Config.ReadyMaxCredentialAge; max > 0 && age > max {
+				notReady("credentials last refreshed %s ago", age.Round(time.Second))
+			}
+		}
+	}
+
+	return report
+}
+
+// checkForwarders reports on the forwarders of fs and their inbox, calling
+// notReady for each threshold they're past.
+func (rd *readiness) checkForwarders(fs *forwarderSet, now time.Time, notReady func(format string, args ...interface{})) ([]forwarderReport, *inboxReport) {
+	var forwarders []forwarderReport
+	connected := 0
+	lastWrite := rd.started
+	for _, st := range fs.States() {
+		fr := forwarderReport{
+			ID:          st.ID,
+			State:       st.State,
+			Destination: st.Destination,
+			Since:       st.Since,
+			LastError:   st.LastError,
+		}
+		if !st.LastWrite.IsZero() {
+			t, age := st.LastWrite, now.Sub(st.LastWrite).Seconds()
+			fr.LastWrite, fr.LastWriteAgeSeconds = &t, &age
+			if t.After(lastWrite) {
+				lastWrite = t
+			}
+		}
+		if st.State == forwarderConnected {
+			connected++
+		}
+		forwarders = append(forwarders, fr)
+	}
+
+	inbox := &inboxReport{Depth: len(fs.Inbox), Capacity: cap(fs.Inbox)}
+
+	if min := rd.Config.ReadyMinConnectedForwarders; min > 0 && connected < min {
+		notReady("%d of %d forwarders connected, need %d", connected, len(forwarders), min)
+	}
+	if max := rd.Config.ReadyMaxInboxFill; max > 0 && float64(inbox.Depth) >= max*float64(inbox.Capacity) {
+		notReady("inbox holds %d of %d payloads", inbox.Depth, inbox.Capacity)
+	}
+	// An idle instance has nothing to write, so only a backlog makes an
+	// old write a problem.
+	if max := rd.Config.ReadyMaxWriteAge; max > 0 && inbox.Depth > 0 && now.Sub(lastWrite) > max {
+		notReady("nothing written for %s with %d payloads queued", now.Sub(lastWrite).Round(time.Second), inbox.Depth)
+	}
+
+	return forwarders, inbox
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/heroku/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestReadiness(t *testing.T) (*readiness, *forwarderSet, *fakeClock) {
+	config := getConfig()
+	config.ForwardCount = 2
+	config.MetricsRegistry = metrics.NewRegistry()
+
+	fs := newForwarderSet(*config)
+	clock := &fakeClock{t: time.Now()}
+	rd := newReadiness(*config, fs, nil)
+	rd.now = clock.Now
+	return rd, fs, clock
+}
+
+func TestReadinessForwarders(t *testing.T) {
+	assert := assert.New(t)
+	rd, fs, _ := newTestReadiness(t)
+
+	report := rd.Report(false)
+	assert.False(report.Ready)
+	assert.Equal([]string{"0 of 2 forwarders connected, need 1"}, report.Reasons)
+	if assert.Len(report.Forwarders, 2) {
+		assert.Equal(forwarderStarting, report.Forwarders[0].State)
+	}
+
+	fs.forwarders[0].setState(forwarderConnecting, "127.0.0.1:5001", errors.New("connection refused"))
+	fs.forwarders[1].setState(forwarderConnected, "127.0.0.1:5001", nil)
+	report = rd.Report(false)
+	assert.True(report.Ready)
+	assert.Equal("connection refused", report.Forwarders[0].LastError)
+	assert.Equal("127.0.0.1:5001", report.Forwarders[1].Destination)
+
+	report = rd.Report(true)
+	assert.False(report.Ready)
+	assert.Equal([]string{"shutting down"}, report.Reasons)
+}
+
+func TestReadinessInbox(t *testing.T) {
+	assert := assert.New(t)
+	rd, fs, clock := newTestReadiness(t)
+	fs.forwarders[0].setState(forwarderConnected, "127.0.0.1:5001", nil)
+
+	for i := 0; i < 900; i++ {
+		fs.Inbox <- NewPayload("", "", nil)
+	}
+	report := rd.Report(false)
+	assert.False(report.Ready)
+	assert.Equal(&inboxReport{Depth: 900, Capacity: 1000}, report.Inbox)
+	assert.Equal([]string{"inbox holds 900 of 1000 payloads"}, report.Reasons)
+
+	<-fs.Inbox
+	assert.True(rd.Report(false).Ready)
+
+	// A backlog that isn't being written out
+	clock.Advance(2 * time.Minute)
+	report = rd.Report(false)
+	assert.False(report.Ready)
+	assert.Equal([]string{"nothing written for 2m0s with 899 payloads queued"}, report.Reasons)
+
+	fs.forwarders[1].setLastWrite(clock.Now())
+	report = rd.Report(false)
+	assert.True(report.Ready)
+	assert.Equal(float64(0), *report.Forwarders[1].LastWriteAgeSeconds)
+	assert.Nil(report.Forwarders[0].LastWrite)
+}
+
+func TestReadinessCredentials(t *testing.T) {
+	assert := assert.New(t)
+	rd, fs, clock := newTestReadiness(t)
+	fs.forwarders[0].setState(forwarderConnected, "127.0.0.1:5001", nil)
+
+	// Credentials from the environment never need refreshing
+	rd.auth = defaultCreds()
+	report := rd.Report(false)
+	assert.True(report.Ready)
+	assert.Nil(report.Credentials)
+
+	rd.auth.refreshing = true
+	rd.auth.lastRefresh = clock.Now()
+	clock.Advance(5 * time.Minute)
+	report = rd.Report(false)
+	assert.True(report.Ready)
+	assert.Equal(float64(300), report.Credentials.RefreshAgeSeconds)
+
+	clock.Advance(10 * time.Minute)
+	report = rd.Report(false)
+	assert.False(report.Ready)
+	assert.Equal([]string{"credentials last refreshed 15m0s ago"}, report.Reasons)
+}
+
+func TestReadinessRoutes(t *testing.T) {
+	assert := assert.New(t)
+	rd, fs, _ := newTestReadiness(t)
+	fs.forwarders[0].setState(forwarderConnected, "127.0.0.1:5001", nil)
+
+	config := rd.Config
+	config.ForwardDests = []string{"127.0.0.1:5002"}
+	system := newForwarderSetFrom(config, 2)
+	rd.routes = map[string]*forwarderSet{"system": system}
+
+	report := rd.Report(false)
+	assert.False(report.Ready)
+	assert.Equal([]string{"route system: 0 of 2 forwarders connected, need 1"}, report.Reasons)
+	if assert.Contains(report.Routes, "system") {
+		assert.Len(report.Routes["system"].Forwarders, 2)
+		assert.Equal(2, report.Routes["system"].Forwarders[0].ID)
+		assert.Equal(&inboxReport{Depth: 0, Capacity: 1000}, report.Routes["system"].Inbox)
+	}
+
+	system.forwarders[1].setState(forwarderConnected, "127.0.0.1:5002", nil)
+	assert.True(rd.Report(false).Ready)
+}
@@ -2,10 +2,14 @@ package main
 
 import (
 	"compress/gzip"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"mime"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -18,6 +22,11 @@ type payload struct {
 	SourceAddr string
 	RequestID  string
 	Body       []byte
+	NumLogs    int64                 // number of log messages in Body, when known
+	Routes     map[string]routedLogs // logs that rules routed to ROUTE_DESTS, by destination
+	Trace      spanContext           // span the payload was received in, if traced
+	Sent       []metrics.Counter     // incremented by NumLogs once an asyncDeliverer's logs are written
+	QueuedAt   time.Time
 	WaitCh     chan struct{}
 }
 
@@ -26,22 +35,24 @@ func NewPayload(sa string, ri string, b []byte) payload {
 		SourceAddr: sa,
 		RequestID:  ri,
 		Body:       b,
+		QueuedAt:   time.Now(),
 		WaitCh:     make(chan struct{}, 1),
 	}
 }
 
 // FixerFunc params:
-//  * http.Request -- incoming http request
-//  * io.Reader - request body stream
-//  * string - remote address of incoming request
-//  * string - logplex drain token
-//  * metadataId - ID to use when adding metadata to logs
-//  * credential - the credential used to authenticate
-//  * []string - a slice of custom query paramters to look for in the request
+//   - http.Request -- incoming http request
+//   - io.Reader - request body stream
+//   - string - remote address of incoming request
+//   - string - logplex drain token
+//   - metadataId - ID to use when adding metadata to logs
+//   - credential - the credential used to authenticate
+//   - []string - a slice of custom query paramters to look for in the request
+//
 // FixerFunc returns:
-//  * boolean - indicating whether the request has query params (aka metadata).
-//  * int64  - number of log lines read from the stream
-//  * error - if something went wrong.
+//   - boolean - indicating whether the request has query params (aka metadata).
+//   - int64  - number of log lines read from the stream
+//   - error - if something went wrong.
 type FixerFunc func(*http.Request, io.Reader, string, string, string, *credential, *IssConfig) (fixResult, error)
 
 type httpServer struct {
@@ -50,9 +61,11 @@ type httpServer struct {
 	shutdownCh            shutdownCh
 	deliverer             deliverer
 	isShuttingDown        bool
-	auth                  *BasicAuth
+	auth                  authenticator
 	posts                 metrics.Timer   // tracks metrics about posts
 	healthChecks          metrics.Timer   // tracks metrics about health checks
+	readyChecks           metrics.Timer   // tracks metrics about readiness checks
+	readiness             *readiness      // decides readiness, if set
 	pErrors               metrics.Counter // tracks the count of post errors
 	pSuccesses            metrics.Counter // tracks the number of post successes
 	pAuthErrors           metrics.Counter // tracks the count of auth errors
@@ -61,15 +74,27 @@ type httpServer struct {
 	pLogsReceived         metrics.Counter // tracks the number of logs that have been received
 	pMetadataLogsSent     metrics.Counter // tracks the number of logs that have metadata that have been received
 	pLogsSent             metrics.Counter // tracks the number of logs that have been received
+	pLogsEnqueued         metrics.Counter // tracks the number of logs queued to be sent, with AsyncAck
 	pHostnameTruncations  metrics.Counter // tracks the number of hostname fields in logs that have been truncated
 	pAppnameTruncations   metrics.Counter // tracks the number of appname fields in logs that have been truncated
 	pProcidTruncations    metrics.Counter // tracks the number of procid fields in logs that have been truncated
 	pMsgidTruncations     metrics.Counter // trakcs the number of msgid fields in logs that have been truncated
+	pMetadataRejections   metrics.Counter // tracks the number of posts refused for invalid metadata values
+	pMetadataSanitized    metrics.Counter // tracks the number of metadata values that had invalid characters replaced
 	pAuthUsers            map[string]metrics.Counter
+	pInputReceived        map[string]metrics.Counter // tracks the number of posts received per input format
+	pInputErrors          map[string]metrics.Counter // tracks the number of posts per input format that couldn't be decoded or fixed
 	sync.WaitGroup
 }
 
-func newHTTPServer(config IssConfig, auth *BasicAuth, fixerFunc FixerFunc, deliverer deliverer) *httpServer {
+func newHTTPServer(config IssConfig, auth authenticator, fixerFunc FixerFunc, deliverer deliverer) *httpServer {
+	pInputReceived := make(map[string]metrics.Counter)
+	pInputErrors := make(map[string]metrics.Counter)
+	for _, f := range inputFormats {
+		pInputReceived[f.Name] = metrics.GetOrRegisterCounter(fmt.Sprintf("log-iss.input.%s.received.g", f.Name), config.MetricsRegistry)
+		pInputErrors[f.Name] = metrics.GetOrRegisterCounter(fmt.Sprintf("log-iss.input.%s.errors.g", f.Name), config.MetricsRegistry)
+	}
+
 	return &httpServer{
 		auth:                  auth,
 		Config:                config,
@@ -78,6 +103,7 @@ func newHTTPServer(config IssConfig, auth *BasicAuth, fixerFunc FixerFunc, deliv
 		shutdownCh:            make(shutdownCh),
 		posts:                 metrics.GetOrRegisterTimer("log-iss.http.logs.g", config.MetricsRegistry),
 		healthChecks:          metrics.GetOrRegisterTimer("log-iss.http.healthchecks.g", config.MetricsRegistry),
+		readyChecks:           metrics.GetOrRegisterTimer("log-iss.http.readychecks.g", config.MetricsRegistry),
 		pErrors:               metrics.GetOrRegisterCounter("log-iss.http.logs.errors.g", config.MetricsRegistry),
 		pSuccesses:            metrics.GetOrRegisterCounter("log-iss.http.logs.successes.g", config.MetricsRegistry),
 		pAuthErrors:           metrics.GetOrRegisterCounter("log-iss.auth.errors.g", config.MetricsRegistry),
@@ -86,11 +112,16 @@ func newHTTPServer(config IssConfig, auth *BasicAuth, fixerFunc FixerFunc, deliv
 		pLogsReceived:         metrics.GetOrRegisterCounter("log-iss.logs.received.g", config.MetricsRegistry),
 		pMetadataLogsSent:     metrics.GetOrRegisterCounter("log-iss.metadata_logs.sent.g", config.MetricsRegistry),
 		pLogsSent:             metrics.GetOrRegisterCounter("log-iss.logs.sent.g", config.MetricsRegistry),
+		pLogsEnqueued:         metrics.GetOrRegisterCounter("log-iss.logs.enqueued.g", config.MetricsRegistry),
 		pHostnameTruncations:  metrics.GetOrRegisterCounter("log-iss.logs.hostname_truncations.g", config.MetricsRegistry),
 		pAppnameTruncations:   metrics.GetOrRegisterCounter("log-iss.logs.appname_truncations.g", config.MetricsRegistry),
 		pProcidTruncations:    metrics.GetOrRegisterCounter("log-iss.logs.procid_truncations.g", config.MetricsRegistry),
 		pMsgidTruncations:     metrics.GetOrRegisterCounter("log-iss.logs.msgid_truncations.g", config.MetricsRegistry),
+		pMetadataRejections:   metrics.GetOrRegisterCounter("log-iss.metadata.rejections.g", config.MetricsRegistry),
+		pMetadataSanitized:    metrics.GetOrRegisterCounter("log-iss.metadata.sanitized.g", config.MetricsRegistry),
 		pAuthUsers:            make(map[string]metrics.Counter),
+		pInputReceived:        pInputReceived,
+		pInputErrors:          pInputErrors,
 		isShuttingDown:        false,
 	}
 }
@@ -130,10 +161,80 @@ func (s *httpServer) Run() error {
 
 	})
 
+	// Liveness only reflects whether the process is serving requests at all.
+	http.HandleFunc("/live", func(w http.ResponseWriter, r *http.Request) {
+		defer s.healthChecks.UpdateSince(time.Now())
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"alive":true}` + "\n"))
+	})
+
+	http.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		defer s.readyChecks.UpdateSince(time.Now())
+
+		report := readinessReport{Ready: !s.isShuttingDown}
+		if s.readiness != nil {
+			report = s.readiness.Report(s.isShuttingDown)
+		} else if s.isShuttingDown {
+			report.Reasons = []string{"shutting down"}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if !report.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+
+	if s.Config.PrometheusMetrics {
+		exporter := newPrometheusExporter(s.Config)
+		if s.Config.PrometheusMetricsPort != "" {
+			// Metric names include auth users and drain tokens, so they're
+			// only served without authentication on a port of their own
+			l, err := net.Listen("tcp", ":"+s.Config.PrometheusMetricsPort)
+			if err != nil {
+				return err
+			}
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", exporter)
+			go func() {
+				if err := http.Serve(l, mux); err != nil {
+					log.WithFields(log.Fields{"ns": "http", "at": "metrics-error"}).Error(err)
+				}
+			}()
+		} else {
+			http.Handle("/metrics", s.authenticated(exporter))
+		}
+	}
+
 	http.HandleFunc("/logs", func(w http.ResponseWriter, r *http.Request) {
 		defer s.posts.UpdateSince(time.Now())
 
-		if s.Config.EnforceSsl && r.Header.Get("X-Forwarded-Proto") != "https" {
+		ctx, span := s.Config.Tracer.Start(s.Config.Tracer.Extract(r.Context(), r.Header.Get("traceparent")), "POST /logs", spanKindServer)
+		r = r.WithContext(ctx)
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		w = sw
+		rec := &accessRecord{
+			Start:           time.Now(),
+			RequestID:       r.Header.Get("X-Request-Id"),
+			DrainToken:      r.Header.Get("Logplex-Drain-Token"),
+			RemoteAddr:      extractRemoteAddr(r),
+			ContentEncoding: r.Header.Get("Content-Encoding"),
+		}
+		rec.AuthUser, _, _ = r.BasicAuth()
+		r = r.WithContext(contextWithAccessRecord(r.Context(), rec))
+		defer func() {
+			rec.Status = sw.status
+			s.Config.AccessLogger.Log(rec)
+
+			span.SetAttribute("http.method", r.Method)
+			span.SetAttribute("http.status_code", sw.status)
+			if sw.status >= 500 {
+				span.SetError(errors.New(http.StatusText(sw.status)))
+			}
+			span.End()
+		}()
+
+		if s.Config.EnforceSsl && r.TLS == nil && r.Header.Get("X-Forwarded-Proto") != "https" {
 			s.handleHTTPError(w, "Only SSL requests accepted", 400)
 			return
 		}
@@ -148,8 +249,10 @@ func (s *httpServer) Run() error {
 			return
 		}
 
-		if r.Header.Get("Content-Type") != "application/logplex-1" {
-			s.handleHTTPError(w, "Only Content-Type application/logplex-1 is accepted", 400)
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		input, ok := inputFormats[mediaType]
+		if !ok {
+			s.handleHTTPError(w, "Only Content-Type application/logplex-1, application/json or application/x-ndjson is accepted", 400)
 			return
 		}
 
@@ -160,26 +263,41 @@ func (s *httpServer) Run() error {
 			return
 		} else {
 			s.pAuthSuccesses.Inc(1)
+			rec.AuthUser = authUser(r, cred)
+			rec.Stage = cred.Stage
 		}
 
-		remoteAddr := extractRemoteAddr(r)
-		requestID := r.Header.Get("X-Request-Id")
-		logplexDrainToken := r.Header.Get("Logplex-Drain-Token")
+		remoteAddr := rec.RemoteAddr
+		requestID := rec.RequestID
+		logplexDrainToken := rec.DrainToken
 
-		body := r.Body
-		var err error
+		rec.CompressedBytes = &countingReader{Reader: r.Body}
+		var body io.Reader = rec.CompressedBytes
 
 		if r.Header.Get("Content-Encoding") == "gzip" {
-			body, err = gzip.NewReader(r.Body)
+			gz, err := gzip.NewReader(body)
 			if err != nil {
 				s.handleHTTPError(w, "Could not decode gzip request", 500)
 				return
 			}
-			defer body.Close()
+			defer gz.Close()
+			body = gz
+		}
+		rec.UncompressedBytes = &countingReader{Reader: body}
+
+		s.pInputReceived[input.Name].Inc(1)
+		decoded, err := input.Decode(rec.UncompressedBytes)
+		if err != nil {
+			s.pInputErrors[input.Name].Inc(1)
+			s.handleHTTPError(
+				w, "Problem decoding body: "+err.Error(), 400,
+				log.Fields{"remote_addr": remoteAddr, "requestId": requestID, "logdrain_token": logplexDrainToken},
+			)
+			return
 		}
 
 		// This should only be reached if authentication information is valid.
-		if authUser, _, ok := r.BasicAuth(); ok {
+		if authUser := metricsUser(r, cred); authUser != "" {
 			var um metrics.Counter
 			um, ok = s.pAuthUsers[authUser]
 			if !ok {
@@ -196,20 +314,54 @@ func (s *httpServer) Run() error {
 			um.Inc(1)
 		}
 
-		if err, status := s.process(r, body, remoteAddr, requestID, logplexDrainToken, s.Config.MetadataId, cred); err != nil {
+		err, status := s.process(r, decoded, remoteAddr, requestID, logplexDrainToken, s.Config.MetadataId, cred)
+		if err != nil {
+			if status == http.StatusTooManyRequests {
+				retryAfter := 1
+				if rl, ok := err.(*rateLimitError); ok {
+					retryAfter = rl.RetryAfterSeconds()
+				}
+				w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			}
 			s.handleHTTPError(
 				w, err.Error(), status,
 				log.Fields{"remote_addr": remoteAddr, "requestId": requestID, "logdrain_token": logplexDrainToken},
 			)
+			if status == http.StatusBadRequest {
+				s.pInputErrors[input.Name].Inc(1)
+			}
 			return
 		}
 
 		s.pSuccesses.Inc(1)
+		w.WriteHeader(status)
 	})
 
+	if s.Config.HttpTlsConfig != nil {
+		server := &http.Server{
+			Addr:      ":" + s.Config.HttpPort,
+			TLSConfig: s.Config.HttpTlsConfig.Config(),
+			ErrorLog:  s.Config.HttpTlsConfig.ErrorLog(),
+		}
+		return server.ListenAndServeTLS("", "")
+	}
+
 	return http.ListenAndServe(":"+s.Config.HttpPort, nil)
 }
 
+// authenticated wraps h to refuse requests that the authenticator doesn't
+// accept.
+func (s *httpServer) authenticated(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.auth.Authenticate(r) == nil {
+			s.pAuthErrors.Inc(1)
+			s.handleHTTPError(w, "Unable to authenticate request", 401)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
 func (s *httpServer) awaitShutdown() {
 	<-s.shutdownCh
 	s.isShuttingDown = true
@@ -220,29 +372,120 @@ func (s *httpServer) process(req *http.Request, reader io.Reader, remoteAddr str
 	s.Add(1)
 	defer s.Done()
 
+	// Throttled requests are refused before their logs are read, and those
+	// let through charged for them after
+	limitKeys, limitOverrides := s.rateLimitKeys(req, logplexDrainToken, cred)
+	if err := s.Config.RateLimiter.Allow(limitKeys, limitOverrides); err != nil {
+		return err, http.StatusTooManyRequests
+	}
+
+	rec := accessRecordFromContext(req.Context())
+	_, fixSpan := startSpan(req.Context(), "FixerFunc", spanKindInternal)
+	fixStart := time.Now()
 	r, err := s.FixerFunc(req, reader, remoteAddr, logplexDrainToken, metadataId, cred, &s.Config)
+	rec.FixTime = time.Since(fixStart)
+	fixSpan.SetError(err)
 	if err != nil {
+		fixSpan.End()
+		if _, ok := err.(invalidMetadataError); ok {
+			s.pMetadataRejections.Inc(1)
+		}
 		return errors.New("Problem fixing body: " + err.Error()), http.StatusBadRequest
 	}
+	truncations := r.hostnameTruncs + r.appnameTruncs + r.procidTruncs + r.msgidTruncs
+	for _, sp := range []*span{fixSpan, spanFromContext(req.Context())} {
+		sp.SetAttribute("log_iss.frame_count", r.numFrames)
+		sp.SetAttribute("log_iss.log_count", r.numLogs)
+		sp.SetAttribute("log_iss.bytes", int64(len(r.bytes)))
+		sp.SetAttribute("log_iss.truncations", truncations)
+	}
+	fixSpan.End()
+	rec.NumFrames, rec.NumLogs = r.numFrames, r.numLogs
+	rec.HostnameTruncs, rec.AppnameTruncs = r.hostnameTruncs, r.appnameTruncs
+	rec.ProcidTruncs, rec.MsgidTruncs = r.procidTruncs, r.msgidTruncs
 
-	s.pLogsReceived.Inc(r.numLogs)
+	s.pLogsReceived.Inc(r.numFrames)
 	if r.hasMetadata {
-		s.pMetadataLogsReceived.Inc(r.numLogs)
+		s.pMetadataLogsReceived.Inc(r.numFrames)
 	}
 
+	s.Config.RateLimiter.Charge(limitKeys, limitOverrides, r.numFrames)
+
 	payload := NewPayload(remoteAddr, requestID, r.bytes)
-	if err := s.deliverer.Deliver(payload); err != nil {
+	payload.NumLogs = r.numLogs - r.routedLogs
+	payload.Routes = r.routes
+	payload.Trace = spanFromContext(req.Context()).SpanContext()
+	if s.Config.AsyncAck {
+		// The logs are only sent once a forwarder has written them
+		payload.Sent = []metrics.Counter{s.pLogsSent}
+		if r.hasMetadata {
+			payload.Sent = append(payload.Sent, s.pMetadataLogsSent)
+		}
+	}
+	deliverStart := time.Now()
+	err = s.deliverer.Deliver(payload)
+	rec.DeliveryWait = time.Since(deliverStart)
+	if err == errQueueFull {
+		return errors.New("Problem delivering body: " + err.Error()), http.StatusTooManyRequests
+	} else if err != nil {
 		return errors.New("Problem delivering body: " + err.Error()), http.StatusGatewayTimeout
 	}
-
-	s.pLogsSent.Inc(r.numLogs)
-	if r.hasMetadata {
-		s.pMetadataLogsSent.Inc(r.numLogs)
+	r.dedup.Commit()
+
+	if s.Config.AsyncAck {
+		s.pLogsEnqueued.Inc(r.numLogs)
+	} else {
+		s.pLogsSent.Inc(r.numLogs)
+		if r.hasMetadata {
+			s.pMetadataLogsSent.Inc(r.numLogs)
+		}
 	}
 	s.pHostnameTruncations.Inc(r.hostnameTruncs)
 	s.pAppnameTruncations.Inc(r.appnameTruncs)
 	s.pProcidTruncations.Inc(r.procidTruncs)
 	s.pMsgidTruncations.Inc(r.msgidTruncs)
+	s.pMetadataSanitized.Inc(r.metadataSanitized)
 
+	if s.Config.AsyncAck {
+		return nil, http.StatusAccepted
+	}
 	return nil, 200
 }
+
+// rateLimitKeys returns the rate limit keys for the request's auth user,
+// credential stage and drain token. A limit set on the credential itself
+// overrides the configured one for its user.
+func (s *httpServer) rateLimitKeys(req *http.Request, drainToken string, cred *credential) ([]rateLimitKey, map[rateLimitKey]rateLimit) {
+	if s.Config.RateLimiter == nil {
+		return nil, nil
+	}
+
+	user := authUser(req, cred)
+	keys := []rateLimitKey{{rateLimitUser, user}, {rateLimitDrain, drainToken}}
+
+	var overrides map[rateLimitKey]rateLimit
+	if cred != nil {
+		keys = append(keys, rateLimitKey{rateLimitStage, cred.Stage})
+		if cred.RateLimit != "" {
+			l, err := parseRateLimit(cred.RateLimit)
+			if err != nil {
+				log.WithFields(log.Fields{"ns": "http", "at": "rate-limit", "user": user}).Error(err)
+			} else {
+				overrides = map[rateLimitKey]rateLimit{keys[0]: l}
+			}
+		}
+	}
+
+	return keys, overrides
+}
+
+// statusWriter records the status code written to a http.ResponseWriter.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
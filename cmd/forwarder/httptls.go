@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	stdlog "log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/heroku/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// Values for HTTP_TLS_CLIENT_AUTH
+const (
+	clientAuthNone     = "none"     // don't ask for client certificates
+	clientAuthOptional = "optional" // verify client certificates if presented
+	clientAuthRequire  = "require"  // refuse connections without a verified client certificate
+)
+
+// serverTLSSettings are the file locations and policy used to build the
+// tls.Config of the HTTP listener.
+type serverTLSSettings struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+	ClientAuth   string
+	MinVersion   uint16
+}
+
+// serverTLSReloader holds the tls.Config the HTTP listener terminates TLS
+// with, and rebuilds it from the certificate files when asked, so that the
+// server certificate and client CAs can be rotated with a SIGHUP. It is safe
+// for concurrent use.
+type serverTLSReloader struct {
+	sync.RWMutex
+	settings          serverTLSSettings
+	config            *tls.Config
+	reloads           metrics.Counter // counts successful certificate reloads
+	reloadFailures    metrics.Counter // counts failed certificate reloads
+	handshakeFailures metrics.Counter // counts failed TLS handshakes
+}
+
+func newServerTLSReloader(settings serverTLSSettings, registry metrics.Registry) (*serverTLSReloader, error) {
+	if settings.ClientAuth == "" {
+		settings.ClientAuth = clientAuthOptional
+	}
+	switch settings.ClientAuth {
+	case clientAuthNone, clientAuthOptional, clientAuthRequire:
+	default:
+		return nil, fmt.Errorf("Unknown HTTP TLS client auth mode: %s", settings.ClientAuth)
+	}
+	if settings.CertFile == "" || settings.KeyFile == "" {
+		return nil, fmt.Errorf("Both a TLS certificate and key must be set to serve HTTP over TLS")
+	}
+	if settings.ClientAuth == clientAuthRequire && settings.ClientCAFile == "" {
+		return nil, fmt.Errorf("A client CA file must be set to require client certificates")
+	}
+
+	st := &serverTLSReloader{
+		settings:          settings,
+		reloads:           metrics.GetOrRegisterCounter("log-iss.http.tls.reloads.g", registry),
+		reloadFailures:    metrics.GetOrRegisterCounter("log-iss.http.tls.reload.failures.g", registry),
+		handshakeFailures: metrics.GetOrRegisterCounter("log-iss.http.tls.handshake.failures.g", registry),
+	}
+
+	config, err := st.load()
+	if err != nil {
+		return nil, err
+	}
+	st.config = config
+	return st, nil
+}
+
+// load reads the certificate files and builds a tls.Config from them.
+func (st *serverTLSReloader) load() (*tls.Config, error) {
+	s := st.settings
+	cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load HTTP TLS certificate: %s", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   s.MinVersion,
+		NextProtos:   httpNextProtos,
+	}
+
+	if s.ClientCAFile != "" && s.ClientAuth != clientAuthNone {
+		pemFileData, err := ioutil.ReadFile(s.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read HTTP client CA file: %s", err)
+		}
+		cp := x509.NewCertPool()
+		if ok := cp.AppendCertsFromPEM(pemFileData); !ok {
+			return nil, fmt.Errorf("Error parsing PEM: %s", s.ClientCAFile)
+		}
+		config.ClientCAs = cp
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if s.ClientAuth == clientAuthRequire {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return config, nil
+}
+
+// httpNextProtos are the ALPN protocols offered, as net/http would for a
+// tls.Config of its own. They have to be set on the configs returned by
+// GetConfigForClient, as those replace the listener's entirely.
+var httpNextProtos = []string{"h2", "http/1.1"}
+
+// Config returns a tls.Config for the listener that uses whichever
+// certificates were loaded most recently.
+func (st *serverTLSReloader) Config() *tls.Config {
+	current := func() *tls.Config {
+		st.RLock()
+		defer st.RUnlock()
+		return st.config
+	}
+	return &tls.Config{
+		MinVersion: st.settings.MinVersion,
+		NextProtos: append([]string{}, httpNextProtos...),
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &current().Certificates[0], nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return current(), nil
+		},
+	}
+}
+
+// Reload rereads the certificate files, keeping the previous certificates if
+// the new ones can't be loaded.
+func (st *serverTLSReloader) Reload() error {
+	config, err := st.load()
+	if err != nil {
+		st.reloadFailures.Inc(1)
+		log.WithFields(log.Fields{"ns": "http", "at": "tls-reload-failure", "message": err.Error()}).Error()
+		return err
+	}
+
+	st.Lock()
+	st.config = config
+	st.Unlock()
+	st.reloads.Inc(1)
+	log.WithFields(log.Fields{"ns": "http", "at": "tls-reload"}).Info()
+	return nil
+}
+
+// ErrorLog returns a logger for http.Server that counts the TLS handshake
+// failures net/http reports through it.
+func (st *serverTLSReloader) ErrorLog() *stdlog.Logger {
+	return stdlog.New(serverErrorLog{st.handshakeFailures}, "", 0)
+}
+
+// serverErrorLog passes http.Server's error log on to logrus.
+type serverErrorLog struct {
+	handshakeFailures metrics.Counter
+}
+
+func (l serverErrorLog) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	if strings.Contains(msg, "TLS handshake error") {
+		l.handshakeFailures.Inc(1)
+		log.WithFields(log.Fields{"ns": "http", "at": "tls-handshake-failure"}).Info(msg)
+		return len(p), nil
+	}
+	log.WithFields(log.Fields{"ns": "http", "at": "error"}).Error(msg)
+	return len(p), nil
+}
+
+// certAuth authenticates requests by the verified client certificate they
+// were made with, mapping a URI, DNS or email SAN or the subject common name
+// to a credential. Requests without a mapped certificate go to Next.
+type certAuth struct {
+	identities map[string]credential
+	registry   metrics.Registry
+	Next       authenticator
+}
+
+// newCertAuth creates a certAuth from "NAME[/STAGE[/deprecated]]:IDENTITY|..."
+func newCertAuth(certs string, next authenticator, registry metrics.Registry) (*certAuth, error) {
+	identities, err := parseSecrets(certs)
+	if err != nil {
+		return nil, err
+	}
+	return &certAuth{identities: identities, registry: registry, Next: next}, nil
+}
+
+// certIdentities lists the names a certificate may be mapped by, SANs first.
+func certIdentities(cert *x509.Certificate) []string {
+	ids := make([]string, 0, len(cert.URIs)+len(cert.DNSNames)+len(cert.EmailAddresses)+1)
+	for _, u := range cert.URIs {
+		ids = append(ids, u.String())
+	}
+	ids = append(ids, cert.DNSNames...)
+	ids = append(ids, cert.EmailAddresses...)
+	if cert.Subject.CommonName != "" {
+		ids = append(ids, cert.Subject.CommonName)
+	}
+	return ids
+}
+
+func (ca *certAuth) Authenticate(r *http.Request) (cred *credential) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ca.Next.Authenticate(r)
+	}
+
+	_, span := startSpan(r.Context(), "CertAuth.Authenticate", spanKindInternal)
+	leaf := r.TLS.VerifiedChains[0][0]
+	for _, id := range certIdentities(leaf) {
+		if c, ok := ca.identities[id]; ok {
+			span.SetAttribute("log_iss.authenticated", true)
+			span.SetAttribute("log_iss.credential_stage", c.Stage)
+			span.End()
+			countAuthSuccess(ca.registry, c.Name, c.Stage)
+			return &c
+		}
+	}
+	span.SetAttribute("log_iss.authenticated", false)
+	span.End()
+
+	log.WithFields(log.Fields{"ns": "auth", "at": "unmapped-client-cert", "subject": leaf.Subject.String()}).Info()
+	return ca.Next.Authenticate(r)
+}
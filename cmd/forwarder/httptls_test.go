@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/heroku/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestTLSServer serves handler over TLS with the certificates in
+// settings, returning the server and a client trusting ca.
+func newTestTLSServer(t *testing.T, st *serverTLSReloader, ca testCert, handler http.Handler) (*httptest.Server, *tls.Config) {
+	ts := httptest.NewUnstartedServer(handler)
+	ts.TLS = st.Config()
+	ts.Config.ErrorLog = st.ErrorLog()
+	ts.StartTLS()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	return ts, &tls.Config{RootCAs: roots, ServerName: "log-iss.example.com"}
+}
+
+// awaitCount waits up to a second for c to reach n, as net/http logs
+// handshake errors after the client has given up.
+func awaitCount(c metrics.Counter, n int64) int64 {
+	for deadline := time.Now().Add(time.Second); c.Count() < n && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return c.Count()
+}
+
+func get(t *testing.T, ts *httptest.Server, config *tls.Config) (*http.Response, error) {
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	resp, err := client.Get(ts.URL)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return resp, err
+}
+
+func TestServerTLSClientCertificates(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	ca := newTestCert(t, "ca", nil)
+	server := newTestCert(t, "log-iss.example.com", &ca)
+	client := newTestCert(t, "shuttle.example.com", &ca)
+	otherCA := newTestCert(t, "other-ca", nil)
+	stranger := newTestCert(t, "shuttle.example.com", &otherCA)
+
+	settings := serverTLSSettings{
+		CertFile:     writeTestFile(t, dir, "server.pem", server.certPEM),
+		KeyFile:      writeTestFile(t, dir, "server.key", server.keyPEM),
+		ClientCAFile: writeTestFile(t, dir, "ca.pem", ca.certPEM),
+		MinVersion:   tls.VersionTLS12,
+	}
+	registry := metrics.NewRegistry()
+	st, err := newServerTLSReloader(settings, registry)
+	if !assert.NoError(err) {
+		return
+	}
+
+	basic, _ := NewBasicAuthFromString("user:password", "hmacKey", registry)
+	auth, err := newAuthenticator(AuthConfig{HmacKey: "hmacKey", ClientCerts: "shuttle/current:shuttle.example.com"}, basic, registry)
+	if !assert.NoError(err) {
+		return
+	}
+
+	creds := make(chan *credential, 1)
+	ts, config := newTestTLSServer(t, st, ca, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		creds <- auth.Authenticate(r)
+	}))
+	defer ts.Close()
+
+	config.Certificates = []tls.Certificate{client.tlsCertificate(t)}
+	_, err = get(t, ts, config)
+	if assert.NoError(err) {
+		if cred := <-creds; assert.NotNil(cred) {
+			assert.Equal(credential{Name: "shuttle", Stage: "current"}, *cred)
+		}
+	}
+
+	// Client certificates are optional, so basic auth still works
+	config.Certificates = nil
+	_, err = get(t, ts, config)
+	if assert.NoError(err) {
+		assert.Nil(<-creds)
+	}
+
+	// A certificate from another CA fails the handshake
+	strangerCert := stranger.tlsCertificate(t)
+	config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return &strangerCert, nil
+	}
+	_, err = get(t, ts, config)
+	assert.Error(err)
+	assert.Equal(int64(1), awaitCount(st.handshakeFailures, 1))
+}
+
+func TestServerTLSRequireClientCertificates(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	ca := newTestCert(t, "ca", nil)
+	server := newTestCert(t, "log-iss.example.com", &ca)
+
+	settings := serverTLSSettings{
+		CertFile:   writeTestFile(t, dir, "server.pem", server.certPEM),
+		KeyFile:    writeTestFile(t, dir, "server.key", server.keyPEM),
+		ClientAuth: clientAuthRequire,
+	}
+	_, err := newServerTLSReloader(settings, metrics.NewRegistry())
+	assert.Error(err, "requiring client certificates needs a CA")
+
+	settings.ClientCAFile = writeTestFile(t, dir, "ca.pem", ca.certPEM)
+	st, err := newServerTLSReloader(settings, metrics.NewRegistry())
+	if !assert.NoError(err) {
+		return
+	}
+
+	ts, config := newTestTLSServer(t, st, ca, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	_, err = get(t, ts, config)
+	assert.Error(err)
+	assert.Equal(int64(1), awaitCount(st.handshakeFailures, 1))
+}
+
+func TestServerTLSReload(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	ca := newTestCert(t, "ca", nil)
+	server := newTestCert(t, "log-iss.example.com", &ca)
+	settings := serverTLSSettings{
+		CertFile: writeTestFile(t, dir, "server.pem", server.certPEM),
+		KeyFile:  writeTestFile(t, dir, "server.key", server.keyPEM),
+	}
+	st, err := newServerTLSReloader(settings, metrics.NewRegistry())
+	if !assert.NoError(err) {
+		return
+	}
+
+	ts, config := newTestTLSServer(t, st, ca, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	_, err = get(t, ts, config)
+	assert.NoError(err)
+
+	// A certificate from a new CA is served once reloaded
+	newCA := newTestCert(t, "new-ca", nil)
+	rolled := newTestCert(t, "log-iss.example.com", &newCA)
+	writeTestFile(t, dir, "server.pem", rolled.certPEM)
+	writeTestFile(t, dir, "server.key", rolled.keyPEM)
+	assert.NoError(st.Reload())
+	assert.Equal(int64(1), st.reloads.Count())
+
+	_, err = get(t, ts, config)
+	assert.Error(err)
+	config.RootCAs.AddCert(newCA.cert)
+	_, err = get(t, ts, config)
+	assert.NoError(err)
+
+	// Broken files leave the current certificate in place
+	ioutil.WriteFile(settings.KeyFile, []byte("garbage"), 0600)
+	assert.Error(st.Reload())
+	assert.Equal(int64(1), st.reloadFailures.Count())
+	_, err = get(t, ts, config)
+	assert.NoError(err)
+}
+
+func TestCertIdentities(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	c := newTestCert(t, "shuttle.example.com", &ca)
+	assert.Equal(t, []string{"shuttle.example.com", "shuttle.example.com"}, certIdentities(c.cert))
+}
+
+func TestServerTLSHTTP2(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	ca := newTestCert(t, "ca", nil)
+	server := newTestCert(t, "log-iss.example.com", &ca)
+	settings := serverTLSSettings{
+		CertFile: writeTestFile(t, dir, "server.pem", server.certPEM),
+		KeyFile:  writeTestFile(t, dir, "server.key", server.keyPEM),
+	}
+	st, err := newServerTLSReloader(settings, metrics.NewRegistry())
+	if !assert.NoError(err) {
+		return
+	}
+
+	// As in httpServer.Run, rather than httptest, which sets its own protocols
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(err) {
+		return
+	}
+	s := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), TLSConfig: st.Config()}
+	go s.ServeTLS(ln, "", "")
+	defer s.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	config := &tls.Config{RootCAs: roots, ServerName: "log-iss.example.com"}
+	for _, h2 := range []bool{true, false} {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: config.Clone(), ForceAttemptHTTP2: h2}}
+		resp, err := client.Get("https://" + ln.Addr().String())
+		if assert.NoError(err) {
+			resp.Body.Close()
+			assert.Equal(h2, resp.ProtoMajor == 2, resp.Proto)
+		}
+	}
+}
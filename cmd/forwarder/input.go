@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Priority of submitted JSON logs that don't have one: local7.info, the
+	// same as logplex uses for application logs.
+	defaultJSONPriority = 190
+
+	jsonTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+// inputDecoder converts a request body into logplex frames for FixerFunc.
+type inputDecoder func(r io.Reader) (io.Reader, error)
+
+// inputFormat is a Content-Type accepted on /logs.
+type inputFormat struct {
+	Name   string // used in metric names
+	Decode inputDecoder
+}
+
+// inputFormats are the accepted Content-Types, without parameters.
+var inputFormats = map[string]inputFormat{
+	"application/logplex-1": {Name: "logplex", Decode: decodeLogplex},
+	"application/json":      {Name: "json", Decode: decodeJSON},
+	"application/x-ndjson":  {Name: "ndjson", Decode: decodeNDJSON},
+	"application/ndjson":    {Name: "ndjson", Decode: decodeNDJSON},
+}
+
+// jsonInput is a single log submitted as JSON.
+type jsonInput struct {
+	Time     string                       `json:"time"`
+	Host     string                       `json:"host"`
+	App      string                       `json:"app"`
+	Procid   string                       `json:"procid"`
+	Msgid    string                       `json:"msgid"`
+	Priority *int                         `json:"priority"`
+	Msg      string                       `json:"msg"`
+	SD       map[string]map[string]string `json:"sd"`
+}
+
+func decodeLogplex(r io.Reader) (io.Reader, error) {
+	return r, nil
+}
+
+// decodeJSON decodes a JSON array of logs.
+func decodeJSON(r io.Reader) (io.Reader, error) {
+	var logs []jsonInput
+	if err := json.NewDecoder(r).Decode(&logs); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %s", err)
+	}
+
+	var out bytes.Buffer
+	for i, l := range logs {
+		if err := writeLogplexFrame(&out, l); err != nil {
+			return nil, fmt.Errorf("log %d: %s", i, err)
+		}
+	}
+	return &out, nil
+}
+
+// decodeNDJSON decodes newline delimited JSON logs, ignoring blank lines.
+func decodeNDJSON(r io.Reader) (io.Reader, error) {
+	var out bytes.Buffer
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		if len(bytes.TrimSpace(line)) > 0 {
+			var l jsonInput
+			if err := json.Unmarshal(line, &l); err != nil {
+				return nil, fmt.Errorf("line %d: invalid JSON: %s", n, err)
+			}
+			if err := writeLogplexFrame(&out, l); err != nil {
+				return nil, fmt.Errorf("line %d: %s", n, err)
+			}
+		}
+
+		if err == io.EOF {
+			return &out, nil
+		}
+	}
+}
+
+// headerField returns v, or the NILVALUE if it's empty. Fields can't
+// contain spaces since they're space delimited.
+func headerField(name string, v string) (string, error) {
+	if v == "" {
+		return "-", nil
+	}
+	if strings.ContainsAny(v, " \t\r\n") {
+		return "", fmt.Errorf("%s must not contain whitespace", name)
+	}
+	return v, nil
+}
+
+// writeLogplexFrame writes l as a logplex frame:
+// LEN SP PRI VERSION SP TIMESTAMP SP HOSTNAME SP APP-NAME SP PROCID SP MSGID SP STRUCTURED-DATA [SP MSG]
+func writeLogplexFrame(w *bytes.Buffer, l jsonInput) error {
+	var msg bytes.Buffer
+
+	pri := defaultJSONPriority
+	if l.Priority != nil {
+		pri = *l.Priority
+	}
+	if pri < 0 || pri > 191 {
+		return fmt.Errorf("priority must be between 0 and 191")
+	}
+
+	ts := time.Now().UTC().Format(jsonTimeFormat)
+	if l.Time != "" {
+		if _, err := time.Parse(time.RFC3339Nano, l.Time); err != nil {
+			return fmt.Errorf("time must be RFC 3339: %s", err)
+		}
+		ts = l.Time
+	}
+
+	msg.WriteString("<")
+	msg.WriteString(strconv.Itoa(pri))
+	msg.WriteString(">1 ")
+	msg.WriteString(ts)
+
+	for _, f := range []struct{ name, value string }{
+		{"host", l.Host},
+		{"app", l.App},
+		{"procid", l.Procid},
+		{"msgid", l.Msgid},
+	} {
+		v, err := headerField(f.name, f.value)
+		if err != nil {
+			return err
+		}
+		msg.WriteString(" ")
+		msg.WriteString(v)
+	}
+
+	elements, err := sdElementsFromMap(l.SD)
+	if err != nil {
+		return err
+	}
+	msg.WriteString(" ")
+	writeStructuredData(&msg, elements)
+	if l.Msg != "" {
+		msg.WriteString(" ")
+		msg.WriteString(l.Msg)
+	}
+
+	w.WriteString(strconv.Itoa(msg.Len()))
+	w.WriteString(" ")
+	msg.WriteTo(w)
+	return nil
+}
+
+// sdElementsFromMap converts a map of SD-ID to params into structured data
+// elements, sorted so the output is stable.
+func sdElementsFromMap(m map[string]map[string]string) ([]sdElement, error) {
+	elements := make([]sdElement, 0, len(m))
+	for id, params := range m {
+		if !validSDName(id) {
+			return nil, fmt.Errorf("invalid SD-ID %q", id)
+		}
+		e := sdElement{ID: id, Params: make([]sdParam, 0, len(params))}
+		for name, value := range params {
+			if !validSDName(name) {
+				return nil, fmt.Errorf("invalid SD-PARAM name %q", name)
+			}
+			e.Params = append(e.Params, sdParam{Name: name, Value: value})
+		}
+		sort.Slice(e.Params, func(i, j int) bool { return e.Params[i].Name < e.Params[j].Name })
+		elements = append(elements, e)
+	}
+	sort.Slice(elements, func(i, j int) bool { return elements[i].ID < elements[j].ID })
+	return elements, nil
+}
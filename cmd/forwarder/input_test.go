@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeJSON(t *testing.T) {
+	assert := assert.New(t)
+
+	in := `[
+		{"time": "2013-06-07T13:17:49.468822+00:00", "host": "host", "app": "heroku", "procid": "web.7", "msg": "hi"},
+		{"time": "2013-06-07T13:17:49.468822+00:00", "host": "host", "app": "heroku", "procid": "web.7", "priority": 13, "msg": "hello", "sd": {"meta": {"sequenceId": "hello"}, "foo": {"bar": "b\"az"}}}
+	]`
+	r, err := decodeJSON(strings.NewReader(in))
+	if !assert.NoError(err) {
+		return
+	}
+
+	res, err := fix(simpleHttpRequest(), r, "1.2.3.4", "", "", nil, getConfig())
+	assert.NoError(err)
+	assert.Equal(int64(2), res.numLogs)
+	assert.Equal("84 <190>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [origin ip=\"1.2.3.4\"] hi"+
+		"129 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [origin ip=\"1.2.3.4\"] [foo bar=\"b\\\"az\"][meta sequenceId=\"hello\"] hello",
+		string(res.bytes))
+}
+
+func TestDecodeNDJSON(t *testing.T) {
+	assert := assert.New(t)
+
+	in := `{"time": "2013-06-07T13:17:49.468822+00:00", "host": "host", "app": "heroku", "procid": "web.7", "msg": "hi"}
+
+{"time": "2013-06-07T13:17:49.468822+00:00", "app": "heroku", "msg": "hello"}`
+	r, err := decodeNDJSON(strings.NewReader(in))
+	if !assert.NoError(err) {
+		return
+	}
+
+	b, _ := ioutil.ReadAll(r)
+	assert.Equal("64 <190>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - - hi"+
+		"60 <190>1 2013-06-07T13:17:49.468822+00:00 - heroku - - - hello", string(b))
+}
+
+func TestDecodeJSONDefaultsTime(t *testing.T) {
+	assert := assert.New(t)
+
+	r, err := decodeJSON(strings.NewReader(`[{"msg": "hi"}]`))
+	if !assert.NoError(err) {
+		return
+	}
+	res, err := fix(simpleHttpRequest(), r, "", "", "", nil, getConfig())
+	assert.NoError(err)
+	assert.Equal(int64(1), res.numLogs)
+}
+
+func TestDecodeJSONErrors(t *testing.T) {
+	tests := map[string]string{
+		"not JSON":           `hello`,
+		"not an array":       `{"msg": "hi"}`,
+		"bad time":           `[{"time": "yesterday", "msg": "hi"}]`,
+		"bad priority":       `[{"priority": 200, "msg": "hi"}]`,
+		"whitespace in host": `[{"host": "my host", "msg": "hi"}]`,
+		"bad SD-ID":          `[{"sd": {"a b": {"c": "d"}}, "msg": "hi"}]`,
+		"bad param name":     `[{"sd": {"ab": {"c]": "d"}}, "msg": "hi"}]`,
+	}
+
+	for name, in := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := decodeJSON(strings.NewReader(in))
+			assert.Error(t, err)
+		})
+	}
+
+	_, err := decodeNDJSON(strings.NewReader("{\"msg\": \"hi\"}\n{\"msg\": 1}\n"))
+	assert.EqualError(t, err, "line 2: invalid JSON: json: cannot unmarshal number into Go struct field jsonInput.msg of type string")
+}
+
+func TestDecodeLogplex(t *testing.T) {
+	in := bytes.NewReader(input[0])
+	r, err := decodeLogplex(in)
+	assert.NoError(t, err)
+	assert.Equal(t, in, r)
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/heroku/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// Supported JWT signing algorithms
+const (
+	jwtRS256 = "RS256"
+	jwtES256 = "ES256"
+	jwtHS256 = "HS256"
+)
+
+// jwk is a key from a JSON Web Key Set, see RFC 7517.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`   // RSA modulus
+	E   string `json:"e"`   // RSA exponent
+	Crv string `json:"crv"` // EC curve
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"` // symmetric key
+
+	key interface{} // *rsa.PublicKey, *ecdsa.PublicKey or []byte
+}
+
+func decodeSegment(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// parse decodes the key material of k for the kty it names.
+func (k *jwk) parse() error {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeSegment(k.N)
+		if err != nil {
+			return err
+		}
+		e, err := decodeSegment(k.E)
+		if err != nil {
+			return err
+		}
+		if len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return errors.New("invalid RSA key")
+		}
+		k.key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	case "EC":
+		if k.Crv != "P-256" {
+			return fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeSegment(k.X)
+		if err != nil {
+			return err
+		}
+		y, err := decodeSegment(k.Y)
+		if err != nil {
+			return err
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return errors.New("invalid EC key")
+		}
+		k.key = pub
+	case "oct":
+		secret, err := decodeSegment(k.K)
+		if err != nil {
+			return err
+		}
+		if len(secret) == 0 {
+			return errors.New("empty symmetric key")
+		}
+		k.key = secret
+	default:
+		return fmt.Errorf("unsupported kty %q", k.Kty)
+	}
+	return nil
+}
+
+// verifies reports whether k may verify signatures made with alg. Keys are
+// tied to the algorithm family of their type, so that a public key can't be
+// used as an HMAC secret.
+func (k *jwk) verifies(alg string) bool {
+	if k.Alg != "" && k.Alg != alg {
+		return false
+	}
+	if k.Use != "" && k.Use != "sig" {
+		return false
+	}
+	switch alg {
+	case jwtRS256:
+		return k.Kty == "RSA"
+	case jwtES256:
+		return k.Kty == "EC"
+	case jwtHS256:
+		return k.Kty == "oct"
+	}
+	return false
+}
+
+func (k *jwk) verify(alg string, signed []byte, sig []byte) bool {
+	digest := sha256.Sum256(signed)
+	switch alg {
+	case jwtRS256:
+		return rsa.VerifyPKCS1v15(k.key.(*rsa.PublicKey), crypto.SHA256, digest[:], sig) == nil
+	case jwtES256:
+		if len(sig) != 64 {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(k.key.(*ecdsa.PublicKey), digest[:], r, s)
+	case jwtHS256:
+		mac := hmac.New(sha256.New, k.key.([]byte))
+		mac.Write(signed)
+		return hmac.Equal(sig, mac.Sum(nil))
+	}
+	return false
+}
+
+// parseJWKS parses a JSON Web Key Set, skipping keys that can't be used.
+func parseJWKS(b []byte) ([]*jwk, error) {
+	var set struct {
+		Keys []*jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make([]*jwk, 0, len(set.Keys))
+	for _, k := range set.Keys {
+		if err := k.parse(); err != nil {
+			log.WithFields(log.Fields{"ns": "auth", "at": "jwks", "kid": k.Kid, "skipped": true}).Info(err)
+			continue
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no usable keys in JWKS")
+	}
+	return keys, nil
+}
+
+// jwtAudience is the aud claim, which may be a string or an array of them.
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = jwtAudience{s}
+		return nil
+	}
+	var l []string
+	if err := json.Unmarshal(b, &l); err != nil {
+		return err
+	}
+	*a = l
+	return nil
+}
+
+func (a jwtAudience) contains(aud string) bool {
+	for _, s := range a {
+		if s == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// jwtAuth authenticates requests with JWTs, as in "Authorization: Bearer
+// JWT", verified against the keys of a JWKS. Claims name the credential:
+// NameClaim (default "sub") is its name, StageClaim (default "stage") its
+// stage and DeprecatedClaim (default "deprecated") whether it's deprecated.
+// As names may be per workload, only those in MetricsNames are used in
+// metric names; the rest are counted as "jwt".
+//
+// Bearer tokens that aren't JWTs are passed to Fallback, if set.
+type jwtAuth struct {
+	sync.RWMutex
+	Source          string // path or http(s) URL of the JWKS
+	Issuer          string
+	Audience        string
+	ClockSkew       time.Duration
+	NameClaim       string
+	StageClaim      string
+	DeprecatedClaim string
+	MetricsNames    map[string]bool
+	Fallback        authenticator
+	Client          *http.Client
+	keys            []*jwk
+	registry        metrics.Registry
+	now             func() time.Time
+	pKeys           metrics.Gauge   // number of usable keys
+	pExpired        metrics.Counter // tokens refused for exp or nbf
+}
+
+func newJWTAuth(config AuthConfig, registry metrics.Registry) (*jwtAuth, error) {
+	ja := &jwtAuth{
+		Source:          config.JwtJwks,
+		Issuer:          config.JwtIssuer,
+		Audience:        config.JwtAudience,
+		ClockSkew:       config.JwtClockSkew,
+		NameClaim:       config.JwtNameClaim,
+		StageClaim:      config.JwtStageClaim,
+		DeprecatedClaim: config.JwtDeprecatedClaim,
+		MetricsNames:    make(map[string]bool, len(config.JwtMetricsNames)),
+		Client:          &http.Client{Timeout: 10 * time.Second},
+		registry:        registry,
+		now:             time.Now,
+		pKeys:           metrics.GetOrRegisterGauge("log-iss.jwks.keys.g", registry),
+		pExpired:        metrics.GetOrRegisterCounter("log-iss.auth.jwt.expired.g", registry),
+	}
+	for _, name := range config.JwtMetricsNames {
+		ja.MetricsNames[name] = true
+	}
+	if ja.NameClaim == "" {
+		ja.NameClaim = "sub"
+	}
+	if ja.StageClaim == "" {
+		ja.StageClaim = "stage"
+	}
+	if ja.DeprecatedClaim == "" {
+		ja.DeprecatedClaim = "deprecated"
+	}
+
+	if err := ja.refresh(); err != nil {
+		return nil, fmt.Errorf("Unable to load JWKS from %s: %s", ja.Source, err)
+	}
+	return ja, nil
+}
+
+func (ja *jwtAuth) fetch() ([]byte, error) {
+	if !strings.HasPrefix(ja.Source, "http://") && !strings.HasPrefix(ja.Source, "https://") {
+		return ioutil.ReadFile(ja.Source)
+	}
+
+	resp, err := ja.Client.Get(ja.Source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// refresh reloads the keys from Source, keeping the old ones on failure.
+func (ja *jwtAuth) refresh() error {
+	b, err := ja.fetch()
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(b)
+	if err != nil {
+		return err
+	}
+
+	ja.Lock()
+	defer ja.Unlock()
+	ja.keys = keys
+	ja.pKeys.Update(int64(len(keys)))
+	return nil
+}
+
+func (ja *jwtAuth) startRefresh(interval time.Duration) {
+	pFailures := metrics.GetOrRegisterCounter("log-iss.jwks.refresh.failures.g", ja.registry)
+	pSuccesses := metrics.GetOrRegisterCounter("log-iss.jwks.refresh.successes.g", ja.registry)
+
+	for range time.Tick(interval) {
+		if err := ja.refresh(); err != nil {
+			log.WithFields(log.Fields{"ns": "auth", "at": "error", "jwks": ja.Source, "refresh": true, "message": err.Error()}).Info()
+			pFailures.Inc(1)
+			continue
+		}
+		pSuccesses.Inc(1)
+	}
+}
+
+// looksLikeJWT reports whether a bearer token has the three segments of a
+// compact JWS.
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+func (ja *jwtAuth) Authenticate(r *http.Request) (cred *credential) {
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	token := ""
+	if len(parts) == 2 {
+		token = strings.TrimSpace(parts[1])
+	}
+	if !looksLikeJWT(token) && ja.Fallback != nil {
+		return ja.Fallback.Authenticate(r)
+	}
+
+	_, span := startSpan(r.Context(), "JWTAuth.Authenticate", spanKindInternal)
+	defer func() {
+		span.SetAttribute("log_iss.authenticated", cred != nil)
+		if cred != nil {
+			span.SetAttribute("log_iss.credential_stage", cred.Stage)
+		}
+		span.End()
+	}()
+
+	c, err := ja.validate(token)
+	if err != nil {
+		log.WithFields(log.Fields{"ns": "auth", "at": "failure", "scheme": "jwt", "reason": err.Error()}).Info()
+		countSchemeAuthFailure(ja.registry, "jwt")
+		return nil
+	}
+	c.metricsName = "jwt"
+	if ja.MetricsNames[c.Name] {
+		c.metricsName = c.Name
+	}
+	countAuthSuccess(ja.registry, c.metricsName, c.Stage)
+	return c
+}
+
+// validate verifies token's signature and registered claims, and maps its
+// claims onto a credential.
+func (ja *jwtAuth) validate(token string) (*credential, error) {
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	hb, err := decodeSegment(segments[0])
+	if err != nil {
+		return nil, errors.New("malformed header")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(hb, &header); err != nil {
+		return nil, errors.New("malformed header")
+	}
+	sig, err := decodeSegment(segments[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+
+	signed := []byte(segments[0] + "." + segments[1])
+	verified := false
+	ja.RLock()
+	for _, k := range ja.keys {
+		if (header.Kid == "" || k.Kid == header.Kid) && k.verifies(header.Alg) && k.verify(header.Alg, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	ja.RUnlock()
+	if !verified {
+		return nil, fmt.Errorf("no key verifies %s signature with kid %q", header.Alg, header.Kid)
+	}
+
+	cb, err := decodeSegment(segments[1])
+	if err != nil {
+		return nil, errors.New("malformed claims")
+	}
+	var registered struct {
+		Iss string      `json:"iss"`
+		Aud jwtAudience `json:"aud"`
+		Exp *float64    `json:"exp"`
+		Nbf *float64    `json:"nbf"`
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(cb, &registered); err != nil {
+		return nil, errors.New("malformed claims")
+	}
+	if err := json.Unmarshal(cb, &claims); err != nil {
+		return nil, errors.New("malformed claims")
+	}
+
+	now := ja.now()
+	if registered.Exp == nil {
+		return nil, errors.New("missing exp")
+	}
+	if now.Add(-ja.ClockSkew).After(time.Unix(int64(*registered.Exp), 0)) {
+		ja.pExpired.Inc(1)
+		return nil, errors.New("expired")
+	}
+	if registered.Nbf != nil && now.Add(ja.ClockSkew).Before(time.Unix(int64(*registered.Nbf), 0)) {
+		ja.pExpired.Inc(1)
+		return nil, errors.New("not yet valid")
+	}
+	if ja.Issuer != "" && registered.Iss != ja.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %q", registered.Iss)
+	}
+	if ja.Audience != "" && !registered.Aud.contains(ja.Audience) {
+		return nil, errors.New("unexpected audience")
+	}
+
+	name, _ := claims[ja.NameClaim].(string)
+	if name == "" {
+		return nil, fmt.Errorf("missing %s claim", ja.NameClaim)
+	}
+	stage, _ := claims[ja.StageClaim].(string)
+	if stage == "" {
+		stage = "jwt"
+	}
+	deprecated, _ := claims[ja.DeprecatedClaim].(bool)
+	return &credential{Name: name, Stage: stage, Deprecated: deprecated}, nil
+}
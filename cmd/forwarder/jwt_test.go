@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/heroku/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+var b64 = base64.RawURLEncoding
+
+type jwtTestKeys struct {
+	rsa  *rsa.PrivateKey
+	ec   *ecdsa.PrivateKey
+	hmac []byte
+}
+
+func newJWTTestKeys(t *testing.T) *jwtTestKeys {
+	rk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ek, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &jwtTestKeys{rsa: rk, ec: ek, hmac: []byte("hmac-secret")}
+}
+
+func (k *jwtTestKeys) JWKS() []byte {
+	b, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "n": b64.EncodeToString(k.rsa.N.Bytes()), "e": "AQAB"},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64.EncodeToString(k.ec.X.Bytes()), "y": b64.EncodeToString(k.ec.Y.Bytes())},
+		{"kty": "oct", "kid": "hs", "alg": "HS256", "k": b64.EncodeToString(k.hmac)},
+		{"kty": "OKP", "kid": "unsupported"},
+	}})
+	return b
+}
+
+func (k *jwtTestKeys) Sign(t *testing.T, alg string, kid string, claims map[string]interface{}) string {
+	hb, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	cb, _ := json.Marshal(claims)
+	signed := b64.EncodeToString(hb) + "." + b64.EncodeToString(cb)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch alg {
+	case jwtRS256:
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case jwtES256:
+		r, s, err := ecdsa.Sign(rand.Reader, k.ec, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	case jwtHS256:
+		mac := hmac.New(sha256.New, k.hmac)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	}
+	return signed + "." + b64.EncodeToString(sig)
+}
+
+func newTestJWTAuth(t *testing.T, keys *jwtTestKeys) *jwtAuth {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := ioutil.WriteFile(path, keys.JWKS(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ja, err := newJWTAuth(AuthConfig{
+		JwtJwks:         path,
+		JwtIssuer:       "https://issuer",
+		JwtAudience:     "log-iss",
+		JwtClockSkew:    time.Minute,
+		JwtMetricsNames: []string{"workload"},
+	}, metrics.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ja
+}
+
+func bearerRequest(token string) *http.Request {
+	r, _ := http.NewRequest("POST", "http://localhost/logs", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestJWTAuth(t *testing.T) {
+	assert := assert.New(t)
+	keys := newJWTTestKeys(t)
+	ja := newTestJWTAuth(t, keys)
+	assert.Equal(int64(3), ja.pKeys.Value())
+
+	now := time.Now()
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{"sub": "workload", "iss": "https://issuer", "aud": []string{"other", "log-iss"}, "exp": now.Add(time.Minute).Unix()}
+		for k, v := range extra {
+			c[k] = v
+		}
+		return c
+	}
+
+	for _, alg := range []string{jwtRS256, jwtES256, jwtHS256} {
+		kid := map[string]string{jwtRS256: "rsa", jwtES256: "ec", jwtHS256: "hs"}[alg]
+		cred := ja.Authenticate(bearerRequest(keys.Sign(t, alg, kid, claims(map[string]interface{}{"stage": "current", "deprecated": true}))))
+		if assert.NotNil(cred, alg) {
+			assert.Equal(credential{Name: "workload", Stage: "current", Deprecated: true, metricsName: "workload"}, *cred)
+		}
+	}
+
+	// Without a kid every key of the right type is tried
+	if cred := ja.Authenticate(bearerRequest(keys.Sign(t, jwtRS256, "", claims(nil)))); assert.NotNil(cred) {
+		assert.Equal("jwt", cred.Stage)
+	}
+	assert.Equal(int64(3), metrics.GetOrRegisterCounter("log-iss.auth.workload.current.successes.g", ja.registry).Count())
+	assert.Equal(int64(1), metrics.GetOrRegisterCounter("log-iss.auth.workload.jwt.successes.g", ja.registry).Count())
+
+	// Names that aren't listed are counted together
+	if cred := ja.Authenticate(bearerRequest(keys.Sign(t, jwtRS256, "rsa", claims(map[string]interface{}{"sub": "pod-1234"})))); assert.NotNil(cred) {
+		assert.Equal("pod-1234", cred.Name)
+		assert.Equal("jwt", metricsUser(bearerRequest(""), cred))
+	}
+	assert.Equal(int64(1), metrics.GetOrRegisterCounter("log-iss.auth.jwt.jwt.successes.g", ja.registry).Count())
+	assert.Nil(ja.registry.Get("log-iss.auth.pod-1234.jwt.successes.g"))
+
+	// Within the clock skew
+	assert.NotNil(ja.Authenticate(bearerRequest(keys.Sign(t, jwtES256, "ec", claims(map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix()})))))
+	assert.NotNil(ja.Authenticate(bearerRequest(keys.Sign(t, jwtES256, "ec", claims(map[string]interface{}{"nbf": now.Add(30 * time.Second).Unix()})))))
+
+	refused := map[string]string{
+		"expired":        keys.Sign(t, jwtRS256, "rsa", claims(map[string]interface{}{"exp": now.Add(-2 * time.Minute).Unix()})),
+		"not yet valid":  keys.Sign(t, jwtRS256, "rsa", claims(map[string]interface{}{"nbf": now.Add(2 * time.Minute).Unix()})),
+		"no exp":         keys.Sign(t, jwtRS256, "rsa", map[string]interface{}{"sub": "workload", "iss": "https://issuer", "aud": "log-iss"}),
+		"wrong issuer":   keys.Sign(t, jwtRS256, "rsa", claims(map[string]interface{}{"iss": "https://elsewhere"})),
+		"wrong audience": keys.Sign(t, jwtRS256, "rsa", claims(map[string]interface{}{"aud": "other"})),
+		"no subject":     keys.Sign(t, jwtRS256, "rsa", claims(map[string]interface{}{"sub": ""})),
+		"wrong kid":      keys.Sign(t, jwtRS256, "ec", claims(nil)),
+		"none":           keys.Sign(t, "none", "", claims(nil)),
+		"garbage":        "a.b.c",
+	}
+	for name, token := range refused {
+		assert.Nil(ja.Authenticate(bearerRequest(token)), name)
+	}
+	assert.Equal(int64(2), ja.pExpired.Count())
+	assert.Equal(int64(len(refused)), metrics.GetOrRegisterCounter("log-iss.auth.scheme.jwt.failures.g", ja.registry).Count())
+
+	// An RSA public key can't be used as an HS256 secret
+	forged := &jwtTestKeys{hmac: []byte(b64.EncodeToString(keys.rsa.N.Bytes()))}
+	assert.Nil(ja.Authenticate(bearerRequest(forged.Sign(t, jwtHS256, "rsa", claims(nil)))))
+}
+
+func TestJWTAuthFallback(t *testing.T) {
+	assert := assert.New(t)
+	keys := newJWTTestKeys(t)
+	ja := newTestJWTAuth(t, keys)
+
+	assert.Nil(ja.Authenticate(bearerRequest("static")))
+
+	ja.Fallback, _ = newBearerAuth("shuttle:static", "hmacKey", ja.registry)
+	if cred := ja.Authenticate(bearerRequest("static")); assert.NotNil(cred) {
+		assert.Equal("shuttle", cred.Name)
+	}
+}
+
+func TestJWTAuthRefreshFromURL(t *testing.T) {
+	assert := assert.New(t)
+	keys := newJWTTestKeys(t)
+	jwks := keys.JWKS()
+	status := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write(jwks)
+	}))
+	defer ts.Close()
+
+	ja, err := newJWTAuth(AuthConfig{JwtJwks: ts.URL}, metrics.NewRegistry())
+	if !assert.NoError(err) {
+		return
+	}
+	token := keys.Sign(t, jwtES256, "ec", map[string]interface{}{"sub": "workload", "exp": time.Now().Add(time.Minute).Unix()})
+	assert.NotNil(ja.Authenticate(bearerRequest(token)))
+
+	// Rotated keys are picked up on refresh
+	rotated := newJWTTestKeys(t)
+	jwks = rotated.JWKS()
+	assert.NoError(ja.refresh())
+	assert.Nil(ja.Authenticate(bearerRequest(token)))
+
+	// A failed refresh keeps the keys loaded
+	status = http.StatusInternalServerError
+	assert.Error(ja.refresh())
+	assert.Equal(int64(3), ja.pKeys.Value())
+
+	_, err = newJWTAuth(AuthConfig{JwtJwks: ts.URL}, metrics.NewRegistry())
+	assert.Error(err)
+}
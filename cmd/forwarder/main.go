@@ -15,12 +15,40 @@ import (
 type shutdownCh chan struct{}
 
 func awaitShutdownSignals(chs ...shutdownCh) {
-	sigCh := make(chan os.Signal)
+	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	notifyShutdown(sigCh, chs...)
+}
+
+// notifyShutdown tells each of chs to shut down for every signal received,
+// skipping nil channels, which nothing is listening on.
+func notifyShutdown(sigCh <-chan os.Signal, chs ...shutdownCh) {
 	for sig := range sigCh {
 		log.WithFields(log.Fields{"at": "shutdown-signal", "signal": sig}).Info()
 		for _, ch := range chs {
-			ch <- struct{}{}
+			if ch != nil {
+				ch <- struct{}{}
+			}
+		}
+	}
+}
+
+// reloader rereads certificates from disk.
+type reloader interface {
+	Reload() error
+}
+
+func awaitReloadSignals(reloaders ...reloader) {
+	// Without anything to reload, SIGHUP keeps its default of terminating
+	if len(reloaders) == 0 {
+		return
+	}
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	for sig := range sigCh {
+		log.WithFields(log.Fields{"at": "reload-signal", "signal": sig}).Info()
+		for _, r := range reloaders {
+			r.Reload()
 		}
 	}
 }
@@ -45,14 +73,62 @@ func main() {
 		log.Fatalln(err)
 	}
 
-	forwarderSet := newForwarderSet(config)
+	authenticator, err := newAuthenticator(authConfig, auth, config.MetricsRegistry)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	chain, err := newDeliveryChain(config, "", 0)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	var deliverer deliverer = chain
+	chains := []*deliveryChain{chain}
+	var routes *router
+	if len(config.RouteDestinations) > 0 {
+		routes, err = newRouter(config, chain)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		deliverer = routes
+		for _, c := range routes.chains {
+			chains = append(chains, c)
+		}
+	}
 
 	shutdownCh := make(shutdownCh)
-	httpServer := newHTTPServer(config, auth, fix, forwarderSet)
+	httpServer := newHTTPServer(config, authenticator, fix, deliverer)
+	httpServer.readiness = newReadiness(config, chain.forwarders, auth)
+	if routes != nil {
+		httpServer.readiness.routes = routes.forwarders()
+	}
+
+	syslogServer, err := newSyslogServer(config, fix, deliverer)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	go awaitShutdownSignals(httpServer.shutdownCh, syslogServer.ShutdownCh(), shutdownCh)
 
-	go awaitShutdownSignals(httpServer.shutdownCh, shutdownCh)
+	var reloaders []reloader
+	if config.HttpTlsConfig != nil {
+		reloaders = append(reloaders, config.HttpTlsConfig)
+	}
+	if config.TlsConfig != nil {
+		reloaders = append(reloaders, config.TlsConfig)
+	}
+	if config.Rules != nil {
+		reloaders = append(reloaders, config.Rules)
+	}
+	go awaitReloadSignals(reloaders...)
 
-	go forwarderSet.Run()
+	for _, c := range chains {
+		c.Run()
+	}
+	if config.Deduper != nil {
+		go config.Deduper.Run(config.OutputEncoder, deliverer)
+	}
 
 	go func() {
 		if err := httpServer.Run(); err != nil {
@@ -60,6 +136,12 @@ func main() {
 		}
 	}()
 
+	if syslogServer.Enabled() {
+		if err := syslogServer.Run(); err != nil {
+			log.Fatalln("Unable to start syslog server:", err)
+		}
+	}
+
 	if config.LibratoOwner != "" && config.LibratoToken != "" {
 		log.WithField("source", config.LibratoSource).Info("starting librato metrics reporting")
 		go librato.Librato(
@@ -82,5 +164,11 @@ func main() {
 	<-shutdownCh
 	log.WithField("at", "drain").Info()
 	httpServer.Wait()
+	syslogServer.Wait()
+	if config.Deduper != nil {
+		config.Deduper.Close()
+	}
+	closeDeliveryChains(config.AsyncDrainTimeout, chains...)
+	config.Tracer.Shutdown()
 	log.WithField("at", "exit").Info()
 }
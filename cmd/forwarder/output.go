@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Values for OUTPUT_FORMAT
+const (
+	outputFormatRFC5424 = "rfc5424"
+	outputFormatRFC3164 = "rfc3164"
+	outputFormatJSON    = "json"
+)
+
+// Values for OUTPUT_FRAMING
+const (
+	outputFramingOctetCounting  = "octet-counting"  // LEN SP MSG, per RFC 6587 section 3.4.1 and RFC 5425
+	outputFramingNonTransparent = "non-transparent" // MSG LF, per RFC 6587 section 3.4.2
+)
+
+var (
+	nilVal = []byte("- ")
+
+	// Embedded newlines are escaped the way rsyslog escapes control
+	// characters, so they can't be mistaken for the end of a frame.
+	escapedNewline = []byte("#012")
+
+	defaultOutputEncoder = &outputEncoder{Format: formatRFC5424, Frame: frameOctetCounting}
+)
+
+// syslogFrame is a single log message after fixing, split into the parts
+// needed to write it out.
+type syslogFrame struct {
+	PrivalVersion []byte
+	Time          []byte
+	Hostname      []byte
+	Appname       []byte
+	Procid        []byte
+	Msgid         []byte
+	SD            []byte // structured data added by log-iss
+	Msg           []byte // the rest of the message as received, including any structured data of its own
+
+	LengthMismatch bool // the frame's octet count wasn't the length read for it
+}
+
+// outputEncoder converts fixed messages into the bytes that are forwarded.
+// Format writes a single message, which Frame then appends to dst, leaving
+// msg empty.
+type outputEncoder struct {
+	Format func(w *bytes.Buffer, f *syslogFrame)
+	Frame  func(dst *bytes.Buffer, msg *bytes.Buffer)
+}
+
+func newOutputEncoder(format string, framing string) (*outputEncoder, error) {
+	e := &outputEncoder{}
+
+	switch format {
+	case outputFormatRFC5424:
+		e.Format = formatRFC5424
+	case outputFormatRFC3164:
+		e.Format = formatRFC3164
+	case outputFormatJSON:
+		// JSON documents are always newline delimited
+		e.Format = formatJSON
+		framing = outputFramingNonTransparent
+	default:
+		return nil, fmt.Errorf("Unknown output format: %s", format)
+	}
+
+	switch framing {
+	case outputFramingOctetCounting:
+		e.Frame = frameOctetCounting
+	case outputFramingNonTransparent:
+		e.Frame = frameNonTransparent
+	default:
+		return nil, fmt.Errorf("Unknown output framing: %s", framing)
+	}
+
+	return e, nil
+}
+
+// writeMsg writes the message as received after the structured data added by
+// log-iss, dropping its NILVALUE structured data if present.
+func writeMsg(w *bytes.Buffer, b []byte) {
+	if len(b) >= 2 && bytes.Equal(b[0:2], nilVal) {
+		w.Write(b[1:])
+	} else if len(b) > 0 {
+		w.WriteString(" ")
+		w.Write(b)
+	}
+}
+
+// PRI VERSION SP TIMESTAMP SP HOSTNAME SP APP-NAME SP PROCID SP MSGID SP STRUCTURED-DATA MSG
+func formatRFC5424(w *bytes.Buffer, f *syslogFrame) {
+	w.Write(f.PrivalVersion)
+	w.WriteString(" ")
+	w.Write(f.Time)
+	w.WriteString(" ")
+	w.Write(f.Hostname)
+	w.WriteString(" ")
+	w.Write(f.Appname)
+	w.WriteString(" ")
+	w.Write(f.Procid)
+	w.WriteString(" ")
+	w.Write(f.Msgid)
+	w.WriteString(" ")
+	w.Write(f.SD)
+	writeMsg(w, f.Msg)
+}
+
+// PRI TIMESTAMP SP HOSTNAME SP TAG: SP MSG, per RFC 3164 section 4.1. The
+// structured data is kept at the start of MSG, since there's nowhere else to
+// put it.
+func formatRFC3164(w *bytes.Buffer, f *syslogFrame) {
+	pri := f.PrivalVersion
+	if i := bytes.IndexByte(pri, '>'); i >= 0 {
+		pri = pri[:i+1]
+	}
+	w.Write(pri)
+
+	t, err := time.Parse(time.RFC3339Nano, string(f.Time))
+	if err != nil {
+		t = time.Now()
+	}
+	w.WriteString(t.UTC().Format(time.Stamp))
+	w.WriteString(" ")
+	w.Write(f.Hostname)
+	w.WriteString(" ")
+	w.Write(f.Appname)
+	if len(f.Procid) > 0 && !bytes.Equal(f.Procid, nilVal[:1]) {
+		w.WriteString("[")
+		w.Write(f.Procid)
+		w.WriteString("]")
+	}
+	w.WriteString(":")
+	if len(f.SD) > 0 {
+		w.WriteString(" ")
+		w.Write(f.SD)
+	}
+	writeMsg(w, f.Msg)
+}
+
+func frameOctetCounting(dst *bytes.Buffer, msg *bytes.Buffer) {
+	dst.WriteString(strconv.Itoa(msg.Len()))
+	dst.WriteString(" ")
+	msg.WriteTo(dst)
+}
+
+// frameNonTransparent terminates the message with a newline. A trailing
+// newline already in the message is reused, and any others are escaped.
+func frameNonTransparent(dst *bytes.Buffer, msg *bytes.Buffer) {
+	b := bytes.TrimSuffix(msg.Bytes(), []byte("\n"))
+	for {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			break
+		}
+		dst.Write(b[:i])
+		dst.Write(escapedNewline)
+		b = b[i+1:]
+	}
+	dst.Write(b)
+	dst.WriteString("\n")
+	msg.Reset()
+}
+
+// jsonLog is the document written for each message in the json output format.
+type jsonLog struct {
+	Priority       *int                         `json:"priority,omitempty"`
+	Facility       *int                         `json:"facility,omitempty"`
+	Severity       *int                         `json:"severity,omitempty"`
+	Timestamp      string                       `json:"timestamp,omitempty"`
+	Hostname       string                       `json:"hostname,omitempty"`
+	AppName        string                       `json:"app_name,omitempty"`
+	Procid         string                       `json:"procid,omitempty"`
+	Msgid          string                       `json:"msgid,omitempty"`
+	StructuredData map[string]map[string]string `json:"structured_data,omitempty"`
+	OriginIP       string                       `json:"origin_ip,omitempty"`
+	Metadata       map[string]string            `json:"metadata,omitempty"`
+	Message        string                       `json:"message"`
+}
+
+// nilToEmpty returns the field as a string, or "" for the NILVALUE.
+func nilToEmpty(b []byte) string {
+	if len(b) == 1 && b[0] == '-' {
+		return ""
+	}
+	return string(b)
+}
+
+// parsePrival parses the PRI part of "<PRI>VERSION".
+func parsePrival(b []byte) (int, bool) {
+	end := bytes.IndexByte(b, '>')
+	if len(b) < 3 || b[0] != '<' || end < 2 {
+		return 0, false
+	}
+	pri, err := strconv.Atoi(string(b[1:end]))
+	if err != nil || pri < 0 || pri > 191 {
+		return 0, false
+	}
+	return pri, true
+}
+
+// sdMap converts structured data elements to a map of SD-ID to params.
+func sdMap(elements []sdElement) map[string]map[string]string {
+	if len(elements) == 0 {
+		return nil
+	}
+	m := make(map[string]map[string]string, len(elements))
+	for _, e := range elements {
+		params := m[e.ID]
+		if params == nil {
+			params = make(map[string]string, len(e.Params))
+			m[e.ID] = params
+		}
+		for _, p := range e.Params {
+			params[p.Name] = p.Value
+		}
+	}
+	return m
+}
+
+// formatJSON writes the message as a JSON document. The structured data
+// added by log-iss is split into origin_ip and metadata, with the "fields"
+// param expanded into individual metadata entries. Structured data that
+// came with the message is kept under structured_data.
+func formatJSON(w *bytes.Buffer, f *syslogFrame) {
+	doc := jsonLog{
+		Timestamp: nilToEmpty(f.Time),
+		Hostname:  nilToEmpty(f.Hostname),
+		AppName:   nilToEmpty(f.Appname),
+		Procid:    nilToEmpty(f.Procid),
+		Msgid:     nilToEmpty(f.Msgid),
+	}
+
+	if pri, ok := parsePrival(f.PrivalVersion); ok {
+		facility, severity := pri/8, pri%8
+		doc.Priority, doc.Facility, doc.Severity = &pri, &facility, &severity
+	}
+
+	added, _, _ := parseStructuredData(f.SD)
+	for _, e := range added {
+		if e.ID == "origin" {
+			for _, p := range e.Params {
+				if p.Name == "ip" {
+					doc.OriginIP = p.Value
+				}
+			}
+			continue
+		}
+
+		if doc.Metadata == nil {
+			doc.Metadata = make(map[string]string)
+		}
+		for _, p := range e.Params {
+			if p.Name != "fields" {
+				doc.Metadata[p.Name] = p.Value
+				continue
+			}
+			for _, kv := range strings.Split(p.Value, ",") {
+				if parts := strings.SplitN(kv, "=", 2); len(parts) == 2 {
+					doc.Metadata[parts[0]] = parts[1]
+				}
+			}
+		}
+	}
+
+	msg := f.Msg
+	if elements, rest, err := parseStructuredData(msg); err == nil {
+		doc.StructuredData = sdMap(elements)
+		msg = rest
+	}
+	msg = bytes.TrimPrefix(msg, []byte(" "))
+	doc.Message = string(bytes.TrimSuffix(msg, []byte("\n")))
+
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(&doc)
+}
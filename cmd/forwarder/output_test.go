@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func configWithOutput(t *testing.T, format string, framing string) *IssConfig {
+	config := getConfig()
+	encoder, err := newOutputEncoder(format, framing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.OutputEncoder = encoder
+	return config
+}
+
+func TestFixNonTransparentFraming(t *testing.T) {
+	assert := assert.New(t)
+	config := configWithOutput(t, outputFormatRFC5424, outputFramingNonTransparent)
+
+	var output = [][]byte{
+		[]byte("<13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [origin ip=\"1.2.3.4\"] hi\n<13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [origin ip=\"1.2.3.4\"] hello\n"),
+		[]byte("<13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [origin ip=\"1.2.3.4\"] [meta sequenceId=\"hello\"][foo bar=\"baz\"] hello\n"),
+		[]byte("<13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [origin ip=\"1.2.3.4\"] hello\n"),
+		[]byte("<13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [origin ip=\"1.2.3.4\"]\n"),
+		[]byte("<13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [origin ip=\"1.2.3.4\"] [60607e20-f12d-483e-aa89-ffaf954e7527]\n"),
+	}
+
+	for x, in := range input {
+		r, err := fix(simpleHttpRequest(), bytes.NewReader(in), "1.2.3.4", "", "", nil, config)
+		assert.NoError(err)
+		assert.Equal(string(output[x]), string(r.bytes))
+	}
+}
+
+func TestFixNonTransparentFramingEscapesNewlines(t *testing.T) {
+	assert := assert.New(t)
+	config := configWithOutput(t, outputFormatRFC5424, outputFramingNonTransparent)
+
+	in := []byte("87 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - - panic: oops\n\tat main.go:1\n")
+	r, err := fix(simpleHttpRequest(), bytes.NewReader(in), "1.2.3.4", "", "", nil, config)
+	assert.NoError(err)
+	assert.Equal("<13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [origin ip=\"1.2.3.4\"] panic: oops#012\tat main.go:1\n", string(r.bytes))
+	assert.Equal(1, bytes.Count(r.bytes, []byte("\n")))
+}
+
+func TestFixRFC3164(t *testing.T) {
+	assert := assert.New(t)
+
+	in := []byte("64 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - - hi\n61 <190>1 2013-06-07T03:07:49.468822-04:00 host app - - - hello\n")
+
+	config := configWithOutput(t, outputFormatRFC3164, outputFramingNonTransparent)
+	r, err := fix(simpleHttpRequest(), bytes.NewReader(in), "1.2.3.4", "", "", nil, config)
+	assert.NoError(err)
+	assert.Equal("<13>Jun  7 13:17:49 host heroku[web.7]: [origin ip=\"1.2.3.4\"] hi\n<190>Jun  7 07:07:49 host app: [origin ip=\"1.2.3.4\"] hello\n", string(r.bytes))
+
+	config = configWithOutput(t, outputFormatRFC3164, outputFramingOctetCounting)
+	r, err = fix(simpleHttpRequest(), bytes.NewReader(in), "", "", "", nil, config)
+	assert.NoError(err)
+	assert.Equal("43 <13>Jun  7 13:17:49 host heroku[web.7]: hi\n37 <190>Jun  7 07:07:49 host app: hello\n", string(r.bytes))
+}
+
+func TestNewOutputEncoder(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := newOutputEncoder("rfc9999", outputFramingOctetCounting)
+	assert.Error(err)
+
+	_, err = newOutputEncoder(outputFormatRFC5424, "carrier-pigeon")
+	assert.Error(err)
+
+	e, err := newOutputEncoder(outputFormatRFC5424, outputFramingOctetCounting)
+	assert.NoError(err)
+	assert.NotNil(e.Format)
+	assert.NotNil(e.Frame)
+}
+
+func TestFixJSON(t *testing.T) {
+	assert := assert.New(t)
+	config := configWithOutput(t, outputFormatJSON, outputFramingOctetCounting)
+
+	var output = [][]byte{
+		[]byte(`{"priority":13,"facility":1,"severity":5,"timestamp":"2013-06-07T13:17:49.468822+00:00","hostname":"host","app_name":"heroku","procid":"web.7","origin_ip":"1.2.3.4","message":"hi"}` + "\n" +
+			`{"priority":13,"facility":1,"severity":5,"timestamp":"2013-06-07T13:17:49.468822+00:00","hostname":"host","app_name":"heroku","procid":"web.7","origin_ip":"1.2.3.4","message":"hello"}` + "\n"),
+		[]byte(`{"priority":13,"facility":1,"severity":5,"timestamp":"2013-06-07T13:17:49.468822+00:00","hostname":"host","app_name":"heroku","procid":"web.7","structured_data":{"foo":{"bar":"baz"},"meta":{"sequenceId":"hello"}},"origin_ip":"1.2.3.4","message":"hello"}` + "\n"),
+		[]byte(`{"priority":13,"facility":1,"severity":5,"timestamp":"2013-06-07T13:17:49.468822+00:00","hostname":"host","app_name":"heroku","procid":"web.7","origin_ip":"1.2.3.4","message":"hello"}` + "\n"),
+		[]byte(`{"priority":13,"facility":1,"severity":5,"timestamp":"2013-06-07T13:17:49.468822+00:00","hostname":"host","app_name":"heroku","procid":"web.7","origin_ip":"1.2.3.4","message":""}` + "\n"),
+		[]byte(`{"priority":13,"facility":1,"severity":5,"timestamp":"2013-06-07T13:17:49.468822+00:00","hostname":"host","app_name":"heroku","procid":"web.7","structured_data":{"60607e20-f12d-483e-aa89-ffaf954e7527":{}},"origin_ip":"1.2.3.4","message":""}` + "\n"),
+	}
+
+	for x, in := range input {
+		r, err := fix(simpleHttpRequest(), bytes.NewReader(in), "1.2.3.4", "", "", nil, config)
+		assert.NoError(err)
+		assert.Equal(string(output[x]), string(r.bytes))
+	}
+}
+
+func TestFixJSONWithMetadata(t *testing.T) {
+	assert := assert.New(t)
+	config := configWithOutput(t, outputFormatJSON, outputFramingNonTransparent)
+	config.QueryParams = []string{"index", "source", "sourcetype"}
+	config.QueryFieldParams = []string{"custom1", "custom2"}
+
+	in := []byte("87 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - - panic: oops\n\tat main.go:1\n")
+	cred := credential{Stage: "previous", Name: "cred", Deprecated: true}
+	r, err := fix(httpRequestWithFieldParams(), bytes.NewReader(in), "1.2.3.4", "", "metadata@123", &cred, config)
+	assert.NoError(err)
+	assert.Equal(`{"priority":13,"facility":1,"severity":5,"timestamp":"2013-06-07T13:17:49.468822+00:00","hostname":"host","app_name":"heroku","procid":"web.7","origin_ip":"1.2.3.4","metadata":{"credential_deprecated":"true","credential_name":"cred","custom1":"cq1","custom2":"cq2","index":"i","source":"s","sourcetype":"st"},"message":"panic: oops\n\tat main.go:1"}`+"\n", string(r.bytes))
+}
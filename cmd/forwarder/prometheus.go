@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/heroku/go-metrics"
+)
+
+// prometheusQuantiles are reported for timers and histograms, matching those
+// sent to Librato.
+var prometheusQuantiles = []float64{0.50, 0.95, 0.99}
+
+// prometheusRule maps metric names matching Pattern to the family Name, with
+// the submatches as the values of Labels.
+type prometheusRule struct {
+	Pattern *regexp.Regexp
+	Name    string
+	Labels  []string
+}
+
+// prometheusRules are tried in order. Names that don't match any of them are
+// exported unlabelled, with every character Prometheus doesn't allow in a
+// metric name replaced by an underscore.
+var prometheusRules = []prometheusRule{
+	{regexp.MustCompile(`^log-iss\.forwarder\.(\d+)\.dest\.(\d+)\.(.+)\.g$`), "log_iss_forwarder_dest_$3", []string{"forwarder", "dest"}},
+	{regexp.MustCompile(`^log-iss\.forwarder\.(\d+)\.(.+)\.g$`), "log_iss_forwarder_$2", []string{"forwarder"}},
+	{regexp.MustCompile(`^log-iss\.route\.([^.]+)\.(spool|async)\.(.+)\.g$`), "log_iss_${2}_$3", []string{"route"}},
+	{regexp.MustCompile(`^log-iss\.auth\.(.+)\.([^.]+)\.successes\.g$`), "log_iss_auth_user_successes", []string{"user", "stage"}},
+	{regexp.MustCompile(`^log-iss\.auth\.scheme\.([^.]+)\.failures\.g$`), "log_iss_auth_scheme_failures", []string{"scheme"}},
+	{regexp.MustCompile(`^log-iss\.auth\.(.+)\.failures\.g$`), "log_iss_auth_user_failures", []string{"user"}},
+	{regexp.MustCompile(`^log-iss\.auth\.(.+)\.([^.]+)\.expired\.g$`), "log_iss_auth_user_expired", []string{"user", "stage"}},
+	{regexp.MustCompile(`^log-iss\.auth\.(.+)\.([^.]+)\.not_yet_valid\.g$`), "log_iss_auth_user_not_yet_valid", []string{"user", "stage"}},
+	{regexp.MustCompile(`^log-iss\.auth\.user\.(.+)\.g$`), "log_iss_auth_user_requests", []string{"user"}},
+	{regexp.MustCompile(`^log-iss\.input\.([^.]+)\.(.+)\.g$`), "log_iss_input_$2", []string{"format"}},
+	{regexp.MustCompile(`^log-iss\.syslog\.([^.]+)\.(.+)\.g$`), "log_iss_syslog_$2", []string{"proto"}},
+	{regexp.MustCompile(`^log-iss\.redact\.([^.]+)\.redactions\.g$`), "log_iss_redact_redactions", []string{"pattern"}},
+	{regexp.MustCompile(`^log-iss\.rules\.([^.]+)\.hits\.g$`), "log_iss_rules_hits", []string{"rule"}},
+	{regexp.MustCompile(`^log-iss\.validation\.violations\.([^.]+)\.g$`), "log_iss_validation_violations", []string{"kind"}},
+	{regexp.MustCompile(`^log-iss\.sample\.([^.]+)\.(.+)\.sampled\.g$`), "log_iss_sample_sampled", []string{"kind", "key"}},
+	{regexp.MustCompile(`^log-iss\.ratelimit\.([^.]+)\.(.+)\.throttled\.([^.]+)\.g$`), "log_iss_ratelimit_throttled_$3", []string{"kind", "key"}},
+}
+
+var prometheusInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// prometheusName maps a dotted metric name to a Prometheus family name and
+// labels.
+func prometheusName(name string) (string, []string, []string) {
+	for _, rule := range prometheusRules {
+		m := rule.Pattern.FindStringSubmatchIndex(name)
+		if m == nil {
+			continue
+		}
+
+		family := string(rule.Pattern.ExpandString(nil, rule.Name, name, m))
+		values := make([]string, len(rule.Labels))
+		for i := range rule.Labels {
+			values[i] = name[m[2*i+2]:m[2*i+3]]
+		}
+		return prometheusInvalidChars.ReplaceAllString(family, "_"), rule.Labels, values
+	}
+
+	return prometheusInvalidChars.ReplaceAllString(strings.TrimSuffix(name, ".g"), "_"), nil, nil
+}
+
+// prometheusFamily collects the samples of one metric family, which the text
+// format requires to be written together.
+type prometheusFamily struct {
+	Type    string
+	Samples []string
+}
+
+// prometheusExporter serves a metrics.Registry in the Prometheus text
+// exposition format.
+type prometheusExporter struct {
+	Registry metrics.Registry
+
+	// Counters are reported as gauges when something else, such as the
+	// Librato reporter, clears them.
+	CountersAreGauges bool
+}
+
+func newPrometheusExporter(config IssConfig) *prometheusExporter {
+	return &prometheusExporter{
+		Registry:          config.MetricsRegistry,
+		CountersAreGauges: config.LibratoOwner != "" && config.LibratoToken != "",
+	}
+}
+
+func (e *prometheusExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	e.Export(w)
+}
+
+// Export writes every metric in the registry, with families sorted by name.
+func (e *prometheusExporter) Export(w io.Writer) error {
+	families := make(map[string]*prometheusFamily)
+	add := func(name string, typ string, sample string) {
+		f, ok := families[name]
+		if !ok {
+			f = &prometheusFamily{Type: typ}
+			families[name] = f
+		}
+		f.Samples = append(f.Samples, sample)
+	}
+
+	counterType := "counter"
+	if e.CountersAreGauges {
+		counterType = "gauge"
+	}
+
+	registered := make(map[string]interface{})
+	e.Registry.Each(func(name string, i interface{}) {
+		registered[name] = i
+	})
+	metricNames := make([]string, 0, len(registered))
+	for name := range registered {
+		metricNames = append(metricNames, name)
+	}
+	sort.Strings(metricNames)
+
+	for _, name := range metricNames {
+		family, labels, values := prometheusName(name)
+
+		switch m := registered[name].(type) {
+		case metrics.Counter:
+			add(family, counterType, prometheusSample(family, labels, values, float64(m.Count())))
+		case metrics.Gauge:
+			add(family, "gauge", prometheusSample(family, labels, values, float64(m.Value())))
+		case metrics.GaugeFloat64:
+			add(family, "gauge", prometheusSample(family, labels, values, m.Value()))
+		case metrics.Meter:
+			add(family, counterType, prometheusSample(family, labels, values, float64(m.Count())))
+		case metrics.Timer:
+			// Timers record nanoseconds, Prometheus expects seconds
+			family += "_seconds"
+			t := m.Snapshot()
+			ps := t.Percentiles(prometheusQuantiles)
+			for i, q := range prometheusQuantiles {
+				add(family, "summary", prometheusQuantile(family, labels, values, q, ps[i]/float64(time.Second)))
+			}
+			add(family, "summary", prometheusSample(family+"_sum", labels, values, float64(t.Sum())/float64(time.Second)))
+			add(family, "summary", prometheusSample(family+"_count", labels, values, float64(t.Count())))
+		case metrics.Histogram:
+			h := m.Snapshot()
+			ps := h.Percentiles(prometheusQuantiles)
+			for i, q := range prometheusQuantiles {
+				add(family, "summary", prometheusQuantile(family, labels, values, q, ps[i]))
+			}
+			add(family, "summary", prometheusSample(family+"_sum", labels, values, float64(h.Sum())))
+			add(family, "summary", prometheusSample(family+"_count", labels, values, float64(h.Count())))
+		}
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		f := families[name]
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", name, f.Type)
+		for _, s := range f.Samples {
+			buf.WriteString(s)
+		}
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// prometheusSample formats a single sample line.
+func prometheusSample(name string, labels []string, values []string, v float64) string {
+	var buf bytes.Buffer
+	buf.WriteString(name)
+	if len(labels) > 0 {
+		buf.WriteString("{")
+		for i, l := range labels {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			buf.WriteString(l)
+			buf.WriteString(`="`)
+			buf.WriteString(prometheusLabelEscaper.Replace(values[i]))
+			buf.WriteString(`"`)
+		}
+		buf.WriteString("}")
+	}
+	buf.WriteString(" ")
+	buf.WriteString(prometheusFloat(v))
+	buf.WriteString("\n")
+	return buf.String()
+}
+
+// prometheusQuantile formats a summary sample for quantile q.
+func prometheusQuantile(name string, labels []string, values []string, q float64, v float64) string {
+	labels = append(append([]string(nil), labels...), "quantile")
+	values = append(append([]string(nil), values...), prometheusFloat(q))
+	return prometheusSample(name, labels, values, v)
+}
+
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func prometheusFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
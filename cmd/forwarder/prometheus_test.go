@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/heroku/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrometheusName(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, tc := range []struct {
+		name   string
+		family string
+		labels []string
+		values []string
+	}{
+		{"log-iss.http.logs.errors.g", "log_iss_http_logs_errors", nil, nil},
+		{"log-iss.forwarder.tls.reloads.g", "log_iss_forwarder_tls_reloads", nil, nil},
+		{"log-iss.forwarder.3.write.bytes.g", "log_iss_forwarder_write_bytes", []string{"forwarder"}, []string{"3"}},
+		{"log-iss.forwarder.1.dest.0.connect.errors.g", "log_iss_forwarder_dest_connect_errors", []string{"forwarder", "dest"}, []string{"1", "0"}},
+		{"log-iss.spool.depth.bytes.g", "log_iss_spool_depth_bytes", nil, nil},
+		{"log-iss.route.system.spool.depth.bytes.g", "log_iss_spool_depth_bytes", []string{"route"}, []string{"system"}},
+		{"log-iss.route.system.async.accepted.g", "log_iss_async_accepted", []string{"route"}, []string{"system"}},
+		{"log-iss.auth.user.dan.g", "log_iss_auth_user_requests", []string{"user"}, []string{"dan"}},
+		{"log-iss.auth.dan.previous.successes.g", "log_iss_auth_user_successes", []string{"user", "stage"}, []string{"dan", "previous"}},
+		{"log-iss.auth.dan.failures.g", "log_iss_auth_user_failures", []string{"user"}, []string{"dan"}},
+		{"log-iss.auth.scheme.hmac-sha256.failures.g", "log_iss_auth_scheme_failures", []string{"scheme"}, []string{"hmac-sha256"}},
+		{"log-iss.auth.dan.previous.expired.g", "log_iss_auth_user_expired", []string{"user", "stage"}, []string{"dan", "previous"}},
+		{"log-iss.auth.successes.g", "log_iss_auth_successes", nil, nil},
+		{"log-iss.jwks.refresh.failures.g", "log_iss_jwks_refresh_failures", nil, nil},
+		{"log-iss.input.ndjson.received.g", "log_iss_input_received", []string{"format"}, []string{"ndjson"}},
+		{"log-iss.syslog.udp.logs.received.g", "log_iss_syslog_logs_received", []string{"proto"}, []string{"udp"}},
+		{"log-iss.redact.pan.redactions.g", "log_iss_redact_redactions", []string{"pattern"}, []string{"pan"}},
+		{"log-iss.rules.drop-router.hits.g", "log_iss_rules_hits", []string{"rule"}, []string{"drop-router"}},
+		{"log-iss.validation.violations.timestamp.g", "log_iss_validation_violations", []string{"kind"}, []string{"timestamp"}},
+		{"log-iss.validation.dropped.g", "log_iss_validation_dropped", nil, nil},
+		{"log-iss.sample.drain.d.1234.sampled.g", "log_iss_sample_sampled", []string{"kind", "key"}, []string{"drain", "d.1234"}},
+		{"log-iss.ratelimit.drain.d.1234.throttled.requests.g", "log_iss_ratelimit_throttled_requests", []string{"kind", "key"}, []string{"drain", "d.1234"}},
+	} {
+		family, labels, values := prometheusName(tc.name)
+		assert.Equal(tc.family, family, tc.name)
+		assert.Equal(tc.labels, labels, tc.name)
+		assert.Equal(tc.values, values, tc.name)
+	}
+}
+
+func TestPrometheusExporter(t *testing.T) {
+	assert := assert.New(t)
+	registry := metrics.NewRegistry()
+	e := &prometheusExporter{Registry: registry}
+
+	metrics.GetOrRegisterCounter("log-iss.forwarder.1.write.bytes.g", registry).Inc(20)
+	metrics.GetOrRegisterCounter("log-iss.forwarder.0.write.bytes.g", registry).Inc(10)
+	metrics.GetOrRegisterCounter(`log-iss.auth.user.a"b.g`, registry).Inc(1)
+	metrics.GetOrRegisterGauge("log-iss.async.depth.g", registry).Update(5)
+	timer := metrics.GetOrRegisterTimer("log-iss.http.logs.g", registry)
+	timer.Update(time.Second)
+	timer.Update(3 * time.Second)
+
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal("text/plain; version=0.0.4; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(`# TYPE log_iss_async_depth gauge
+log_iss_async_depth 5
+# TYPE log_iss_auth_user_requests counter
+log_iss_auth_user_requests{user="a\"b"} 1
+# TYPE log_iss_forwarder_write_bytes counter
+log_iss_forwarder_write_bytes{forwarder="0"} 10
+log_iss_forwarder_write_bytes{forwarder="1"} 20
+# TYPE log_iss_http_logs_seconds summary
+log_iss_http_logs_seconds{quantile="0.5"} 2
+log_iss_http_logs_seconds{quantile="0.95"} 3
+log_iss_http_logs_seconds{quantile="0.99"} 3
+log_iss_http_logs_seconds_sum 4
+log_iss_http_logs_seconds_count 2
+`, w.Body.String())
+
+	e.CountersAreGauges = true
+	w = httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(w.Body.String(), "# TYPE log_iss_forwarder_write_bytes gauge\n")
+}
+
+// authenticatorFunc adapts a function to the authenticator interface.
+type authenticatorFunc func(*http.Request) *credential
+
+func (f authenticatorFunc) Authenticate(r *http.Request) *credential {
+	return f(r)
+}
+
+func TestMetricsRequireAuthentication(t *testing.T) {
+	assert := assert.New(t)
+	config := getConfig()
+	config.MetricsRegistry = metrics.NewRegistry()
+	auth := authenticatorFunc(func(r *http.Request) *credential {
+		if user, _, _ := r.BasicAuth(); user == "ops" {
+			return &credential{Name: user}
+		}
+		return nil
+	})
+	s := newHTTPServer(*config, auth, fix, &captureDeliverer{})
+	h := s.authenticated(newPrometheusExporter(*config))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(http.StatusUnauthorized, w.Code)
+	assert.NotContains(w.Body.String(), "# TYPE")
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/metrics", nil)
+	r.SetBasicAuth("ops", "secret")
+	h.ServeHTTP(w, r)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), "# TYPE log_iss_auth_errors counter\nlog_iss_auth_errors 1\n")
+}
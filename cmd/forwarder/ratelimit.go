@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/heroku/go-metrics"
+)
+
+// Kinds of rate limit key, as used in RATE_LIMITS
+const (
+	rateLimitUser  = "user"
+	rateLimitStage = "stage"
+	rateLimitDrain = "drain"
+
+	rateLimitDefault = "*" // key matching anything without a limit of its own
+)
+
+// bucketIdleTimeout is how long a bucket is kept around unused before it's
+// forgotten.
+const bucketIdleTimeout = 10 * time.Minute
+
+// rateLimit is a token bucket refilled at Rate logs per second, holding up
+// to Burst logs. A zero Rate means unlimited.
+type rateLimit struct {
+	Rate  float64
+	Burst float64
+}
+
+// parseRateLimit parses "RATE" or "RATE/BURST". Burst defaults to one
+// second's worth of logs.
+func parseRateLimit(s string) (rateLimit, error) {
+	var l rateLimit
+	parts := strings.SplitN(s, "/", 2)
+
+	rate, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || rate < 0 {
+		return l, fmt.Errorf("Invalid rate limit: %s", s)
+	}
+	l.Rate, l.Burst = rate, math.Max(rate, 1)
+
+	if len(parts) == 2 {
+		burst, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || burst < 1 {
+			return l, fmt.Errorf("Invalid rate limit burst: %s", s)
+		}
+		l.Burst = burst
+	}
+	return l, nil
+}
+
+// rateLimitKey identifies a bucket, eg. {"drain", "d.1234"}
+type rateLimitKey struct {
+	Kind string
+	Key  string
+}
+
+func (k rateLimitKey) String() string {
+	return k.Kind + "." + k.Key
+}
+
+type tokenBucket struct {
+	rateLimit
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.Burst, b.tokens+now.Sub(b.last).Seconds()*b.Rate)
+	b.last = now
+}
+
+// rateLimitError is returned for requests over a limit.
+type rateLimitError struct {
+	Key        rateLimitKey
+	RetryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("Rate limit exceeded for %s %s", e.Key.Kind, e.Key.Key)
+}
+
+// RetryAfterSeconds is the value for the Retry-After header.
+func (e *rateLimitError) RetryAfterSeconds() int {
+	return int(math.Max(1, math.Ceil(e.RetryAfter.Seconds())))
+}
+
+type rateLimitMetrics struct {
+	requests metrics.Counter // counts throttled requests
+}
+
+// rateLimiter applies token bucket limits to log submissions, keyed by auth
+// user, credential stage and drain token. It is safe for concurrent use.
+type rateLimiter struct {
+	sync.Mutex
+	limits    map[rateLimitKey]rateLimit
+	buckets   map[rateLimitKey]*tokenBucket
+	metrics   map[rateLimitKey]*rateLimitMetrics
+	registry  metrics.Registry
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// newRateLimiter creates a rateLimiter from a list of "KIND:KEY=LIMIT"
+// entries, where KEY may be "*" to set the default for that kind.
+func newRateLimiter(entries []string, registry metrics.Registry) (*rateLimiter, error) {
+	rl := &rateLimiter{
+		limits:   make(map[rateLimitKey]rateLimit),
+		buckets:  make(map[rateLimitKey]*tokenBucket),
+		metrics:  make(map[rateLimitKey]*rateLimitMetrics),
+		registry: registry,
+		now:      time.Now,
+	}
+
+	for _, e := range entries {
+		parts := strings.SplitN(e, "=", 2)
+		kk := strings.SplitN(parts[0], ":", 2)
+		if len(parts) != 2 || len(kk) != 2 || kk[1] == "" {
+			return nil, fmt.Errorf("Invalid rate limit entry: %s", e)
+		}
+		switch kk[0] {
+		case rateLimitUser, rateLimitStage, rateLimitDrain:
+		default:
+			return nil, fmt.Errorf("Unknown rate limit kind: %s", kk[0])
+		}
+
+		l, err := parseRateLimit(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		rl.limits[rateLimitKey{kk[0], kk[1]}] = l
+	}
+
+	return rl, nil
+}
+
+// limit returns the configured limit for k, falling back to the default for
+// its kind.
+func (rl *rateLimiter) limit(k rateLimitKey) rateLimit {
+	if l, ok := rl.limits[k]; ok {
+		return l
+	}
+	return rl.limits[rateLimitKey{k.Kind, rateLimitDefault}]
+}
+
+// Allow returns a *rateLimitError naming the first of keys whose bucket is
+// empty, without taking anything from any of them, so that a request can be
+// refused before its logs are read. overrides take precedence over
+// configured limits, and keys with an empty Key are skipped. A nil
+// rateLimiter allows everything.
+func (rl *rateLimiter) Allow(keys []rateLimitKey, overrides map[rateLimitKey]rateLimit) error {
+	if rl == nil {
+		return nil
+	}
+	rl.Lock()
+	defer rl.Unlock()
+
+	var err error
+	rl.each(keys, overrides, func(k rateLimitKey, b *tokenBucket) bool {
+		if b.tokens >= 1 {
+			return true
+		}
+		rl.metricsFor(k).requests.Inc(1)
+		wait := time.Duration((1 - b.tokens) / b.Rate * float64(time.Second))
+		err = &rateLimitError{Key: k, RetryAfter: wait}
+		return false
+	})
+	return err
+}
+
+// Charge takes n logs' worth of tokens from the bucket for every key, once a
+// request allowed by Allow has been read. Buckets may be overdrawn, and
+// refuse requests until they've refilled. Batches bigger than a bucket are
+// only charged what it holds when full, rather than keeping it empty for
+// longer.
+func (rl *rateLimiter) Charge(keys []rateLimitKey, overrides map[rateLimitKey]rateLimit, n int64) {
+	if rl == nil {
+		return
+	}
+	rl.Lock()
+	defer rl.Unlock()
+
+	rl.each(keys, overrides, func(k rateLimitKey, b *tokenBucket) bool {
+		b.tokens -= math.Min(float64(n), b.Burst)
+		return true
+	})
+}
+
+// each calls f with the bucket, refilled until now, of each of keys that's
+// limited, until f returns false.
+func (rl *rateLimiter) each(keys []rateLimitKey, overrides map[rateLimitKey]rateLimit, f func(rateLimitKey, *tokenBucket) bool) {
+	now := rl.now()
+	rl.sweep(now)
+
+	for _, k := range keys {
+		if k.Key == "" {
+			continue
+		}
+
+		l, ok := overrides[k]
+		if !ok {
+			l = rl.limit(k)
+		}
+		if l.Rate == 0 {
+			continue
+		}
+
+		b, ok := rl.buckets[k]
+		if !ok {
+			b = &tokenBucket{rateLimit: l, tokens: l.Burst, last: now}
+			rl.buckets[k] = b
+		}
+		b.rateLimit = l
+		b.refill(now)
+		if !f(k, b) {
+			return
+		}
+	}
+}
+
+func (rl *rateLimiter) metricsFor(k rateLimitKey) *rateLimitMetrics {
+	m, ok := rl.metrics[k]
+	if !ok {
+		m = &rateLimitMetrics{
+			requests: metrics.GetOrRegisterCounter(rateLimitMetricPrefix(k)+".requests.g", rl.registry),
+		}
+		rl.metrics[k] = m
+	}
+	return m
+}
+
+func rateLimitMetricPrefix(k rateLimitKey) string {
+	return "log-iss.ratelimit." + k.String() + ".throttled"
+}
+
+// sweep forgets buckets that have gone unused, along with their metrics, so
+// that the number of drain tokens seen doesn't grow them or the registry
+// forever. By then all but the slowest buckets have refilled anyway.
+func (rl *rateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < bucketIdleTimeout {
+		return
+	}
+	rl.lastSweep = now
+
+	for k, b := range rl.buckets {
+		if now.Sub(b.last) >= bucketIdleTimeout {
+			delete(rl.buckets, k)
+			if _, ok := rl.metrics[k]; ok {
+				rl.registry.Unregister(rateLimitMetricPrefix(k) + ".requests.g")
+				delete(rl.metrics, k)
+			}
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/heroku/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRateLimiter(t *testing.T, entries ...string) (*rateLimiter, *fakeClock) {
+	rl, err := newRateLimiter(entries, metrics.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &fakeClock{t: time.Unix(1500000000, 0)}
+	rl.now = clock.Now
+	return rl, clock
+}
+
+func TestParseRateLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	l, err := parseRateLimit("100")
+	assert.NoError(err)
+	assert.Equal(rateLimit{Rate: 100, Burst: 100}, l)
+
+	l, err = parseRateLimit("0.5/10")
+	assert.NoError(err)
+	assert.Equal(rateLimit{Rate: 0.5, Burst: 10}, l)
+
+	l, err = parseRateLimit("0")
+	assert.NoError(err)
+	assert.Equal(float64(0), l.Rate)
+
+	for _, s := range []string{"", "fast", "-1", "10/0", "10/many"} {
+		_, err = parseRateLimit(s)
+		assert.Error(err, s)
+	}
+}
+
+func TestNewRateLimiterInvalid(t *testing.T) {
+	for _, e := range []string{"user", "user=10", "app:foo=10", "user:=10", "user:foo=fast"} {
+		_, err := newRateLimiter([]string{e}, metrics.NewRegistry())
+		assert.Error(t, err, e)
+	}
+}
+
+func TestRateLimiterTokenBucket(t *testing.T) {
+	assert := assert.New(t)
+	rl, clock := newTestRateLimiter(t, "drain:*=10/20")
+	keys := []rateLimitKey{{rateLimitDrain, "d.1"}}
+
+	assert.NoError(rl.Allow(keys, nil))
+	rl.Charge(keys, nil, 15)
+	assert.NoError(rl.Allow(keys, nil))
+	rl.Charge(keys, nil, 10)
+	err := rl.Allow(keys, nil)
+	if assert.IsType(&rateLimitError{}, err) {
+		assert.Equal(keys[0], err.(*rateLimitError).Key)
+		assert.Equal(600*time.Millisecond, err.(*rateLimitError).RetryAfter)
+		assert.Equal(1, err.(*rateLimitError).RetryAfterSeconds())
+	}
+
+	// Other drain tokens have buckets of their own
+	assert.NoError(rl.Allow([]rateLimitKey{{rateLimitDrain, "d.2"}}, nil))
+
+	clock.Advance(time.Second)
+	assert.NoError(rl.Allow(keys, nil))
+
+	// Batches bigger than the bucket are charged what it holds when full
+	clock.Advance(2 * time.Second)
+	rl.Charge(keys, nil, 100)
+	assert.Equal(float64(0), rl.buckets[keys[0]].tokens)
+	assert.Error(rl.Allow(keys, nil))
+
+	registry := rl.registry
+	assert.Equal(int64(2), metrics.GetOrRegisterCounter("log-iss.ratelimit.drain.d.1.throttled.requests.g", registry).Count())
+}
+
+func TestRateLimiterAnyEmptyBucket(t *testing.T) {
+	assert := assert.New(t)
+	rl, _ := newTestRateLimiter(t, "user:*=100", "stage:previous=5")
+	keys := []rateLimitKey{{rateLimitUser, "user"}, {rateLimitStage, "previous"}}
+
+	assert.NoError(rl.Allow(keys, nil))
+	rl.Charge(keys, nil, 5)
+	err := rl.Allow(keys, nil)
+	if assert.Error(err) {
+		assert.Equal(rateLimitKey{rateLimitStage, "previous"}, err.(*rateLimitError).Key)
+	}
+
+	// Nothing is taken for the throttled request
+	assert.Equal(float64(95), rl.buckets[keys[0]].tokens)
+}
+
+func TestRateLimiterOverridesAndExemptions(t *testing.T) {
+	assert := assert.New(t)
+	rl, _ := newTestRateLimiter(t, "user:*=1", "user:system=0")
+
+	for _, k := range []rateLimitKey{{rateLimitUser, "system"}, {rateLimitDrain, "d.1"}, {rateLimitUser, ""}} {
+		rl.Charge([]rateLimitKey{k}, nil, 1000)
+		assert.NoError(rl.Allow([]rateLimitKey{k}, nil), k.String())
+	}
+
+	key := rateLimitKey{rateLimitUser, "user"}
+	overrides := map[rateLimitKey]rateLimit{key: {Rate: 100, Burst: 100}}
+	rl.Charge([]rateLimitKey{key}, overrides, 50)
+	assert.NoError(rl.Allow([]rateLimitKey{key}, overrides))
+	rl.Charge([]rateLimitKey{key}, overrides, 60)
+	assert.Error(rl.Allow([]rateLimitKey{key}, overrides))
+}
+
+func TestRateLimiterSweepsIdleBuckets(t *testing.T) {
+	rl, clock := newTestRateLimiter(t, "drain:*=10")
+
+	assert.NoError(t, rl.Allow([]rateLimitKey{{rateLimitDrain, "d.1"}}, nil))
+	clock.Advance(bucketIdleTimeout)
+	assert.NoError(t, rl.Allow([]rateLimitKey{{rateLimitDrain, "d.2"}}, nil))
+	assert.Len(t, rl.buckets, 1)
+}
+
+func TestRateLimiterSweepsIdleMetrics(t *testing.T) {
+	rl, clock := newTestRateLimiter(t, "drain:*=1")
+	key := rateLimitKey{rateLimitDrain, "d.1"}
+
+	rl.Charge([]rateLimitKey{key}, nil, 1)
+	assert.Error(t, rl.Allow([]rateLimitKey{key}, nil))
+	assert.NotNil(t, rl.registry.Get("log-iss.ratelimit.drain.d.1.throttled.requests.g"))
+
+	clock.Advance(bucketIdleTimeout)
+	assert.NoError(t, rl.Allow([]rateLimitKey{{rateLimitDrain, "d.2"}}, nil))
+	assert.Nil(t, rl.registry.Get("log-iss.ratelimit.drain.d.1.throttled.requests.g"))
+	assert.Empty(t, rl.metrics)
+}
+
+func TestHTTPProcessRateLimited(t *testing.T) {
+	assert := assert.New(t)
+	config := getConfig()
+	rl, _ := newTestRateLimiter(t, "drain:*=1")
+	config.RateLimiter = rl
+	s := newHTTPServer(*config, nil, fix, &captureDeliverer{})
+
+	in := []byte("64 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - - hi\n")
+	err, status := s.process(simpleHttpRequest(), bytes.NewReader(in), "1.2.3.4", "", "d.1", "", nil)
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, status)
+
+	// Throttled requests aren't read
+	body := bytes.NewReader(in)
+	err, status = s.process(simpleHttpRequest(), body, "1.2.3.4", "", "d.1", "", nil)
+	assert.IsType(&rateLimitError{}, err)
+	assert.Equal(http.StatusTooManyRequests, status)
+	assert.Equal(len(in), body.Len())
+	assert.Equal(int64(1), s.pLogsReceived.Count())
+
+	req := simpleHttpRequest()
+	req.SetBasicAuth("user", "pass")
+	cred := &credential{Stage: "current", RateLimit: "100"}
+	config.RateLimiter, _ = newTestRateLimiter(t, "user:*=1")
+	s = newHTTPServer(*config, nil, fix, &captureDeliverer{})
+	for i := 0; i < 5; i++ {
+		err, _ = s.process(req, bytes.NewReader(in), "1.2.3.4", "", "", "", cred)
+		assert.NoError(err)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/heroku/go-metrics"
+)
+
+// Redaction actions
+const (
+	redactMask = "mask" // replace the secret with [REDACTED:NAME]
+	redactHash = "hash" // replace the secret with an HMAC of it, so it can still be correlated
+	redactDrop = "drop" // drop the whole log
+)
+
+// redactPattern is a pattern of secret to redact from messages. If Pattern
+// has a group named "secret", only that part of a match is redacted.
+type redactPattern struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+	Action  string `json:"action"`
+
+	re       *regexp.Regexp
+	hint     func(msg []byte) bool // quickly rules out messages that can't match, if set
+	validate func(secret []byte) bool
+	secret   int // index of the secret group, or 0 for the whole match
+	count    metrics.Counter
+}
+
+// builtinRedactPatterns can be enabled by name in REDACT.
+var builtinRedactPatterns = map[string]redactPattern{
+	"pan": {
+		Pattern:  `\b(?:\d[ -]?){12,18}\d\b`,
+		hint:     hasDigitRun(12),
+		validate: luhnValid,
+	},
+	"jwt": {
+		Pattern: `\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`,
+		hint:    containsAny("eyJ"),
+	},
+	"aws_key": {
+		Pattern: `\b(?:AKIA|ASIA)[0-9A-Z]{16}\b|(?i:aws_secret_access_key)["']?\s*[=:]\s*["']?(?P<secret>[A-Za-z0-9/+=]{40})`,
+		hint:    containsAny("AKIA", "ASIA", "aws_secret_access_key", "AWS_SECRET_ACCESS_KEY"),
+	},
+	"email": {
+		Pattern: `\b[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}\b`,
+		hint:    containsAny("@"),
+	},
+	"password": {
+		Pattern: `(?i)\b(?:password|passwd|pwd)=(?P<secret>"[^"]*"|[^\s&,;"]+)`,
+		hint:    containsAny("="),
+	},
+}
+
+func containsAny(subs ...string) func([]byte) bool {
+	return func(msg []byte) bool {
+		for _, s := range subs {
+			if bytes.Contains(msg, []byte(s)) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// hasDigitRun returns a hint that requires n digits in a row, allowing for
+// single separators between them.
+func hasDigitRun(n int) func([]byte) bool {
+	return func(msg []byte) bool {
+		run := 0
+		for i, c := range msg {
+			switch {
+			case c >= '0' && c <= '9':
+				if run++; run >= n {
+					return true
+				}
+			case (c == ' ' || c == '-') && i > 0 && msg[i-1] >= '0' && msg[i-1] <= '9':
+			default:
+				run = 0
+			}
+		}
+		return false
+	}
+}
+
+// luhnValid returns true if the digits in b pass the Luhn check, as card
+// numbers do.
+func luhnValid(b []byte) bool {
+	sum, n := 0, 0
+	for i := len(b) - 1; i >= 0; i-- {
+		c := b[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n >= 13 && sum%10 == 0
+}
+
+// redactor removes secrets from log messages before they are forwarded.
+// It is safe for concurrent use.
+type redactor struct {
+	patterns []*redactPattern
+	hmacKey  []byte
+	dropped  metrics.Counter // counts logs dropped for containing a secret
+}
+
+// newRedactor creates a redactor from the built-in patterns named in
+// entries, as "NAME[:ACTION]", and the custom patterns in a JSON file, if
+// set. Hashing needs hmacKey.
+func newRedactor(entries []string, file string, defaultAction string, hmacKey string, registry metrics.Registry) (*redactor, error) {
+	var patterns []redactPattern
+	for _, e := range entries {
+		parts := strings.SplitN(e, ":", 2)
+		p, ok := builtinRedactPatterns[parts[0]]
+		if !ok {
+			return nil, fmt.Errorf("Unknown redaction pattern: %s", parts[0])
+		}
+		p.Name = parts[0]
+		if len(parts) == 2 {
+			p.Action = parts[1]
+		}
+		patterns = append(patterns, p)
+	}
+
+	if file != "" {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read redaction patterns: %s", err)
+		}
+		var custom []redactPattern
+		if err := json.Unmarshal(b, &custom); err != nil {
+			return nil, fmt.Errorf("Invalid redaction patterns file: %s", err)
+		}
+		patterns = append(patterns, custom...)
+	}
+
+	r := &redactor{
+		hmacKey: []byte(hmacKey),
+		dropped: metrics.GetOrRegisterCounter("log-iss.redact.dropped.g", registry),
+	}
+	names := make(map[string]bool, len(patterns))
+	for i := range patterns {
+		p := patterns[i]
+		if !validRuleName.MatchString(p.Name) || names[p.Name] {
+			return nil, fmt.Errorf("Invalid or duplicate redaction pattern name: %q", p.Name)
+		}
+		names[p.Name] = true
+
+		if p.Action == "" {
+			p.Action = defaultAction
+		}
+		switch p.Action {
+		case redactMask, redactDrop:
+		case redactHash:
+			if hmacKey == "" {
+				return nil, fmt.Errorf("REDACT_HMAC_KEY must be set to hash %s", p.Name)
+			}
+		default:
+			return nil, fmt.Errorf("Unknown redaction action for %s: %s", p.Name, p.Action)
+		}
+
+		re, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid redaction pattern %s: %s", p.Name, err)
+		}
+		p.re = re
+		p.secret = re.SubexpIndex("secret")
+		if p.secret < 0 {
+			p.secret = 0
+		}
+		p.count = metrics.GetOrRegisterCounter(fmt.Sprintf("log-iss.redact.%s.redactions.g", p.Name), registry)
+		r.patterns = append(r.patterns, &p)
+	}
+	return r, nil
+}
+
+// Redact removes secrets from the message of f, returning false if f should
+// be dropped instead. The message is only copied if something is redacted.
+func (r *redactor) Redact(f *syslogFrame) bool {
+	for _, p := range r.patterns {
+		if p.hint != nil && !p.hint(f.Msg) {
+			continue
+		}
+		matches := p.re.FindAllSubmatchIndex(f.Msg, -1)
+		if len(matches) == 0 {
+			continue
+		}
+
+		var out bytes.Buffer
+		last, n := 0, 0
+		for _, m := range matches {
+			start, end := m[2*p.secret], m[2*p.secret+1]
+			if start < 0 {
+				// Another alternative matched, without a secret group
+				start, end = m[0], m[1]
+			}
+			secret := f.Msg[start:end]
+			if p.validate != nil && !p.validate(secret) {
+				continue
+			}
+			n++
+			if p.Action == redactDrop {
+				break
+			}
+			if out.Len() == 0 {
+				out.Grow(len(f.Msg))
+			}
+			out.Write(f.Msg[last:start])
+			r.replacement(&out, p, secret)
+			last = end
+		}
+		if n == 0 {
+			continue
+		}
+
+		p.count.Inc(int64(n))
+		if p.Action == redactDrop {
+			r.dropped.Inc(1)
+			return false
+		}
+		out.Write(f.Msg[last:])
+		f.Msg = out.Bytes()
+	}
+	return true
+}
+
+func (r *redactor) replacement(w *bytes.Buffer, p *redactPattern, secret []byte) {
+	if p.Action == redactHash {
+		mac := hmac.New(sha256.New, r.hmacKey)
+		mac.Write(secret)
+		sum := mac.Sum(nil)
+		w.WriteString("[HMAC:")
+		w.WriteString(p.Name)
+		w.WriteString(":")
+		w.WriteString(hex.EncodeToString(sum[:8]))
+		w.WriteString("]")
+		return
+	}
+	w.WriteString("[REDACTED:")
+	w.WriteString(p.Name)
+	w.WriteString("]")
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/heroku/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// Rule actions
+const (
+	ruleDrop        = "drop"         // discard the log
+	ruleRoute       = "route"        // send the log to a ROUTE_DESTS destination instead of FORWARD_DEST
+	ruleAddSDParam  = "add_sd_param" // add a param to the log's structured data
+	ruleSetSeverity = "set_severity" // replace the severity of the log's PRI
+)
+
+var validRuleName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// ruleConfig is a single rule as written in RULES_FILE.
+type ruleConfig struct {
+	Name        string          `json:"name"`
+	Match       ruleMatchConfig `json:"match"`
+	Action      string          `json:"action"`
+	Destination string          `json:"destination"` // for route
+	SDID        string          `json:"sd_id"`       // for add_sd_param
+	Param       string          `json:"param"`       // for add_sd_param
+	Value       string          `json:"value"`       // for add_sd_param
+	Severity    *int            `json:"severity"`    // for set_severity
+}
+
+// ruleMatchConfig are the conditions of a rule, all of which must hold for it
+// to match. String conditions are regular expressions.
+type ruleMatchConfig struct {
+	Facility   []int             `json:"facility"`
+	Severity   []int             `json:"severity"`
+	Hostname   string            `json:"hostname"`
+	AppName    string            `json:"app_name"`
+	Procid     string            `json:"procid"`
+	Msgid      string            `json:"msgid"`
+	DrainToken string            `json:"drain_token"`
+	AuthUser   string            `json:"auth_user"`
+	Metadata   map[string]string `json:"metadata"` // query param name to pattern
+	Message    string            `json:"message"`
+}
+
+// rule is a compiled ruleConfig.
+type rule struct {
+	ruleConfig
+	facility   map[int]bool
+	severity   map[int]bool
+	hostname   *regexp.Regexp
+	appName    *regexp.Regexp
+	procid     *regexp.Regexp
+	msgid      *regexp.Regexp
+	drainToken *regexp.Regexp
+	authUser   *regexp.Regexp
+	metadata   map[string]*regexp.Regexp
+	message    *regexp.Regexp
+	hits       metrics.Counter
+}
+
+// ruleContext is what rules can match besides the log itself.
+type ruleContext struct {
+	Req        *http.Request
+	DrainToken string
+	AuthUser   string
+}
+
+// ruleSet applies the rules in RULES_FILE to each log, in order. Drop and
+// route end evaluation; other actions apply and carry on to the next rule.
+// Sending it SIGHUP rereads the file. It is safe for concurrent use.
+type ruleSet struct {
+	sync.RWMutex
+	file     string
+	routes   map[string][]string
+	rules    []*rule
+	registry metrics.Registry
+}
+
+func newRuleSet(file string, routes map[string][]string, registry metrics.Registry) (*ruleSet, error) {
+	rs := &ruleSet{file: file, routes: routes, registry: registry}
+	rules, err := rs.load()
+	if err != nil {
+		return nil, err
+	}
+	rs.rules = rules
+	return rs, nil
+}
+
+// load reads and compiles the rules file.
+func (rs *ruleSet) load() ([]*rule, error) {
+	b, err := ioutil.ReadFile(rs.file)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read rules file: %s", err)
+	}
+	return parseRules(b, rs.routes, rs.registry)
+}
+
+// Reload rereads the rules file, keeping the current rules if it's invalid.
+func (rs *ruleSet) Reload() error {
+	rules, err := rs.load()
+	if err != nil {
+		log.WithFields(log.Fields{"ns": "rules", "at": "reload-failure", "message": err.Error()}).Error()
+		return err
+	}
+	rs.Lock()
+	rs.rules = rules
+	rs.Unlock()
+	log.WithFields(log.Fields{"ns": "rules", "at": "reload", "rules": len(rules)}).Info()
+	return nil
+}
+
+// parseRules compiles a JSON array of rules, checking that routes go to one
+// of routes.
+func parseRules(b []byte, routes map[string][]string, registry metrics.Registry) ([]*rule, error) {
+	var configs []ruleConfig
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&configs); err != nil {
+		return nil, fmt.Errorf("Invalid rules file: %s", err)
+	}
+
+	names := make(map[string]bool, len(configs))
+	rules := make([]*rule, 0, len(configs))
+	for i, c := range configs {
+		if !validRuleName.MatchString(c.Name) {
+			return nil, fmt.Errorf("Rule %d: name must be letters, digits, '_' or '-'", i)
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("Rule %s: duplicate name", c.Name)
+		}
+		names[c.Name] = true
+
+		r, err := compileRule(c, routes)
+		if err != nil {
+			return nil, fmt.Errorf("Rule %s: %s", c.Name, err)
+		}
+		r.hits = metrics.GetOrRegisterCounter(fmt.Sprintf("log-iss.rules.%s.hits.g", c.Name), registry)
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func compileRule(c ruleConfig, routes map[string][]string) (*rule, error) {
+	switch c.Action {
+	case ruleDrop:
+	case ruleRoute:
+		if _, ok := routes[c.Destination]; !ok {
+			return nil, fmt.Errorf("unknown destination %q", c.Destination)
+		}
+	case ruleAddSDParam:
+		if !validSDName(c.SDID) || !validSDName(c.Param) {
+			return nil, fmt.Errorf("sd_id and param must be valid SD-NAMEs")
+		}
+	case ruleSetSeverity:
+		if c.Severity == nil || *c.Severity < 0 || *c.Severity > 7 {
+			return nil, fmt.Errorf("severity must be 0 to 7")
+		}
+	default:
+		return nil, fmt.Errorf("unknown action %q", c.Action)
+	}
+
+	r := &rule{ruleConfig: c, facility: intSet(c.Match.Facility), severity: intSet(c.Match.Severity)}
+	for _, p := range []struct {
+		re      **regexp.Regexp
+		pattern string
+	}{
+		{&r.hostname, c.Match.Hostname},
+		{&r.appName, c.Match.AppName},
+		{&r.procid, c.Match.Procid},
+		{&r.msgid, c.Match.Msgid},
+		{&r.drainToken, c.Match.DrainToken},
+		{&r.authUser, c.Match.AuthUser},
+		{&r.message, c.Match.Message},
+	} {
+		if p.pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile(p.pattern)
+		if err != nil {
+			return nil, err
+		}
+		*p.re = re
+	}
+
+	if len(c.Match.Metadata) > 0 {
+		r.metadata = make(map[string]*regexp.Regexp, len(c.Match.Metadata))
+		for k, pattern := range c.Match.Metadata {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, err
+			}
+			r.metadata[k] = re
+		}
+	}
+	return r, nil
+}
+
+func intSet(ints []int) map[int]bool {
+	if len(ints) == 0 {
+		return nil
+	}
+	set := make(map[int]bool, len(ints))
+	for _, i := range ints {
+		set[i] = true
+	}
+	return set
+}
+
+func matchBytes(re *regexp.Regexp, b []byte) bool {
+	return re == nil || re.Match(b)
+}
+
+func matchString(re *regexp.Regexp, s string) bool {
+	return re == nil || re.MatchString(s)
+}
+
+// matches returns true if f, with the given PRI, meets every condition of r.
+func (r *rule) matches(f *syslogFrame, pri int, priOK bool, ctx *ruleContext) bool {
+	if r.facility != nil && (!priOK || !r.facility[pri/8]) {
+		return false
+	}
+	if r.severity != nil && (!priOK || !r.severity[pri%8]) {
+		return false
+	}
+	if !matchBytes(r.hostname, f.Hostname) || !matchBytes(r.appName, f.Appname) ||
+		!matchBytes(r.procid, f.Procid) || !matchBytes(r.msgid, f.Msgid) ||
+		!matchString(r.drainToken, ctx.DrainToken) || !matchString(r.authUser, ctx.AuthUser) ||
+		!matchBytes(r.message, f.Msg) {
+		return false
+	}
+	for k, re := range r.metadata {
+		if ctx.Req == nil || !re.MatchString(ctx.Req.FormValue(k)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Apply runs the rules against f, changing it in place. Returns the
+// destination to route it to, empty for FORWARD_DEST, and false if it should
+// be dropped.
+func (rs *ruleSet) Apply(f *syslogFrame, ctx *ruleContext) (string, bool) {
+	rs.RLock()
+	rules := rs.rules
+	rs.RUnlock()
+
+	pri, version := splitPrivalVersion(f.PrivalVersion)
+	prival, priOK := parsePrival(pri)
+
+	var added []sdElement
+	dest, keep := "", true
+	for _, r := range rules {
+		if !r.matches(f, prival, priOK, ctx) {
+			continue
+		}
+		r.hits.Inc(1)
+
+		switch r.Action {
+		case ruleDrop:
+			keep = false
+		case ruleRoute:
+			dest = r.Destination
+		case ruleAddSDParam:
+			added = addSDParam(added, r.SDID, sdParam{Name: r.Param, Value: r.Value})
+		case ruleSetSeverity:
+			if priOK {
+				prival = prival/8*8 + *r.Severity
+				f.PrivalVersion = append([]byte("<"+strconv.Itoa(prival)+">"), version...)
+			}
+		}
+		if r.Action == ruleDrop || r.Action == ruleRoute {
+			break
+		}
+	}
+
+	if keep && len(added) > 0 {
+		var sd bytes.Buffer
+		sd.Grow(len(f.SD) + 64)
+		sd.Write(f.SD)
+		writeStructuredData(&sd, added)
+		f.SD = sd.Bytes()
+	}
+	return dest, keep
+}
+
+// addSDParam adds p to the element id in elements, adding the element if
+// there isn't one yet.
+func addSDParam(elements []sdElement, id string, p sdParam) []sdElement {
+	for i := range elements {
+		if elements[i].ID == id {
+			elements[i].Params = append(elements[i].Params, p)
+			return elements
+		}
+	}
+	return append(elements, sdElement{ID: id, Params: []sdParam{p}})
+}
+
+// parseRouteDests parses ROUTE_DESTS entries of "NAME=HOST:PORT[,HOST:PORT...]"
+// into the destinations of each route, which are failed over between like
+// those of FORWARD_DEST.
+func parseRouteDests(entries []string) (map[string][]string, error) {
+	routes := make(map[string][]string, len(entries))
+	for _, e := range entries {
+		parts := strings.SplitN(e, "=", 2)
+		if len(parts) != 2 || !validRuleName.MatchString(parts[0]) || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid route destination: %s", e)
+		}
+		if _, ok := routes[parts[0]]; ok {
+			return nil, fmt.Errorf("Duplicate route destination: %s", parts[0])
+		}
+		routes[parts[0]] = strings.Split(parts[1], ",")
+	}
+	return routes, nil
+}
+
+// routedLogs are the logs of a request that rules routed to one destination.
+type routedLogs struct {
+	Body    []byte
+	NumLogs int64
+}
+
+// routeMetricPrefix names the metrics of component, eg. "spool", for route,
+// or for FORWARD_DEST if route is empty.
+func routeMetricPrefix(route string, component string) string {
+	if route == "" {
+		return "log-iss." + component + "."
+	}
+	return "log-iss.route." + route + "." + component + "."
+}
+
+// router delivers the logs that rules routed elsewhere through the delivery
+// chain of their destination, and the rest to Default. Each route has its
+// own forwarders, spool and async queue, as configured for FORWARD_DEST.
+type router struct {
+	Default deliverer
+	Routes  map[string]deliverer
+	chains  map[string]*deliveryChain
+}
+
+// newRouter creates the delivery chain of each route in
+// config.RouteDestinations, numbering their forwarders after those of
+// FORWARD_DEST.
+func newRouter(config IssConfig, def deliverer) (*router, error) {
+	names := make([]string, 0, len(config.RouteDestinations))
+	for name := range config.RouteDestinations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	r := &router{
+		Default: def,
+		Routes:  make(map[string]deliverer, len(names)),
+		chains:  make(map[string]*deliveryChain, len(names)),
+	}
+	for i, name := range names {
+		c := config
+		c.ForwardDests = config.RouteDestinations[name]
+		chain, err := newDeliveryChain(c, name, (i+1)*config.ForwardCount)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create route %s: %s", name, err)
+		}
+		r.Routes[name] = chain
+		r.chains[name] = chain
+	}
+	return r, nil
+}
+
+// forwarders returns the forwarders of each route, by name.
+func (r *router) forwarders() map[string]*forwarderSet {
+	sets := make(map[string]*forwarderSet, len(r.chains))
+	for name, c := range r.chains {
+		sets[name] = c.forwarders
+	}
+	return sets
+}
+
+// Deliver delivers the routed logs of p, then the rest. Delivery isn't
+// atomic: it stops at the first destination to fail, returning its error,
+// without taking back what the others were given. As the sender retries the
+// whole request, the logs of destinations that succeeded may be delivered
+// twice, which is the at-least-once delivery log-iss gives anyway.
+func (r *router) Deliver(p payload) error {
+	for name, body := range p.Routes {
+		rp := NewPayload(p.SourceAddr, p.RequestID, body.Body)
+		rp.NumLogs = body.NumLogs
+		rp.Trace = p.Trace
+		rp.Sent = p.Sent
+		if err := r.Routes[name].Deliver(rp); err != nil {
+			return err
+		}
+	}
+	if len(p.Body) == 0 && len(p.Routes) > 0 {
+		return nil
+	}
+	return r.Default.Deliver(p)
+}
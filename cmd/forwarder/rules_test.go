@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/heroku/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+const testRules = `[
+	{"name": "drop-router", "match": {"app_name": "^heroku$", "procid": "^router$", "message": "status=200"}, "action": "drop"},
+	{"name": "tag-web", "match": {"hostname": "^web-"}, "action": "add_sd_param", "sd_id": "tags@123", "param": "tier", "value": "web \"front\""},
+	{"name": "quiet-staging", "match": {"metadata": {"env": "^staging$"}, "severity": [3]}, "action": "set_severity", "severity": 6},
+	{"name": "route-heroku", "match": {"app_name": "^heroku$"}, "action": "route", "destination": "system"},
+	{"name": "route-shuttle", "match": {"auth_user": "^shuttle$", "drain_token": "^d\\."}, "action": "route", "destination": "apps"}
+]`
+
+var testRoutes = map[string][]string{"system": {"10.0.0.1:601"}, "apps": {"10.0.0.2:601"}}
+
+func newTestRuleSet(t *testing.T, rules string) (*ruleSet, metrics.Registry) {
+	file := filepath.Join(t.TempDir(), "rules.json")
+	if err := ioutil.WriteFile(file, []byte(rules), 0600); err != nil {
+		t.Fatal(err)
+	}
+	registry := metrics.NewRegistry()
+	rs, err := newRuleSet(file, testRoutes, registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rs, registry
+}
+
+func TestRules(t *testing.T) {
+	assert := assert.New(t)
+	rs, registry := newTestRuleSet(t, testRules)
+	config := &IssConfig{Rules: rs}
+
+	body := logplexFrames(
+		"<158>1 2013-06-07T13:17:49Z host heroku router - - at=info status=200\n",
+		"<158>1 2013-06-07T13:17:49Z host heroku router - - at=error status=503\n",
+		"<11>1 2013-06-07T13:17:49Z web-1 app web.1 - - oops\n",
+		"<11>1 2013-06-07T13:17:49Z worker-1 app worker.1 - - oops\n",
+	)
+	req, _ := http.NewRequest("POST", "/logs?env=staging", nil)
+	r, err := fix(req, bytes.NewReader(body), "1.2.3.4", "", "", nil, config)
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.Equal(int64(3), r.numLogs)
+	assert.Equal(int64(1), r.routedLogs)
+	assert.Equal(
+		"103 <14>1 2013-06-07T13:17:49Z web-1 app web.1 - [origin ip=\"1.2.3.4\"][tags@123 tier=\"web \\\"front\\\"\"] oops\n"+
+			"78 <14>1 2013-06-07T13:17:49Z worker-1 app worker.1 - [origin ip=\"1.2.3.4\"] oops\n",
+		string(r.bytes))
+	if assert.Contains(r.routes, "system") {
+		assert.Equal(int64(1), r.routes["system"].NumLogs)
+		assert.Contains(string(r.routes["system"].Body), "status=503")
+	}
+
+	for name, hits := range map[string]int64{"drop-router": 1, "tag-web": 1, "quiet-staging": 2, "route-heroku": 1, "route-shuttle": 0} {
+		assert.Equal(hits, metrics.GetOrRegisterCounter("log-iss.rules."+name+".hits.g", registry).Count(), name)
+	}
+}
+
+func TestRulesMatchAuthUserAndDrainToken(t *testing.T) {
+	assert := assert.New(t)
+	rs, _ := newTestRuleSet(t, testRules)
+	config := &IssConfig{Rules: rs}
+	body := logplexFrames("<13>1 2013-06-07T13:17:49Z host app web.1 - - hi\n")
+
+	req, _ := http.NewRequest("POST", "/logs", nil)
+	req.SetBasicAuth("shuttle", "password")
+	r, _ := fix(req, bytes.NewReader(body), "", "d.1234", "", nil, config)
+	assert.Empty(r.bytes)
+	assert.Contains(r.routes, "apps")
+
+	r, _ = fix(req, bytes.NewReader(body), "", "", "", nil, config)
+	assert.NotEmpty(r.bytes)
+	assert.Nil(r.routes)
+}
+
+func TestParseRulesErrors(t *testing.T) {
+	for name, rules := range map[string]string{
+		"not json":            `{`,
+		"unknown field":       `[{"name": "a", "action": "drop", "match": {"hostnme": "x"}}]`,
+		"bad name":            `[{"name": "a.b", "action": "drop"}]`,
+		"duplicate name":      `[{"name": "a", "action": "drop"}, {"name": "a", "action": "drop"}]`,
+		"unknown action":      `[{"name": "a", "action": "explode"}]`,
+		"unknown destination": `[{"name": "a", "action": "route", "destination": "nowhere"}]`,
+		"bad sd id":           `[{"name": "a", "action": "add_sd_param", "sd_id": "x y", "param": "p"}]`,
+		"missing severity":    `[{"name": "a", "action": "set_severity"}]`,
+		"severity range":      `[{"name": "a", "action": "set_severity", "severity": 8}]`,
+		"bad regexp":          `[{"name": "a", "action": "drop", "match": {"message": "("}}]`,
+	} {
+		_, err := parseRules([]byte(rules), testRoutes, metrics.NewRegistry())
+		assert.Error(t, err, name)
+	}
+}
+
+func TestRuleSetReload(t *testing.T) {
+	assert := assert.New(t)
+	rs, _ := newTestRuleSet(t, `[{"name": "drop-all", "action": "drop"}]`)
+	f := syslogFrame{PrivalVersion: []byte("<13>1"), Msg: []byte("- hi")}
+	_, keep := rs.Apply(&f, &ruleContext{})
+	assert.False(keep)
+
+	ioutil.WriteFile(rs.file, []byte(`[`), 0600)
+	assert.Error(rs.Reload())
+	_, keep = rs.Apply(&f, &ruleContext{})
+	assert.False(keep, "the previous rules are kept")
+
+	ioutil.WriteFile(rs.file, []byte(`[]`), 0600)
+	assert.NoError(rs.Reload())
+	_, keep = rs.Apply(&f, &ruleContext{})
+	assert.True(keep)
+}
+
+func TestParseRouteDests(t *testing.T) {
+	routes, err := parseRouteDests([]string{"system=10.0.0.1:601,10.0.0.3:601", "apps=10.0.0.2:601"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"system": {"10.0.0.1:601", "10.0.0.3:601"}, "apps": {"10.0.0.2:601"}}, routes)
+
+	for _, bad := range [][]string{{"system"}, {"=10.0.0.1:601"}, {"sys.tem=10.0.0.1:601"}, {"a=x", "a=y"}} {
+		_, err := parseRouteDests(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+// recordingDeliverer keeps the bodies of the payloads delivered to it.
+type recordingDeliverer struct {
+	bodies []string
+	err    error
+}
+
+func (d *recordingDeliverer) Deliver(p payload) error {
+	d.bodies = append(d.bodies, string(p.Body))
+	return d.err
+}
+
+func TestRouterChains(t *testing.T) {
+	assert := assert.New(t)
+	config, cleanup := spoolConfig(t)
+	defer cleanup()
+	config.ForwardCount = 1
+	config.ForwardDests = []string{"127.0.0.1:5001"}
+	config.RouteDestinations = map[string][]string{"system": {"127.0.0.1:5002"}}
+
+	def := &recordingDeliverer{}
+	r, err := newRouter(config, def)
+	if !assert.NoError(err) {
+		return
+	}
+	system := r.chains["system"]
+	assert.Equal(1, system.forwarders.States()[0].ID)
+
+	// Routed logs are spooled, under a directory of the route's own
+	p := NewPayload("1.2.3.4", "", nil)
+	p.Routes = map[string]routedLogs{"system": {Body: []byte("routed"), NumLogs: 1}}
+	assert.NoError(r.Deliver(p))
+	assert.Empty(def.bodies)
+	segments, _ := filepath.Glob(filepath.Join(config.SpoolDir, "routes", "system", "*"+spoolSegmentSuffix))
+	assert.Len(segments, 1)
+	assert.Equal(int64(1), metrics.GetOrRegisterCounter("log-iss.route.system.spool.appends.g", config.MetricsRegistry).Count())
+	assert.Equal(int64(0), metrics.GetOrRegisterCounter("log-iss.spool.appends.g", config.MetricsRegistry).Count())
+
+	go system.spool.Run()
+	assert.Equal([]string{"routed"}, drain(t, system.forwarders.Inbox, 1))
+	closeDeliveryChains(time.Second, system)
+	assert.Equal(errSpoolClosed, r.Deliver(p))
+
+	// Or queued, with ASYNC_ACK
+	config.SpoolDir = ""
+	config.AsyncAck = true
+	r, err = newRouter(config, def)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NoError(r.Deliver(p))
+	assert.Len(r.chains["system"].forwarders.Inbox, 1)
+	assert.Equal(int64(1), metrics.GetOrRegisterCounter("log-iss.route.system.async.accepted.g", config.MetricsRegistry).Count())
+}
+
+func TestRouterDeliver(t *testing.T) {
+	assert := assert.New(t)
+	def, apps := &recordingDeliverer{}, &recordingDeliverer{}
+	r := &router{Default: def, Routes: map[string]deliverer{"apps": apps}}
+
+	p := NewPayload("1.2.3.4", "", []byte("default"))
+	p.Routes = map[string]routedLogs{"apps": {Body: []byte("routed"), NumLogs: 1}}
+	assert.NoError(r.Deliver(p))
+	assert.Equal([]string{"default"}, def.bodies)
+	assert.Equal([]string{"routed"}, apps.bodies)
+
+	// Nothing is sent to the default destination when everything was routed
+	p.Body = nil
+	assert.NoError(r.Deliver(p))
+	assert.Len(def.bodies, 1)
+
+	apps.err = errors.New("queue full")
+	assert.Error(r.Deliver(p))
+}
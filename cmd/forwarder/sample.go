@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/heroku/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// Kinds of sampling key, as used in SAMPLE_RATES
+const (
+	sampleDrain = "drain"
+	sampleApp   = "app"
+
+	sampleDefault = "*" // key matching anything without a rate of its own
+)
+
+// sampleIdleTimeout is how long the state kept for a source is kept around
+// unused before it's forgotten, by both sampling and deduplication.
+const sampleIdleTimeout = 10 * time.Minute
+
+// sampleKey identifies a sampling rate or counter, eg. {"drain", "d.1234"}
+type sampleKey struct {
+	Kind string
+	Key  string
+}
+
+func (k sampleKey) String() string {
+	return k.Kind + "." + k.Key
+}
+
+type sampleCounter struct {
+	n    int64
+	last time.Time
+}
+
+// sampler keeps one in every N logs from a drain token or app name, as
+// configured, except for logs of ExemptSeverity or more severe. It is safe
+// for concurrent use.
+type sampler struct {
+	sync.Mutex
+	ExemptSeverity int
+	rates          map[sampleKey]int64
+	counters       map[sampleKey]*sampleCounter
+	sampled        map[sampleKey]metrics.Counter // counts logs dropped, by configured key
+	exempt         metrics.Counter               // counts logs kept for their severity
+	lastSweep      time.Time
+}
+
+// newSampler creates a sampler from a list of "KIND:KEY=N" entries, where
+// KEY may be "*" to set the default for that kind.
+func newSampler(entries []string, exemptSeverity int, registry metrics.Registry) (*sampler, error) {
+	s := &sampler{
+		ExemptSeverity: exemptSeverity,
+		rates:          make(map[sampleKey]int64),
+		counters:       make(map[sampleKey]*sampleCounter),
+		sampled:        make(map[sampleKey]metrics.Counter),
+		exempt:         metrics.GetOrRegisterCounter("log-iss.sample.exempt.g", registry),
+	}
+
+	for _, e := range entries {
+		parts := strings.SplitN(e, "=", 2)
+		kk := strings.SplitN(parts[0], ":", 2)
+		if len(parts) != 2 || len(kk) != 2 || kk[1] == "" {
+			return nil, fmt.Errorf("Invalid sample rate entry: %s", e)
+		}
+		switch kk[0] {
+		case sampleDrain, sampleApp:
+		default:
+			return nil, fmt.Errorf("Unknown sample rate kind: %s", kk[0])
+		}
+
+		n, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("Invalid sample rate: %s", e)
+		}
+		k := sampleKey{kk[0], kk[1]}
+		s.rates[k] = n
+		s.sampled[k] = metrics.GetOrRegisterCounter("log-iss.sample."+k.String()+".sampled.g", registry)
+	}
+
+	return s, nil
+}
+
+// rate returns the rate for a log from drainToken and appName, and the keys
+// its rate and counter are under. A drain token's rate takes precedence
+// over an app name's, and either over the defaults.
+func (s *sampler) rate(drainToken, appName string) (int64, sampleKey, sampleKey) {
+	candidates := []sampleKey{{sampleDrain, drainToken}, {sampleApp, appName}}
+	for _, c := range candidates {
+		if n, ok := s.rates[c]; ok && c.Key != "" {
+			return n, c, c
+		}
+	}
+	for _, c := range candidates {
+		if n, ok := s.rates[sampleKey{c.Kind, sampleDefault}]; ok && c.Key != "" {
+			return n, sampleKey{c.Kind, sampleDefault}, c
+		}
+	}
+	return 1, sampleKey{}, sampleKey{}
+}
+
+// Apply returns whether f, from drainToken, should be kept. The first of
+// every N logs from a source is kept.
+func (s *sampler) Apply(f *syslogFrame, drainToken string, now time.Time) bool {
+	n, configured, k := s.rate(drainToken, nilToEmpty(f.Appname))
+	if n <= 1 {
+		return true
+	}
+	if pri, ok := parsePrival(f.PrivalVersion); ok && pri%8 <= s.ExemptSeverity {
+		s.exempt.Inc(1)
+		return true
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.sweep(now)
+
+	c, ok := s.counters[k]
+	if !ok {
+		c = &sampleCounter{}
+		s.counters[k] = c
+	}
+	c.last = now
+	c.n++
+	if (c.n-1)%n == 0 {
+		return true
+	}
+	s.sampled[configured].Inc(1)
+	return false
+}
+
+// sweep forgets counters that have gone unused, so that the number of
+// sources seen doesn't grow them forever.
+func (s *sampler) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < sampleIdleTimeout {
+		return
+	}
+	s.lastSweep = now
+
+	for k, c := range s.counters {
+		if now.Sub(c.last) >= sampleIdleTimeout {
+			delete(s.counters, k)
+		}
+	}
+}
+
+// dedupKey identifies the source of a log for deduplication.
+type dedupKey struct {
+	Hostname string
+	Appname  string
+	Procid   string
+}
+
+// dedupState is the last log kept from a source, and the duplicates of it
+// suppressed since.
+type dedupState struct {
+	privalVersion []byte
+	msgid         []byte
+	sd            []byte
+	msg           []byte
+	dest          string
+	first         time.Time // when the log was kept
+	last          time.Time // when the source was last seen
+
+	count int64  // duplicates suppressed
+	time  []byte // timestamp of the last duplicate
+
+	version uint64 // of the commit that last changed it
+	run     uint64 // version of the commit that started the run
+}
+
+func (s *dedupState) matches(f *syslogFrame) bool {
+	return bytes.Equal(s.msg, f.Msg) && bytes.Equal(s.privalVersion, f.PrivalVersion) && bytes.Equal(s.msgid, f.Msgid)
+}
+
+// reset makes f, bound for dest, the last log kept. Everything is copied, as
+// the frame's buffers are reused for the next log.
+func (s *dedupState) reset(f *syslogFrame, dest string, now time.Time) {
+	*s = dedupState{
+		privalVersion: append([]byte{}, f.PrivalVersion...),
+		msgid:         append([]byte{}, f.Msgid...),
+		sd:            append([]byte{}, f.SD...),
+		msg:           append([]byte{}, f.Msg...),
+		dest:          dest,
+		first:         now,
+		last:          now,
+	}
+}
+
+// summary returns a log standing in for the duplicates suppressed since the
+// last log kept from the source k.
+func (s *dedupState) summary(k dedupKey) *dedupSummary {
+	msg := fmt.Sprintf("- last message repeated %d times", s.count)
+	if bytes.HasSuffix(s.msg, []byte("\n")) {
+		msg += "\n"
+	}
+	return &dedupSummary{
+		Frame: syslogFrame{
+			PrivalVersion: s.privalVersion,
+			Time:          s.time,
+			Hostname:      []byte(k.Hostname),
+			Appname:       []byte(k.Appname),
+			Procid:        []byte(k.Procid),
+			Msgid:         s.msgid,
+			SD:            s.sd,
+			Msg:           []byte(msg),
+		},
+		Dest: s.dest,
+	}
+}
+
+// dedupSummary is a log standing in for suppressed duplicates, and the
+// route it's bound for.
+type dedupSummary struct {
+	Frame syslogFrame
+	Dest  string
+}
+
+// deduper suppresses consecutive duplicate logs from a source within Window
+// of the first, replacing them with a summary log like syslogd's "last
+// message repeated N times" when the source next sends something else, or
+// the same log after Window. Summaries of sources that go quiet for Window
+// are delivered by Run, and any left by Close. It is safe for concurrent use.
+type deduper struct {
+	sync.Mutex
+	Window     time.Duration
+	sources    map[dedupKey]*dedupState
+	pending    []dedupPending // summaries of runs left over by concurrent requests
+	version    uint64         // of the last commit
+	encoder    *outputEncoder // formats summaries delivered by Run
+	dst        deliverer      // where Run delivers summaries
+	closeCh    chan struct{}
+	suppressed metrics.Counter // counts duplicate logs suppressed
+	summaries  metrics.Counter // counts summary logs sent
+	lastSweep  time.Time
+}
+
+func newDeduper(window time.Duration, registry metrics.Registry) *deduper {
+	return &deduper{
+		Window:     window,
+		sources:    make(map[dedupKey]*dedupState),
+		closeCh:    make(chan struct{}),
+		suppressed: metrics.GetOrRegisterCounter("log-iss.dedup.suppressed.g", registry),
+		summaries:  metrics.GetOrRegisterCounter("log-iss.dedup.summaries.g", registry),
+	}
+}
+
+// load returns a copy of the state of the source k, if there's any.
+func (d *deduper) load(k dedupKey) (*dedupState, bool) {
+	d.Lock()
+	defer d.Unlock()
+
+	s, ok := d.sources[k]
+	if !ok {
+		return nil, false
+	}
+	c := *s
+	c.time = append([]byte{}, s.time...)
+	return &c, true
+}
+
+// dedupPending is the summary of a run of duplicates from the source k that
+// is waiting to be delivered by Run.
+type dedupPending struct {
+	k dedupKey
+	s *dedupState
+}
+
+// dedupBatch deduplicates the logs of one request against copies of the
+// state of their sources, which are merged into the deduper's only once
+// Commit is called after the logs are delivered. A request that fails and is
+// retried is deduplicated the same way again, rather than having its logs
+// taken for duplicates of themselves.
+type dedupBatch struct {
+	d          *deduper
+	sources    map[dedupKey]*dedupBatchSource
+	suppressed int64
+	summaries  int64
+	now        time.Time
+}
+
+// dedupBatchSource is a batch's copy of the state of a source, and what the
+// batch did to the run it was loaded with, so that it can be merged with
+// commits made since.
+type dedupBatchSource struct {
+	state   *dedupState
+	version uint64 // of the state loaded, 0 if there was none
+	run     uint64 // of the state loaded
+	added   int64  // duplicates suppressed onto the run loaded
+	ended   bool   // whether the batch ended the run loaded
+}
+
+// Batch starts deduplicating the logs of a request.
+func (d *deduper) Batch() *dedupBatch {
+	return &dedupBatch{d: d, sources: make(map[dedupKey]*dedupBatchSource)}
+}
+
+// Apply returns whether f, bound for dest, should be kept, and a summary of
+// the duplicates suppressed before it, if it ends a run of them. The summary
+// comes first.
+func (b *dedupBatch) Apply(f *syslogFrame, dest string, now time.Time) (*dedupSummary, bool) {
+	k := dedupKey{string(f.Hostname), string(f.Appname), string(f.Procid)}
+	b.now = now
+
+	src, ok := b.sources[k]
+	if !ok {
+		var s *dedupState
+		if s, ok = b.d.load(k); ok {
+			src = &dedupBatchSource{state: s, version: s.version, run: s.run}
+			b.sources[k] = src
+		}
+	}
+	if ok && src.state.matches(f) && now.Sub(src.state.first) < b.d.Window {
+		s := src.state
+		s.count++
+		s.last = now
+		s.time = append(s.time[:0], f.Time...)
+		if !src.ended {
+			src.added++
+		}
+		b.suppressed++
+		return nil, false
+	}
+
+	var summary *dedupSummary
+	if ok && src.state.count > 0 {
+		summary = src.state.summary(k)
+		b.summaries++
+	}
+	if !ok {
+		src = &dedupBatchSource{state: &dedupState{}}
+		b.sources[k] = src
+	}
+	src.state.reset(f, dest, now)
+	src.ended = true
+	return summary, true
+}
+
+// Commit merges the state of the batch's sources into the deduper's, once
+// its logs have been delivered. A nil batch commits nothing.
+//
+// Sources that no other request has committed since the batch loaded them
+// take the batch's state. Otherwise the committed state is kept, and the
+// duplicates the batch suppressed are added to it if they belong to the same
+// run, or else left pending as a summary of their own for Run to deliver, so
+// none go uncounted. Two requests that both end a run both send its summary.
+func (b *dedupBatch) Commit() {
+	if b == nil || len(b.sources) == 0 {
+		return
+	}
+	d := b.d
+	d.Lock()
+	defer d.Unlock()
+
+	for k, src := range b.sources {
+		s := src.state
+		cur, ok := d.sources[k]
+		switch {
+		case !ok || cur.version == src.version:
+			d.version++
+			s.version = d.version
+			if src.ended {
+				s.run = d.version
+			}
+			d.sources[k] = s
+		case !src.ended && cur.run == src.run:
+			cur.count += src.added
+			if s.last.After(cur.last) {
+				cur.last = s.last
+				cur.time = s.time
+			}
+			d.version++
+			cur.version = d.version
+		case !src.ended:
+			if src.added > 0 {
+				s.count = src.added
+				d.pending = append(d.pending, dedupPending{k, s})
+			}
+		case s.count > 0:
+			d.pending = append(d.pending, dedupPending{k, s})
+		}
+	}
+	d.suppressed.Inc(b.suppressed)
+	d.summaries.Inc(b.summaries)
+	d.sweep(b.now)
+}
+
+// sweep forgets sources that have gone quiet, other than those with
+// summaries still to be delivered.
+func (d *deduper) sweep(now time.Time) {
+	if now.Sub(d.lastSweep) < sampleIdleTimeout {
+		return
+	}
+	d.lastSweep = now
+
+	for k, s := range d.sources {
+		if s.count == 0 && now.Sub(s.last) >= sampleIdleTimeout {
+			delete(d.sources, k)
+		}
+	}
+}
+
+// Run delivers the summaries of sources that have gone quiet for Window to
+// dst, formatted with encoder, until Close is called.
+func (d *deduper) Run(encoder *outputEncoder, dst deliverer) {
+	if encoder == nil {
+		encoder = defaultOutputEncoder
+	}
+	d.Lock()
+	d.encoder, d.dst = encoder, dst
+	d.Unlock()
+
+	t := time.NewTicker(d.Window)
+	defer t.Stop()
+	for {
+		select {
+		case now := <-t.C:
+			d.flush(now, false)
+		case <-d.closeCh:
+			return
+		}
+	}
+}
+
+// Close stops Run and delivers every summary still pending, for use once
+// no more logs are being received.
+func (d *deduper) Close() {
+	close(d.closeCh)
+	d.flush(time.Now(), true)
+}
+
+// flush delivers the summaries pending for sources that haven't been seen
+// for Window, or for every source if all is set, along with those left over
+// by concurrent requests. If delivery fails, they're left pending to be
+// tried again.
+func (d *deduper) flush(now time.Time, all bool) {
+	type flushed struct {
+		k     dedupKey
+		first time.Time
+		count int64
+	}
+	var taken []flushed
+	var msg, body bytes.Buffer
+	var routed map[string]*bytes.Buffer
+	var numLogs int64
+	routes := make(map[string]routedLogs)
+
+	d.Lock()
+	dst, encoder := d.dst, d.encoder
+	if dst == nil {
+		d.Unlock()
+		return
+	}
+	add := func(k dedupKey, s *dedupState) {
+		summary := s.summary(k)
+		encoder.Format(&msg, &summary.Frame)
+		if summary.Dest == "" {
+			encoder.Frame(&body, &msg)
+			numLogs++
+		} else {
+			if routed == nil {
+				routed = make(map[string]*bytes.Buffer)
+			}
+			w := routed[summary.Dest]
+			if w == nil {
+				w = new(bytes.Buffer)
+				routed[summary.Dest] = w
+			}
+			encoder.Frame(w, &msg)
+			rl := routes[summary.Dest]
+			rl.NumLogs++
+			routes[summary.Dest] = rl
+		}
+		msg.Reset()
+	}
+	for k, s := range d.sources {
+		if s.count == 0 || (!all && now.Sub(s.last) < d.Window) {
+			continue
+		}
+		add(k, s)
+		taken = append(taken, flushed{k, s.first, s.count})
+		s.count = 0
+	}
+	pending := d.pending
+	d.pending = nil
+	for _, p := range pending {
+		add(p.k, p.s)
+	}
+	d.Unlock()
+	if len(taken) == 0 && len(pending) == 0 {
+		return
+	}
+
+	p := NewPayload("", "", body.Bytes())
+	p.NumLogs = numLogs
+	for dest, w := range routed {
+		rl := routes[dest]
+		rl.Body = w.Bytes()
+		routes[dest] = rl
+	}
+	if len(routes) > 0 {
+		p.Routes = routes
+	}
+	if err := dst.Deliver(p); err != nil {
+		log.WithFields(log.Fields{"ns": "dedup", "at": "flush-error", "summaries": len(taken) + len(pending), "message": err.Error()}).Error()
+		d.Lock()
+		for _, t := range taken {
+			if s, ok := d.sources[t.k]; ok && s.first.Equal(t.first) {
+				s.count += t.count
+			}
+		}
+		d.pending = append(d.pending, pending...)
+		d.Unlock()
+		return
+	}
+	d.summaries.Inc(int64(len(taken) + len(pending)))
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/heroku/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSampler(t *testing.T) {
+	assert := assert.New(t)
+	registry := metrics.NewRegistry()
+	s, err := newSampler([]string{"drain:d.1234=2", "app:noisy=3", "app:*=1", "drain:*=4"}, 3, registry)
+	if !assert.NoError(err) {
+		return
+	}
+	now := time.Now()
+
+	kept := func(drainToken, app, pri string, n int) int {
+		k := 0
+		for i := 0; i < n; i++ {
+			f := syslogFrame{PrivalVersion: []byte(pri + "1"), Appname: []byte(app)}
+			if s.Apply(&f, drainToken, now) {
+				k++
+			}
+		}
+		return k
+	}
+
+	assert.Equal(6, kept("d.1234", "noisy", "<13>", 12), "the drain's rate comes first")
+	assert.Equal(4, kept("", "noisy", "<13>", 12))
+	assert.Equal(12, kept("", "quiet", "<13>", 12))
+	assert.Equal(3, kept("d.5678", "quiet", "<13>", 12), "the drain default comes before the app default")
+	assert.Equal(12, kept("d.1234", "noisy", "<11>", 12), "errors are never sampled")
+
+	assert.Equal(int64(6), metrics.GetOrRegisterCounter("log-iss.sample.drain.d.1234.sampled.g", registry).Count())
+	assert.Equal(int64(8), metrics.GetOrRegisterCounter("log-iss.sample.app.noisy.sampled.g", registry).Count())
+	assert.Equal(int64(9), metrics.GetOrRegisterCounter("log-iss.sample.drain.*.sampled.g", registry).Count())
+	assert.Equal(int64(12), s.exempt.Count())
+}
+
+func TestNewSamplerErrors(t *testing.T) {
+	for _, entries := range [][]string{{"drain"}, {"drain:=2"}, {"user:x=2"}, {"app:x=0"}, {"app:x=0.5"}} {
+		_, err := newSampler(entries, 3, metrics.NewRegistry())
+		assert.Error(t, err, entries)
+	}
+}
+
+func TestDeduper(t *testing.T) {
+	assert := assert.New(t)
+	d := newDeduper(time.Minute, metrics.NewRegistry())
+	now := time.Now()
+
+	// Each log is in a request of its own
+	apply := func(f *syslogFrame, dest string, now time.Time) (*dedupSummary, bool) {
+		b := d.Batch()
+		defer b.Commit()
+		return b.Apply(f, dest, now)
+	}
+
+	summary, keep := apply(dedupFrame("a", "- hi", "t1"), "", now)
+	assert.Nil(summary)
+	assert.True(keep)
+	for _, ts := range []string{"t2", "t3"} {
+		_, keep = apply(dedupFrame("a", "- hi", ts), "", now)
+		assert.False(keep)
+	}
+	_, keep = apply(dedupFrame("b", "- hi", "t4"), "", now)
+	assert.True(keep, "other sources are separate")
+
+	summary, keep = apply(dedupFrame("a", "- bye", "t5"), "system", now)
+	assert.True(keep)
+	if assert.NotNil(summary) {
+		assert.Equal("", summary.Dest)
+		assert.Equal("t3", string(summary.Frame.Time))
+		assert.Equal("a", string(summary.Frame.Hostname))
+		assert.Equal("- last message repeated 2 times", string(summary.Frame.Msg))
+	}
+
+	// The same log after the window is sent again, after a summary
+	apply(dedupFrame("a", "- bye", "t6"), "system", now)
+	summary, keep = apply(dedupFrame("a", "- bye", "t7"), "system", now.Add(time.Minute))
+	assert.True(keep)
+	if assert.NotNil(summary) {
+		assert.Equal("system", summary.Dest)
+		assert.Equal("- last message repeated 1 times", string(summary.Frame.Msg))
+	}
+
+	assert.Equal(int64(3), d.suppressed.Count())
+	assert.Equal(int64(2), d.summaries.Count())
+}
+
+func dedupFrame(host, msg, ts string) *syslogFrame {
+	return &syslogFrame{
+		PrivalVersion: []byte("<13>1"),
+		Time:          []byte(ts),
+		Hostname:      []byte(host),
+		Appname:       []byte("app"),
+		Procid:        []byte("web.1"),
+		Msgid:         []byte("-"),
+		Msg:           []byte(msg),
+	}
+}
+
+func TestDedupRetriedRequest(t *testing.T) {
+	assert := assert.New(t)
+	config := &IssConfig{Deduper: newDeduper(time.Minute, metrics.NewRegistry())}
+	body := logplexFrames(
+		"<13>1 2013-06-07T13:17:49Z host app web.1 - - same\n",
+		"<13>1 2013-06-07T13:17:50Z host app web.1 - - same\n",
+	)
+
+	// A request that isn't delivered leaves nothing behind, so its retry is
+	// deduplicated the same way
+	first, err := fix(simpleHttpRequest(), bytes.NewReader(body), "1.2.3.4", "", "", nil, config)
+	if !assert.NoError(err) {
+		return
+	}
+	retry, _ := fix(simpleHttpRequest(), bytes.NewReader(body), "1.2.3.4", "", "", nil, config)
+	assert.Equal(int64(1), retry.numLogs)
+	assert.Equal(string(first.bytes), string(retry.bytes))
+	assert.Equal(int64(0), config.Deduper.suppressed.Count())
+
+	// Once it is, the next request's duplicates are suppressed
+	retry.dedup.Commit()
+	assert.Equal(int64(1), config.Deduper.suppressed.Count())
+	r, _ := fix(simpleHttpRequest(), bytes.NewReader(body), "1.2.3.4", "", "", nil, config)
+	assert.Equal(int64(0), r.numLogs)
+}
+
+// Requests deduplicated at the same time don't lose each other's counts.
+func TestDedupConcurrentRequests(t *testing.T) {
+	assert := assert.New(t)
+	d := newDeduper(time.Minute, metrics.NewRegistry())
+	now := time.Now()
+	first := d.Batch()
+	first.Apply(dedupFrame("a", "- hi", "t1"), "", now)
+	first.Commit()
+
+	// Both continue the run
+	x, y := d.Batch(), d.Batch()
+	x.Apply(dedupFrame("a", "- hi", "t2"), "", now)
+	y.Apply(dedupFrame("a", "- hi", "t3"), "", now)
+	y.Apply(dedupFrame("a", "- hi", "t4"), "", now)
+	x.Commit()
+	y.Commit()
+	s, _ := d.load(dedupKey{"a", "app", "web.1"})
+	assert.Equal(int64(3), s.count)
+
+	// One ends the run while the other continues it
+	x, y = d.Batch(), d.Batch()
+	summary, _ := x.Apply(dedupFrame("a", "- bye", "t5"), "", now)
+	if assert.NotNil(summary) {
+		assert.Equal("- last message repeated 3 times", string(summary.Frame.Msg))
+	}
+	y.Apply(dedupFrame("a", "- hi", "t6"), "", now)
+	x.Commit()
+	y.Commit()
+	s, _ = d.load(dedupKey{"a", "app", "web.1"})
+	assert.Equal("- bye", string(s.msg))
+	assert.Equal(int64(0), s.count)
+
+	// The other's duplicates get a summary of their own
+	var p payload
+	d.encoder, d.dst = defaultOutputEncoder, deliverFunc(func(dp payload) error {
+		p = dp
+		return nil
+	})
+	d.flush(now, false)
+	assert.Contains(string(p.Body), "<13>1 t6 a app web.1 ")
+	assert.Contains(string(p.Body), " last message repeated 1 times")
+	assert.Equal(int64(1), p.NumLogs)
+	assert.Equal(int64(4), d.suppressed.Count())
+	assert.Equal(int64(2), d.summaries.Count())
+}
+
+func TestDeduperFlush(t *testing.T) {
+	assert := assert.New(t)
+	d := newDeduper(time.Minute, metrics.NewRegistry())
+	now := time.Now()
+	frame := func(host, ts string) *syslogFrame {
+		f := dedupFrame(host, "- hi\n", ts)
+		f.SD = []byte(`[origin ip="1.2.3.4"]`)
+		return f
+	}
+	b := d.Batch()
+	b.Apply(frame("a", "t1"), "", now)
+	b.Apply(frame("a", "t2"), "", now)
+	b.Apply(frame("b", "t3"), "system", now)
+	b.Apply(frame("b", "t4"), "system", now.Add(time.Second))
+	b.Commit()
+
+	// Summaries are only delivered by Run
+	d.flush(now.Add(time.Hour), true)
+	var p payload
+	dst := deliverFunc(func(dp payload) error {
+		p = dp
+		return errors.New("queue full")
+	})
+	d.encoder, d.dst = defaultOutputEncoder, dst
+
+	// Those that fail to be delivered are tried again
+	d.flush(now.Add(time.Minute), false)
+	assert.Equal("75 <13>1 t2 a app web.1 - [origin ip=\"1.2.3.4\"] last message repeated 1 times\n", string(p.Body))
+	assert.Nil(p.Routes, "b was seen since")
+	assert.Equal(int64(0), d.summaries.Count())
+
+	// Close delivers every summary
+	d.dst = deliverFunc(func(dp payload) error {
+		p = dp
+		return nil
+	})
+	d.Close()
+	assert.Equal("75 <13>1 t2 a app web.1 - [origin ip=\"1.2.3.4\"] last message repeated 1 times\n", string(p.Body))
+	assert.Equal(int64(1), p.NumLogs)
+	if assert.Contains(p.Routes, "system") {
+		assert.Equal("75 <13>1 t4 b app web.1 - [origin ip=\"1.2.3.4\"] last message repeated 1 times\n", string(p.Routes["system"].Body))
+	}
+	assert.Equal(int64(2), d.summaries.Count())
+
+	p = payload{}
+	d.flush(now.Add(time.Hour), true)
+	assert.Nil(p.Body, "nothing is left pending")
+}
+
+// deliverFunc adapts a function to the deliverer interface.
+type deliverFunc func(payload) error
+
+func (f deliverFunc) Deliver(p payload) error {
+	return f(p)
+}
+
+func TestFixDedupsAndSamples(t *testing.T) {
+	assert := assert.New(t)
+	s, _ := newSampler([]string{"app:*=2"}, 3, metrics.NewRegistry())
+	config := &IssConfig{Deduper: newDeduper(time.Minute, metrics.NewRegistry()), Sampler: s}
+
+	body := logplexFrames(
+		"<13>1 2013-06-07T13:17:49Z host app web.1 - - same\n",
+		"<13>1 2013-06-07T13:17:50Z host app web.1 - - same\n",
+		"<13>1 2013-06-07T13:17:51Z host app web.1 - - same\n",
+		"<13>1 2013-06-07T13:17:52Z host app web.1 - - different\n",
+		"<11>1 2013-06-07T13:17:53Z host app web.1 - - oops\n",
+	)
+	r, err := fix(simpleHttpRequest(), bytes.NewReader(body), "1.2.3.4", "", "", nil, config)
+	if !assert.NoError(err) {
+		return
+	}
+
+	// The summary is never sampled, but "different" is, and "oops" is exempt
+	assert.Equal(int64(3), r.numLogs)
+	assert.Equal(
+		"71 <13>1 2013-06-07T13:17:49Z host app web.1 - [origin ip=\"1.2.3.4\"] same\n"+
+			"96 <13>1 2013-06-07T13:17:51Z host app web.1 - [origin ip=\"1.2.3.4\"] last message repeated 2 times\n"+
+			"71 <11>1 2013-06-07T13:17:53Z host app web.1 - [origin ip=\"1.2.3.4\"] oops\n",
+		string(r.bytes))
+}
+
+// BenchmarkFixDedup is BenchmarkFixNoSD with deduplication, where the second
+// log is a duplicate of the first.
+func BenchmarkFixDedup(b *testing.B) {
+	msg := "<13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - - hi\n"
+	input := logplexFrames(msg, msg)
+	config := getConfig()
+	config.Deduper = newDeduper(time.Minute, metrics.NewRegistry())
+	b.SetBytes(int64(len(input)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fix(simpleHttpRequest(), bytes.NewReader(input), "1.2.3.4", "", "", nil, config)
+	}
+}
+
+func TestHTTPProcessCommitsDedupOnDelivery(t *testing.T) {
+	assert := assert.New(t)
+	config := getConfig()
+	config.Deduper = newDeduper(time.Minute, metrics.NewRegistry())
+	d := &recordingDeliverer{err: errors.New("queue full")}
+	s := newHTTPServer(*config, nil, fix, d)
+	in := logplexFrames("<13>1 2013-06-07T13:17:49Z host app web.1 - - same\n")
+
+	err, _ := s.process(simpleHttpRequest(), bytes.NewReader(in), "1.2.3.4", "", "", "", nil)
+	assert.Error(err)
+	d.err = nil
+	err, _ = s.process(simpleHttpRequest(), bytes.NewReader(in), "1.2.3.4", "", "", "", nil)
+	assert.NoError(err)
+	assert.Equal(d.bodies[0], d.bodies[1], "the retry isn't taken for a duplicate")
+
+	err, _ = s.process(simpleHttpRequest(), bytes.NewReader(in), "1.2.3.4", "", "", "", nil)
+	assert.NoError(err)
+	assert.Equal("", d.bodies[2])
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// sdElement is a single RFC 5424 SD-ELEMENT, eg. [origin ip="1.2.3.4"]
+type sdElement struct {
+	ID     string
+	Params []sdParam
+}
+
+type sdParam struct {
+	Name  string
+	Value string
+}
+
+var errNoStructuredData = errors.New("no structured data")
+
+// parseStructuredData parses the STRUCTURED-DATA at the start of b, per RFC
+// 5424 section 6.3, unescaping param values. Returns the elements, which are
+// empty for the NILVALUE, and whatever follows the structured data.
+func parseStructuredData(b []byte) ([]sdElement, []byte, error) {
+	if len(b) == 0 {
+		return nil, b, errNoStructuredData
+	}
+	if b[0] == '-' {
+		if len(b) == 1 || b[1] == ' ' {
+			return nil, b[1:], nil
+		}
+		return nil, b, errNoStructuredData
+	}
+	if b[0] != '[' {
+		return nil, b, errNoStructuredData
+	}
+
+	var elements []sdElement
+	for len(b) > 0 && b[0] == '[' {
+		var e sdElement
+		var err error
+		e, b, err = parseSDElement(b[1:])
+		if err != nil {
+			return nil, b, err
+		}
+		elements = append(elements, e)
+	}
+	return elements, b, nil
+}
+
+// parseSDElement parses an SD-ELEMENT after its opening bracket.
+func parseSDElement(b []byte) (sdElement, []byte, error) {
+	var e sdElement
+
+	i := bytes.IndexAny(b, " ]")
+	if i <= 0 {
+		return e, b, fmt.Errorf("invalid SD-ID")
+	}
+	e.ID = string(b[:i])
+	b = b[i:]
+
+	for {
+		if len(b) == 0 {
+			return e, b, fmt.Errorf("unterminated SD-ELEMENT %s", e.ID)
+		}
+		if b[0] == ']' {
+			return e, b[1:], nil
+		}
+
+		// SP PARAM-NAME "=" %d34 PARAM-VALUE %d34
+		if b[0] != ' ' {
+			return e, b, fmt.Errorf("invalid SD-PARAM in %s", e.ID)
+		}
+		b = b[1:]
+		i := bytes.IndexByte(b, '=')
+		if i <= 0 || i+1 >= len(b) || b[i+1] != '"' {
+			return e, b, fmt.Errorf("invalid SD-PARAM in %s", e.ID)
+		}
+		p := sdParam{Name: string(b[:i])}
+		b = b[i+2:]
+
+		var value bytes.Buffer
+		closed := false
+		for len(b) > 0 && !closed {
+			switch {
+			case b[0] == '\\' && len(b) > 1 && (b[1] == '"' || b[1] == '\\' || b[1] == ']'):
+				value.WriteByte(b[1])
+				b = b[2:]
+			case b[0] == '"':
+				closed = true
+				b = b[1:]
+			default:
+				value.WriteByte(b[0])
+				b = b[1:]
+			}
+		}
+		if !closed {
+			return e, b, fmt.Errorf("unterminated PARAM-VALUE in %s", e.ID)
+		}
+		p.Value = value.String()
+		e.Params = append(e.Params, p)
+	}
+}
+
+// writeStructuredData writes elements as RFC 5424 STRUCTURED-DATA, escaping
+// param values per section 6.3.3, or the NILVALUE if there are none.
+func writeStructuredData(w *bytes.Buffer, elements []sdElement) {
+	if len(elements) == 0 {
+		w.WriteString("-")
+		return
+	}
+
+	for _, e := range elements {
+		w.WriteString("[")
+		w.WriteString(e.ID)
+		for _, p := range e.Params {
+			w.WriteString(" ")
+			w.WriteString(p.Name)
+			w.WriteString(`="`)
+			writeSDParamValue(w, p.Value)
+			w.WriteString(`"`)
+		}
+		w.WriteString("]")
+	}
+}
+
+func writeSDParamValue(w *bytes.Buffer, v string) {
+	for i := 0; i < len(v); i++ {
+		switch v[i] {
+		case '"', '\\', ']':
+			w.WriteByte('\\')
+		}
+		w.WriteByte(v[i])
+	}
+}
+
+// validSDName returns true if name is a valid SD-NAME, as used for SD-IDs and
+// PARAM-NAMEs: 1 to 32 printable US-ASCII characters other than '=', SP,
+// ']' and '"'.
+func validSDName(name string) bool {
+	if len(name) == 0 || len(name) > 32 {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c < 33 || c > 126 || c == '=' || c == ']' || c == '"' {
+			return false
+		}
+	}
+	return true
+}
+
+// Values for METADATA_INVALID_VALUES
+const (
+	metadataSanitize = "sanitize" // replace invalid characters in metadata values
+	metadataReject   = "reject"   // refuse requests with invalid metadata values
+)
+
+// invalidMetadataError is returned for a request whose metadata query
+// parameter has an invalid value when METADATA_INVALID_VALUES is "reject".
+type invalidMetadataError struct {
+	Param string
+}
+
+func (e invalidMetadataError) Error() string {
+	return fmt.Sprintf("invalid value for metadata query parameter %s", e.Param)
+}
+
+// validateMetadataConfig checks that METADATA_ID and the metadata query
+// parameter names can be written as structured data.
+func validateMetadataConfig(config IssConfig) error {
+	switch config.MetadataInvalidValues {
+	case metadataSanitize, metadataReject:
+	default:
+		return fmt.Errorf("Unknown METADATA_INVALID_VALUES: %s", config.MetadataInvalidValues)
+	}
+	if config.MetadataId != "" && !validSDName(config.MetadataId) {
+		return fmt.Errorf("METADATA_ID %q isn't a valid SD-ID", config.MetadataId)
+	}
+	for _, k := range config.QueryParams {
+		if !validSDName(k) {
+			return fmt.Errorf("LOG_ISS_QUERY_PARAMS %q isn't a valid SD-PARAM name", k)
+		}
+	}
+	for _, k := range config.QueryFieldParams {
+		if !validSDName(k) || strings.ContainsRune(k, ',') {
+			return fmt.Errorf("LOG_ISS_FIELD_PARAMS %q isn't a valid field name", k)
+		}
+	}
+	return nil
+}
+
+// sanitizeSDParamValue replaces what shouldn't be in a param value with '_':
+// invalid UTF-8 and control characters, which would break non-transparent
+// framing, and, for entries of the "fields" param, the ',' and '=' that
+// separate them. Returns the value and whether it was changed.
+func sanitizeSDParamValue(v string, field bool) (string, bool) {
+	invalid := func(r rune) bool {
+		return r == utf8.RuneError || r < 0x20 || r == 0x7f || (field && (r == ',' || r == '='))
+	}
+	if utf8.ValidString(v) && strings.IndexFunc(v, invalid) < 0 {
+		return v, false
+	}
+
+	var b strings.Builder
+	b.Grow(len(v))
+	for _, r := range v {
+		if invalid(r) {
+			r = '_'
+		}
+		b.WriteRune(r)
+	}
+	return b.String(), true
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseStructuredData(t *testing.T) {
+	tests := map[string]struct {
+		in       string
+		elements []sdElement
+		rest     string
+		err      bool
+	}{
+		"nil value": {
+			in:   "- hello",
+			rest: " hello",
+		},
+		"single element": {
+			in:       `[origin ip="1.2.3.4"] hello`,
+			elements: []sdElement{{ID: "origin", Params: []sdParam{{"ip", "1.2.3.4"}}}},
+			rest:     " hello",
+		},
+		"multiple elements and params": {
+			in: `[meta sequenceId="hello" other="x"][foo bar="baz"]`,
+			elements: []sdElement{
+				{ID: "meta", Params: []sdParam{{"sequenceId", "hello"}, {"other", "x"}}},
+				{ID: "foo", Params: []sdParam{{"bar", "baz"}}},
+			},
+			rest: "",
+		},
+		"element without params": {
+			in:       "[60607e20-f12d-483e-aa89-ffaf954e7527]",
+			elements: []sdElement{{ID: "60607e20-f12d-483e-aa89-ffaf954e7527"}},
+		},
+		"escaped values": {
+			in:       `[x a="say \"hi\"" b="back\\slash" c="\]"] msg`,
+			elements: []sdElement{{ID: "x", Params: []sdParam{{"a", `say "hi"`}, {"b", `back\slash`}, {"c", "]"}}}},
+			rest:     " msg",
+		},
+		"not structured data": {
+			in:   "hello",
+			rest: "hello",
+			err:  true,
+		},
+		"unterminated value": {
+			in:  `[x a="oops] msg`,
+			err: true,
+		},
+		"unterminated element": {
+			in:  `[x a="b"`,
+			err: true,
+		},
+		"missing quotes": {
+			in:  `[x a=b] msg`,
+			err: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			elements, rest, err := parseStructuredData([]byte(test.in))
+			if test.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.elements, elements)
+			assert.Equal(t, test.rest, string(rest))
+		})
+	}
+}
+
+func TestSanitizeSDParamValue(t *testing.T) {
+	tests := []struct {
+		in      string
+		field   bool
+		out     string
+		changed bool
+	}{
+		{`say "hi"]`, false, `say "hi"]`, false},
+		{"héllo", false, "héllo", false},
+		{"a,b=c", false, "a,b=c", false},
+		{"a,b=c", true, "a_b_c", true},
+		{"line\nbreak\x7f", false, "line_break_", true},
+		{"bad\xffutf8", false, "bad_utf8", true},
+	}
+	for _, tt := range tests {
+		out, changed := sanitizeSDParamValue(tt.in, tt.field)
+		assert.Equal(t, tt.out, out, tt.in)
+		assert.Equal(t, tt.changed, changed, tt.in)
+	}
+}
+
+func TestValidateMetadataConfig(t *testing.T) {
+	assert := assert.New(t)
+	valid := IssConfig{
+		MetadataId:            "metadata@123",
+		MetadataInvalidValues: metadataSanitize,
+		QueryParams:           []string{"index", "source"},
+		QueryFieldParams:      []string{"custom1"},
+	}
+	assert.NoError(validateMetadataConfig(valid))
+
+	for name, mutate := range map[string]func(c *IssConfig){
+		"metadata id with space":   func(c *IssConfig) { c.MetadataId = "meta data" },
+		"long param name":          func(c *IssConfig) { c.QueryParams = []string{strings.Repeat("x", 33)} },
+		"param name with quote":    func(c *IssConfig) { c.QueryParams = []string{`in"dex`} },
+		"field name with comma":    func(c *IssConfig) { c.QueryFieldParams = []string{"a,b"} },
+		"field name with equals":   func(c *IssConfig) { c.QueryFieldParams = []string{"a=b"} },
+		"unknown invalid handling": func(c *IssConfig) { c.MetadataInvalidValues = "ignore" },
+	} {
+		c := valid
+		mutate(&c)
+		assert.Error(validateMetadataConfig(c), name)
+	}
+}
@@ -0,0 +1,610 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/heroku/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	spoolSegmentSuffix = ".seg"
+	spoolPositionFile  = "position"
+
+	// LEN(4) CRC(4) TIME(8) REQUEST-ID-LEN(2)
+	spoolRecordHeaderLen = 18
+
+	// Records with spoolRecordExtended set in REQUEST-ID-LEN have
+	// QUEUED-AT(8) TRACE-ID(16) SPAN-ID(8) SAMPLED(1) after the request ID.
+	// Those spooled by earlier versions don't.
+	spoolRecordExtended     = 0x8000
+	spoolRecordExtensionLen = 33
+)
+
+var errSpoolClosed = errors.New("spool is closed")
+
+// spool is an on-disk write-ahead log that sits between httpServer.process
+// and the forwarders. Deliver appends payloads to a segmented log in Dir and
+// returns right away. Run drains the log into the forwarderSet's Inbox, and
+// the position of the last payload a forwarder has written is persisted so
+// that delivery resumes where it left off after a restart. Delivery is at
+// least once: payloads written after the last persisted position are
+// delivered again after a restart.
+type spool struct {
+	sync.Mutex
+	Dir          string
+	MaxBytes     int64
+	MaxAge       time.Duration
+	SegmentBytes int64
+	Fsync        bool
+	Inbox        chan payload
+
+	segments []*spoolSegment // oldest first, the last one is being appended to
+	w        *os.File        // the segment being appended to
+	size     int64           // total bytes across all segments
+	pos      spoolPosition   // position of the last payload that was written by a forwarder
+	saved    spoolPosition   // position last persisted to disk
+	notify   chan struct{}
+	closeCh  chan struct{}
+	closed   bool
+	now      func() time.Time
+
+	appends        metrics.Counter // counts payloads appended
+	appendBytes    metrics.Counter // counts bytes appended
+	appendErrors   metrics.Counter // counts failed appends
+	dropped        metrics.Counter // counts segments dropped because the spool was over MaxBytes
+	droppedBytes   metrics.Counter // counts bytes dropped because the spool was over MaxBytes
+	expired        metrics.Counter // counts payloads skipped because they were older than MaxAge
+	corrupt        metrics.Counter // counts unreadable records
+	depthBytes     metrics.Gauge   // bytes not yet written by a forwarder
+	depthSegments  metrics.Gauge   // segments on disk
+	lag            metrics.Gauge   // age in milliseconds of the last payload written by a forwarder
+	positionErrors metrics.Counter // counts failures to persist the read position
+}
+
+type spoolSegment struct {
+	id      int64
+	size    int64
+	modTime time.Time
+}
+
+type spoolPosition struct {
+	Segment int64 `json:"segment"`
+	Offset  int64 `json:"offset"`
+}
+
+type spoolRecord struct {
+	time      time.Time
+	requestID string
+	body      []byte
+	queuedAt  time.Time   // when the payload was received, if known
+	trace     spanContext // span the payload was received in, if known
+}
+
+// spoolInflight is a payload handed to the forwarders along with the
+// position just past it, which becomes the read position once it's written.
+type spoolInflight struct {
+	p    payload
+	time time.Time
+	next spoolPosition
+}
+
+func newSpool(config IssConfig, inbox chan payload) (*spool, error) {
+	return newRouteSpool(config, inbox, "")
+}
+
+// newRouteSpool creates the spool in front of the forwarders of route, with
+// metrics named for it, or of FORWARD_DEST if route is empty.
+func newRouteSpool(config IssConfig, inbox chan payload, route string) (*spool, error) {
+	prefix := routeMetricPrefix(route, "spool")
+	s := &spool{
+		Dir:            config.SpoolDir,
+		MaxBytes:       config.SpoolMaxBytes,
+		MaxAge:         config.SpoolMaxAge,
+		SegmentBytes:   config.SpoolSegmentBytes,
+		Fsync:          config.SpoolFsync,
+		Inbox:          inbox,
+		notify:         make(chan struct{}, 1),
+		closeCh:        make(chan struct{}),
+		now:            time.Now,
+		appends:        metrics.GetOrRegisterCounter(prefix+"appends.g", config.MetricsRegistry),
+		appendBytes:    metrics.GetOrRegisterCounter(prefix+"append.bytes.g", config.MetricsRegistry),
+		appendErrors:   metrics.GetOrRegisterCounter(prefix+"append.errors.g", config.MetricsRegistry),
+		dropped:        metrics.GetOrRegisterCounter(prefix+"dropped.segments.g", config.MetricsRegistry),
+		droppedBytes:   metrics.GetOrRegisterCounter(prefix+"dropped.bytes.g", config.MetricsRegistry),
+		expired:        metrics.GetOrRegisterCounter(prefix+"expired.g", config.MetricsRegistry),
+		corrupt:        metrics.GetOrRegisterCounter(prefix+"corrupt.g", config.MetricsRegistry),
+		depthBytes:     metrics.GetOrRegisterGauge(prefix+"depth.bytes.g", config.MetricsRegistry),
+		depthSegments:  metrics.GetOrRegisterGauge(prefix+"depth.segments.g", config.MetricsRegistry),
+		lag:            metrics.GetOrRegisterGauge(prefix+"lag.g", config.MetricsRegistry),
+		positionErrors: metrics.GetOrRegisterCounter(prefix+"position.errors.g", config.MetricsRegistry),
+	}
+
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return nil, fmt.Errorf("Unable to create spool directory: %s", err)
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *spool) segmentPath(id int64) string {
+	return filepath.Join(s.Dir, fmt.Sprintf("%020d%s", id, spoolSegmentSuffix))
+}
+
+// load finds existing segments and the persisted position, then starts a new
+// segment to append to. Appending never resumes in an old segment, and the
+// one that was being appended to is cut back to its last good record.
+func (s *spool) load() error {
+	infos, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return fmt.Errorf("Unable to read spool directory: %s", err)
+	}
+
+	for _, fi := range infos {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), spoolSegmentSuffix) {
+			continue
+		}
+		id, err := strconv.ParseInt(strings.TrimSuffix(fi.Name(), spoolSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, &spoolSegment{id: id, size: fi.Size(), modTime: fi.ModTime()})
+		s.size += fi.Size()
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].id < s.segments[j].id })
+	if len(s.segments) > 0 {
+		s.truncateTorn(s.segments[len(s.segments)-1])
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(s.Dir, spoolPositionFile))
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return fmt.Errorf("Unable to read spool position: %s", err)
+	default:
+		if err := json.Unmarshal(b, &s.pos); err != nil {
+			return fmt.Errorf("Unable to parse spool position: %s", err)
+		}
+	}
+
+	next := int64(0)
+	if len(s.segments) > 0 {
+		next = s.segments[len(s.segments)-1].id + 1
+	}
+	if err := s.rotate(next); err != nil {
+		return err
+	}
+
+	if s.pos.Segment < s.segments[0].id || s.pos.Segment > next {
+		s.pos = spoolPosition{Segment: s.segments[0].id}
+	}
+	s.saved = s.pos
+	s.gc()
+	s.updateDepth()
+	return nil
+}
+
+// truncateTorn cuts seg, the segment that was being appended to before a
+// restart, back to its last good record, so that a record torn by a crash
+// doesn't hide the rest of the segment from the reader.
+func (s *spool) truncateTorn(seg *spoolSegment) {
+	f, err := os.OpenFile(s.segmentPath(seg.id), os.O_RDWR, 0600)
+	if err != nil {
+		log.WithFields(log.Fields{"ns": "spool", "at": "error", "segment": seg.id, "message": err.Error()}).Error()
+		return
+	}
+	defer f.Close()
+
+	off := int64(0)
+	for off < seg.size {
+		_, n, err := readSpoolRecord(f, off, seg.size)
+		if err != nil {
+			break
+		}
+		off += n
+	}
+	if off == seg.size {
+		return
+	}
+
+	if err := f.Truncate(off); err != nil {
+		log.WithFields(log.Fields{"ns": "spool", "at": "error", "segment": seg.id, "message": err.Error()}).Error()
+		return
+	}
+	s.corrupt.Inc(1)
+	log.WithFields(log.Fields{"ns": "spool", "at": "truncated", "segment": seg.id, "offset": off, "bytes": seg.size - off}).Warn()
+	s.size -= seg.size - off
+	seg.size = off
+}
+
+// rotate must be called with the lock held.
+func (s *spool) rotate(id int64) error {
+	f, err := os.OpenFile(s.segmentPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("Unable to create spool segment: %s", err)
+	}
+	if s.w != nil {
+		s.w.Close()
+	}
+	s.w = f
+	s.segments = append(s.segments, &spoolSegment{id: id, modTime: s.now()})
+	return nil
+}
+
+func encodeSpoolRecord(t time.Time, p payload) []byte {
+	requestID := p.RequestID
+	if len(requestID) >= spoolRecordExtended {
+		requestID = requestID[:spoolRecordExtended-1]
+	}
+
+	b := make([]byte, spoolRecordHeaderLen+len(requestID)+spoolRecordExtensionLen+len(p.Body))
+	copy(b[spoolRecordHeaderLen:], requestID)
+	ext := b[spoolRecordHeaderLen+len(requestID):]
+	if !p.QueuedAt.IsZero() {
+		binary.BigEndian.PutUint64(ext[0:8], uint64(p.QueuedAt.UnixNano()))
+	}
+	copy(ext[8:24], p.Trace.TraceID[:])
+	copy(ext[24:32], p.Trace.SpanID[:])
+	if p.Trace.Sampled {
+		ext[32] = 1
+	}
+	copy(ext[spoolRecordExtensionLen:], p.Body)
+
+	binary.BigEndian.PutUint32(b[0:4], uint32(len(p.Body)))
+	binary.BigEndian.PutUint32(b[4:8], crc32.ChecksumIEEE(b[spoolRecordHeaderLen:]))
+	binary.BigEndian.PutUint64(b[8:16], uint64(t.UnixNano()))
+	binary.BigEndian.PutUint16(b[16:18], uint16(len(requestID))|spoolRecordExtended)
+	return b
+}
+
+// readSpoolRecord reads the record at off in r, a segment of size bytes,
+// returning it along with its total encoded length. Lengths in the header are
+// checked against what's left of the segment before anything is allocated
+// for them, as a corrupt header could ask for up to 4 GiB.
+func readSpoolRecord(r io.ReaderAt, off int64, size int64) (spoolRecord, int64, error) {
+	var rec spoolRecord
+	hdr := make([]byte, spoolRecordHeaderLen)
+	if _, err := r.ReadAt(hdr, off); err != nil {
+		return rec, 0, err
+	}
+
+	bodyLen := int64(binary.BigEndian.Uint32(hdr[0:4]))
+	ridLen := int64(binary.BigEndian.Uint16(hdr[16:18]))
+	extLen := int64(0)
+	if ridLen&spoolRecordExtended != 0 {
+		ridLen &^= spoolRecordExtended
+		extLen = spoolRecordExtensionLen
+	}
+	if spoolRecordHeaderLen+ridLen+extLen+bodyLen > size-off {
+		return rec, 0, errors.New("record overruns segment")
+	}
+	data := make([]byte, ridLen+extLen+bodyLen)
+	if _, err := r.ReadAt(data, off+spoolRecordHeaderLen); err != nil {
+		return rec, 0, err
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(hdr[4:8]) {
+		return rec, 0, errors.New("checksum mismatch")
+	}
+
+	rec.time = time.Unix(0, int64(binary.BigEndian.Uint64(hdr[8:16])))
+	rec.requestID = string(data[:ridLen])
+	if ext := data[ridLen : ridLen+extLen]; len(ext) > 0 {
+		if ns := int64(binary.BigEndian.Uint64(ext[0:8])); ns != 0 {
+			rec.queuedAt = time.Unix(0, ns)
+		}
+		copy(rec.trace.TraceID[:], ext[8:24])
+		copy(rec.trace.SpanID[:], ext[24:32])
+		rec.trace.Sampled = ext[32] == 1
+	}
+	rec.body = data[ridLen+extLen:]
+	return rec, spoolRecordHeaderLen + ridLen + extLen + bodyLen, nil
+}
+
+// Deliver appends the payload to the spool. The payload is considered
+// delivered once it is on disk; it is written to the forwarders later.
+func (s *spool) Deliver(p payload) error {
+	rec := encodeSpoolRecord(s.now(), p)
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return errSpoolClosed
+	}
+
+	active := s.segments[len(s.segments)-1]
+	if active.size > 0 && active.size+int64(len(rec)) > s.SegmentBytes {
+		if err := s.rotate(active.id + 1); err != nil {
+			s.appendErrors.Inc(1)
+			return err
+		}
+		active = s.segments[len(s.segments)-1]
+	}
+
+	n, err := s.w.Write(rec)
+	if err == nil && s.Fsync {
+		err = s.w.Sync()
+	}
+	if err != nil {
+		// Cut off anything partially written, so that later records in
+		// the segment can still be read
+		if n > 0 {
+			if terr := s.w.Truncate(active.size); terr != nil {
+				active.size += int64(n)
+				s.size += int64(n)
+			}
+		}
+		s.appendErrors.Inc(1)
+		return fmt.Errorf("Unable to append to spool: %s", err)
+	}
+	active.size += int64(n)
+	active.modTime = s.now()
+	s.size += int64(n)
+
+	s.appends.Inc(1)
+	s.appendBytes.Inc(int64(n))
+	s.gc()
+	s.updateDepth()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// gc removes segments that have been fully written by the forwarders, that
+// are older than MaxAge, or that are the oldest while the spool is over
+// MaxBytes. The segment being appended to is never removed.
+// Must be called with the lock held.
+func (s *spool) gc() {
+	cutoff := s.now().Add(-s.MaxAge)
+	for len(s.segments) > 1 {
+		seg := s.segments[0]
+		switch {
+		case seg.id < s.pos.Segment:
+		case s.MaxAge > 0 && seg.modTime.Before(cutoff):
+			log.WithFields(log.Fields{"ns": "spool", "at": "expired", "segment": seg.id}).Warn()
+		case s.MaxBytes > 0 && s.size > s.MaxBytes:
+			s.dropped.Inc(1)
+			s.droppedBytes.Inc(seg.size)
+			log.WithFields(log.Fields{"ns": "spool", "at": "dropped", "segment": seg.id, "bytes": seg.size}).Warn()
+		default:
+			return
+		}
+
+		if err := os.Remove(s.segmentPath(seg.id)); err != nil && !os.IsNotExist(err) {
+			log.WithFields(log.Fields{"ns": "spool", "at": "error", "segment": seg.id, "message": err.Error()}).Error()
+		}
+		s.size -= seg.size
+		s.segments = s.segments[1:]
+		if s.pos.Segment < s.segments[0].id {
+			s.pos = spoolPosition{Segment: s.segments[0].id}
+		}
+	}
+}
+
+// updateDepth must be called with the lock held.
+func (s *spool) updateDepth() {
+	depth := int64(0)
+	for _, seg := range s.segments {
+		if seg.id >= s.pos.Segment {
+			depth += seg.size
+		}
+	}
+	s.depthBytes.Update(depth - s.pos.Offset)
+	s.depthSegments.Update(int64(len(s.segments)))
+}
+
+// Run drains the spool into the Inbox until the spool is closed. No more
+// payloads than the Inbox can hold are handed to the forwarders at once.
+func (s *spool) Run() {
+	pending := make(chan spoolInflight, cap(s.Inbox))
+	defer close(pending)
+	go s.ack(pending)
+	go s.persistPosition()
+
+	var r spoolReader
+	defer r.close()
+
+	s.Lock()
+	r.pos = s.pos
+	s.Unlock()
+
+	for {
+		rec, next, ok := s.next(&r)
+		if !ok {
+			return
+		}
+
+		if s.MaxAge > 0 && s.now().Sub(rec.time) > s.MaxAge {
+			s.expired.Inc(1)
+			continue
+		}
+
+		p := NewPayload("", rec.requestID, rec.body)
+		p.Trace = rec.trace
+		if !rec.queuedAt.IsZero() {
+			p.QueuedAt = rec.queuedAt
+		}
+		select {
+		case pending <- spoolInflight{p: p, time: rec.time, next: next}:
+		case <-s.closeCh:
+			return
+		}
+		select {
+		case s.Inbox <- p:
+		case <-s.closeCh:
+			return
+		}
+	}
+}
+
+// spoolReader is the state of the goroutine draining the spool.
+type spoolReader struct {
+	pos spoolPosition
+	f   *os.File
+	id  int64 // segment f is open on
+}
+
+func (r *spoolReader) close() {
+	if r.f != nil {
+		r.f.Close()
+		r.f = nil
+	}
+}
+
+// next returns the next readable record and the position just past it,
+// blocking until one is available. Returns false once the spool is closed.
+func (s *spool) next(r *spoolReader) (spoolRecord, spoolPosition, bool) {
+	for {
+		s.Lock()
+		if s.closed {
+			s.Unlock()
+			return spoolRecord{}, r.pos, false
+		}
+
+		seg := s.segments[len(s.segments)-1]
+		for _, candidate := range s.segments {
+			if candidate.id >= r.pos.Segment {
+				seg = candidate
+				break
+			}
+		}
+		if seg.id != r.pos.Segment {
+			// The segment was removed from under us
+			r.pos = spoolPosition{Segment: seg.id}
+		}
+		size := seg.size
+		active := seg == s.segments[len(s.segments)-1]
+		s.Unlock()
+
+		if r.pos.Offset >= size {
+			if !active {
+				r.pos = spoolPosition{Segment: seg.id + 1}
+				continue
+			}
+			select {
+			case <-s.notify:
+			case <-s.closeCh:
+			}
+			continue
+		}
+
+		if r.f == nil || r.id != seg.id {
+			r.close()
+			f, err := os.Open(s.segmentPath(seg.id))
+			if err != nil {
+				s.corrupt.Inc(1)
+				log.WithFields(log.Fields{"ns": "spool", "at": "error", "segment": seg.id, "message": err.Error()}).Error()
+				r.pos = spoolPosition{Segment: seg.id, Offset: size}
+				continue
+			}
+			r.f = f
+			r.id = seg.id
+		}
+
+		rec, n, err := readSpoolRecord(r.f, r.pos.Offset, size)
+		if err != nil {
+			// Skip whatever is left of this segment
+			s.corrupt.Inc(1)
+			log.WithFields(log.Fields{"ns": "spool", "at": "error", "segment": seg.id, "offset": r.pos.Offset, "message": err.Error()}).Error()
+			r.pos = spoolPosition{Segment: seg.id, Offset: size}
+			continue
+		}
+
+		r.pos.Offset += n
+		return rec, r.pos, true
+	}
+}
+
+// ack waits for the forwarders to write each payload, in the order they were
+// handed out, and advances the read position.
+func (s *spool) ack(pending chan spoolInflight) {
+	for in := range pending {
+		select {
+		case <-in.p.WaitCh:
+		case <-s.closeCh:
+			return
+		}
+
+		s.Lock()
+		s.pos = in.next
+		s.gc()
+		s.updateDepth()
+		s.Unlock()
+		s.lag.Update(int64(s.now().Sub(in.time) / time.Millisecond))
+	}
+}
+
+func (s *spool) persistPosition() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.Lock()
+			s.savePosition()
+			s.Unlock()
+		case <-s.closeCh:
+			return
+		}
+	}
+}
+
+// savePosition must be called with the lock held.
+func (s *spool) savePosition() {
+	if s.pos == s.saved {
+		return
+	}
+
+	b, err := json.Marshal(s.pos)
+	if err == nil {
+		tmp := filepath.Join(s.Dir, spoolPositionFile+".tmp")
+		if err = ioutil.WriteFile(tmp, b, 0600); err == nil {
+			err = os.Rename(tmp, filepath.Join(s.Dir, spoolPositionFile))
+		}
+	}
+	if err != nil {
+		s.positionErrors.Inc(1)
+		log.WithFields(log.Fields{"ns": "spool", "at": "error", "message": err.Error()}).Error("Unable to save spool position")
+		return
+	}
+	s.saved = s.pos
+}
+
+// Close stops appending to and draining the spool and persists the read
+// position. Anything left in the spool is delivered after a restart.
+func (s *spool) Close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.closeCh)
+	s.savePosition()
+	if s.Fsync {
+		s.w.Sync()
+	}
+	return s.w.Close()
+}
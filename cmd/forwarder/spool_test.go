@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/heroku/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func spoolConfig(t *testing.T) (IssConfig, func()) {
+	dir, err := ioutil.TempDir("", "log-iss-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := IssConfig{
+		SpoolDir:          dir,
+		SpoolMaxBytes:     1 << 20,
+		SpoolMaxAge:       time.Hour,
+		SpoolSegmentBytes: 128,
+		MetricsRegistry:   metrics.NewRegistry(),
+	}
+	return config, func() { os.RemoveAll(dir) }
+}
+
+// drain acts as a forwarder, acknowledging n payloads from inbox.
+func drain(t *testing.T, inbox chan payload, n int) []string {
+	bodies := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		select {
+		case p := <-inbox:
+			bodies = append(bodies, string(p.Body))
+			p.WaitCh <- struct{}{}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for payload %d", i)
+		}
+	}
+	return bodies
+}
+
+func TestSpoolDeliversInOrder(t *testing.T) {
+	assert := assert.New(t)
+	config, cleanup := spoolConfig(t)
+	defer cleanup()
+
+	inbox := make(chan payload, 10)
+	s, err := newSpool(config, inbox)
+	assert.NoError(err)
+	go s.Run()
+	defer s.Close()
+
+	expected := []string{"first log line", "second log line", "third log line", "fourth log line", "fifth log line"}
+	for _, b := range expected {
+		assert.NoError(s.Deliver(NewPayload("1.2.3.4", "req", []byte(b))))
+	}
+
+	assert.Equal(expected, drain(t, inbox, len(expected)))
+	// The small segment size means we rotated
+	assert.True(len(s.segments) > 1)
+}
+
+func TestSpoolResumesAfterRestart(t *testing.T) {
+	assert := assert.New(t)
+	config, cleanup := spoolConfig(t)
+	defer cleanup()
+
+	inbox := make(chan payload, 10)
+	s, err := newSpool(config, inbox)
+	assert.NoError(err)
+	go s.Run()
+
+	for _, b := range []string{"one", "two", "three"} {
+		assert.NoError(s.Deliver(NewPayload("", "req", []byte(b))))
+	}
+	assert.Equal([]string{"one"}, drain(t, inbox, 1))
+
+	// Wait for the acknowledgement to be recorded
+	for i := 0; i < 100; i++ {
+		s.Lock()
+		done := s.pos.Offset > 0
+		s.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NoError(s.Close())
+	assert.Equal(errSpoolClosed, s.Deliver(NewPayload("", "req", []byte("four"))))
+
+	// Anything handed out but not acknowledged is delivered again
+	inbox = make(chan payload, 10)
+	s, err = newSpool(config, inbox)
+	assert.NoError(err)
+	go s.Run()
+	defer s.Close()
+
+	assert.Equal([]string{"two", "three"}, drain(t, inbox, 2))
+}
+
+func TestSpoolDropsOldestWhenFull(t *testing.T) {
+	assert := assert.New(t)
+	config, cleanup := spoolConfig(t)
+	defer cleanup()
+	config.SpoolMaxBytes = 300
+
+	inbox := make(chan payload, 10)
+	s, err := newSpool(config, inbox)
+	assert.NoError(err)
+	defer s.Close()
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(s.Deliver(NewPayload("", "req", []byte("0123456789012345678901234567890123456789"))))
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	assert.True(s.size <= config.SpoolMaxBytes+config.SpoolSegmentBytes)
+	assert.True(s.dropped.Count() > 0)
+	assert.Equal(s.segments[0].id, s.pos.Segment)
+}
+
+func TestSpoolSkipsExpired(t *testing.T) {
+	assert := assert.New(t)
+	config, cleanup := spoolConfig(t)
+	defer cleanup()
+
+	inbox := make(chan payload, 10)
+	s, err := newSpool(config, inbox)
+	assert.NoError(err)
+	defer s.Close()
+
+	now := time.Now()
+	s.now = func() time.Time { return now.Add(-2 * time.Hour) }
+	assert.NoError(s.Deliver(NewPayload("", "req", []byte("stale"))))
+	s.now = func() time.Time { return now }
+	assert.NoError(s.Deliver(NewPayload("", "req", []byte("fresh"))))
+
+	go s.Run()
+	assert.Equal([]string{"fresh"}, drain(t, inbox, 1))
+	assert.Equal(int64(1), s.expired.Count())
+}
+
+func TestSpoolRecordChecksum(t *testing.T) {
+	assert := assert.New(t)
+	config, cleanup := spoolConfig(t)
+	defer cleanup()
+
+	path := config.SpoolDir + "/record"
+	rec := encodeSpoolRecord(time.Now(), NewPayload("", "req", []byte("hello")))
+	rec[len(rec)-1] = 'X'
+	assert.NoError(ioutil.WriteFile(path, rec, 0600))
+
+	f, err := os.Open(path)
+	assert.NoError(err)
+	defer f.Close()
+
+	_, _, err = readSpoolRecord(f, 0, int64(len(rec)))
+	assert.Error(err)
+}
+
+func TestSpoolRecordOverrunsSegment(t *testing.T) {
+	rec := encodeSpoolRecord(time.Now(), NewPayload("", "req", []byte("hello")))
+	binary.BigEndian.PutUint32(rec[0:4], 0xffffffff)
+
+	_, _, err := readSpoolRecord(bytes.NewReader(rec), 0, int64(len(rec)))
+	assert.EqualError(t, err, "record overruns segment")
+}
+
+func TestSpoolKeepsTraceAndQueuedAt(t *testing.T) {
+	assert := assert.New(t)
+	config, cleanup := spoolConfig(t)
+	defer cleanup()
+
+	inbox := make(chan payload, 10)
+	s, err := newSpool(config, inbox)
+	if !assert.NoError(err) {
+		return
+	}
+	defer s.Close()
+
+	sc, _ := parseTraceparent("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	p := NewPayload("", "req", []byte("hello"))
+	p.Trace = sc
+	p.QueuedAt = time.Now().Add(-time.Minute)
+	assert.NoError(s.Deliver(p))
+
+	go s.Run()
+	select {
+	case got := <-inbox:
+		assert.Equal("req", got.RequestID)
+		assert.Equal(sc, got.Trace)
+		assert.True(p.QueuedAt.Equal(got.QueuedAt))
+		got.WaitCh <- struct{}{}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the spooled payload")
+	}
+}
+
+// Records spooled before the queue time and trace context were kept have
+// neither.
+func TestSpoolReadsRecordsWithoutTrace(t *testing.T) {
+	assert := assert.New(t)
+	rec := make([]byte, spoolRecordHeaderLen+len("req")+len("hello"))
+	copy(rec[spoolRecordHeaderLen:], "req")
+	copy(rec[spoolRecordHeaderLen+len("req"):], "hello")
+	binary.BigEndian.PutUint32(rec[0:4], uint32(len("hello")))
+	binary.BigEndian.PutUint32(rec[4:8], crc32.ChecksumIEEE(rec[spoolRecordHeaderLen:]))
+	binary.BigEndian.PutUint64(rec[8:16], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint16(rec[16:18], uint16(len("req")))
+
+	got, n, err := readSpoolRecord(bytes.NewReader(rec), 0, int64(len(rec)))
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(int64(len(rec)), n)
+	assert.Equal("req", got.requestID)
+	assert.Equal("hello", string(got.body))
+	assert.True(got.queuedAt.IsZero())
+	assert.False(got.trace.IsValid())
+}
+
+func TestSpoolTruncatesTornRecordOnOpen(t *testing.T) {
+	assert := assert.New(t)
+	config, cleanup := spoolConfig(t)
+	defer cleanup()
+	config.SpoolSegmentBytes = 1 << 20
+
+	s, err := newSpool(config, make(chan payload, 10))
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NoError(s.Deliver(NewPayload("", "", []byte("one"))))
+	seg := s.segments[len(s.segments)-1]
+	s.Close()
+
+	// A crash part way through appending the second record
+	torn := encodeSpoolRecord(time.Now(), NewPayload("", "", []byte("two")))
+	f, _ := os.OpenFile(s.segmentPath(seg.id), os.O_WRONLY|os.O_APPEND, 0600)
+	f.Write(torn[:len(torn)-1])
+	f.Close()
+
+	inbox := make(chan payload, 10)
+	s, err = newSpool(config, inbox)
+	if !assert.NoError(err) {
+		return
+	}
+	defer s.Close()
+	assert.Equal(int64(1), s.corrupt.Count())
+	if fi, err := os.Stat(s.segmentPath(seg.id)); assert.NoError(err) {
+		assert.Equal(int64(len(encodeSpoolRecord(time.Now(), NewPayload("", "", []byte("one"))))), fi.Size())
+	}
+	assert.NoError(s.Deliver(NewPayload("", "", []byte("three"))))
+
+	go s.Run()
+	assert.Equal([]string{"one", "three"}, drain(t, inbox, 2))
+	assert.Equal(int64(1), s.corrupt.Count(), "nothing after the torn record is skipped")
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/heroku/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Messages received over syslog are fixed and delivered in batches of
+	// up to this many messages or bytes.
+	syslogBatchMessages = 100
+	syslogBatchBytes    = 64 * 1024
+
+	// How long a UDP batch waits for more datagrams before it's delivered.
+	syslogUDPBatchWait = 100 * time.Millisecond
+
+	syslogHandshakeTimeout = 10 * time.Second
+)
+
+var errSyslogMessageTooLong = errors.New("message too long")
+
+// syslogServer accepts RFC 5424 messages over TCP, TLS and UDP, as an
+// alternative to POSTing them to /logs. Messages go through the same
+// FixerFunc and deliverer as those received over HTTP.
+//
+// TCP and TLS connections may use either octet-counted or non-transparent
+// (LF) framing, per RFC 6587, detected for each message. Each UDP datagram
+// is a single message. Senders are authenticated by their source address
+// being in an allowed CIDR, or, for TLS, by presenting a client certificate
+// signed by the configured CA.
+type syslogServer struct {
+	Config         IssConfig
+	FixerFunc      FixerFunc
+	shutdownCh     shutdownCh
+	deliverer      deliverer
+	allowed        []*net.IPNet
+	tlsConfig      *tls.Config
+	req            *http.Request // stands in for the HTTP request FixerFunc expects
+	isShuttingDown bool
+	listeners      []io.Closer
+	conns          map[net.Conn]struct{}
+	connsMu        sync.Mutex
+	protocols      map[string]*syslogMetrics
+	sync.WaitGroup
+}
+
+type syslogMetrics struct {
+	connections  metrics.Counter // tracks the number of accepted connections
+	authFailures metrics.Counter // tracks the number of connections or datagrams that failed authentication
+	received     metrics.Counter // tracks the number of messages received
+	sent         metrics.Counter // tracks the number of messages delivered
+	errors       metrics.Counter // tracks the number of framing, fixing and delivery errors
+}
+
+func newSyslogServer(config IssConfig, fixerFunc FixerFunc, deliverer deliverer) (*syslogServer, error) {
+	s := &syslogServer{
+		Config:     config,
+		FixerFunc:  fixerFunc,
+		deliverer:  deliverer,
+		shutdownCh: make(shutdownCh),
+		conns:      make(map[net.Conn]struct{}),
+		protocols:  make(map[string]*syslogMetrics),
+	}
+
+	for _, cidr := range config.SyslogAllowedCIDRs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid syslog CIDR: %s", err)
+		}
+		s.allowed = append(s.allowed, n)
+	}
+
+	if (config.SyslogTcpPort != "" || config.SyslogUdpPort != "") && len(s.allowed) == 0 {
+		return nil, errors.New("SYSLOG_ALLOWED_CIDRS must be set to use the syslog TCP or UDP listeners")
+	}
+
+	if config.SyslogTlsPort != "" {
+		cert, err := tls.LoadX509KeyPair(config.SyslogTlsCertFile, config.SyslogTlsKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load syslog TLS certificate: %s", err)
+		}
+		s.tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+
+		if config.SyslogTlsClientCAFile != "" {
+			pemFileData, err := ioutil.ReadFile(config.SyslogTlsClientCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to read syslog client CA file: %s", err)
+			}
+			cp := x509.NewCertPool()
+			if ok := cp.AppendCertsFromPEM(pemFileData); !ok {
+				return nil, fmt.Errorf("Error parsing PEM: %s", config.SyslogTlsClientCAFile)
+			}
+			s.tlsConfig.ClientCAs = cp
+			s.tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		} else if len(s.allowed) == 0 {
+			return nil, errors.New("SYSLOG_TLS_CLIENT_CA_FILE or SYSLOG_ALLOWED_CIDRS must be set to use the syslog TLS listener")
+		}
+	}
+
+	// The request is shared by every connection, so its form is parsed up
+	// front rather than lazily, and concurrently, by FormValue
+	req, err := http.NewRequest("POST", "/syslog", http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.ParseForm(); err != nil {
+		return nil, err
+	}
+	s.req = req
+
+	for _, proto := range []string{"tcp", "tls", "udp"} {
+		me := "log-iss.syslog." + proto
+		s.protocols[proto] = &syslogMetrics{
+			connections:  metrics.GetOrRegisterCounter(me+".connections.g", config.MetricsRegistry),
+			authFailures: metrics.GetOrRegisterCounter(me+".auth.failures.g", config.MetricsRegistry),
+			received:     metrics.GetOrRegisterCounter(me+".logs.received.g", config.MetricsRegistry),
+			sent:         metrics.GetOrRegisterCounter(me+".logs.sent.g", config.MetricsRegistry),
+			errors:       metrics.GetOrRegisterCounter(me+".errors.g", config.MetricsRegistry),
+		}
+	}
+
+	return s, nil
+}
+
+// Enabled returns true if any syslog listener is configured.
+func (s *syslogServer) Enabled() bool {
+	return s.Config.SyslogTcpPort != "" || s.Config.SyslogTlsPort != "" || s.Config.SyslogUdpPort != ""
+}
+
+// ShutdownCh returns the channel to signal shutdown on, or nil if no listener
+// is configured, as then Run isn't called to receive on it.
+func (s *syslogServer) ShutdownCh() shutdownCh {
+	if !s.Enabled() {
+		return nil
+	}
+	return s.shutdownCh
+}
+
+// Run starts the configured listeners and returns once they're listening.
+func (s *syslogServer) Run() error {
+	go s.awaitShutdown()
+
+	if s.Config.SyslogTcpPort != "" {
+		l, err := net.Listen("tcp", ":"+s.Config.SyslogTcpPort)
+		if err != nil {
+			return err
+		}
+		s.serve("tcp", l)
+	}
+
+	if s.Config.SyslogTlsPort != "" {
+		l, err := tls.Listen("tcp", ":"+s.Config.SyslogTlsPort, s.tlsConfig)
+		if err != nil {
+			return err
+		}
+		s.serve("tls", l)
+	}
+
+	if s.Config.SyslogUdpPort != "" {
+		c, err := net.ListenPacket("udp", ":"+s.Config.SyslogUdpPort)
+		if err != nil {
+			return err
+		}
+		s.serveUDP(c)
+	}
+
+	return nil
+}
+
+func (s *syslogServer) awaitShutdown() {
+	<-s.shutdownCh
+
+	s.connsMu.Lock()
+	s.isShuttingDown = true
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	// Unblock reads so that connections deliver what they have and close
+	for c := range s.conns {
+		c.SetReadDeadline(time.Now())
+	}
+	s.connsMu.Unlock()
+
+	log.WithFields(log.Fields{"ns": "syslog", "at": "shutdown"}).Info()
+}
+
+// trackListener records a listener to close on shutdown. Returns false if
+// we're already shutting down.
+func (s *syslogServer) trackListener(l io.Closer) bool {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	if s.isShuttingDown {
+		l.Close()
+		return false
+	}
+	s.listeners = append(s.listeners, l)
+	return true
+}
+
+// trackConn records a connection to stop reading from on shutdown, and adds
+// it to the WaitGroup. Returns false if we're already shutting down.
+func (s *syslogServer) trackConn(c net.Conn) bool {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	if s.isShuttingDown {
+		c.Close()
+		return false
+	}
+	s.conns[c] = struct{}{}
+	s.Add(1)
+	return true
+}
+
+func (s *syslogServer) untrack(c net.Conn) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	delete(s.conns, c)
+}
+
+func (s *syslogServer) serve(proto string, l net.Listener) {
+	if !s.trackListener(l) {
+		return
+	}
+	log.WithFields(log.Fields{"ns": "syslog", "at": "listen", "proto": proto, "addr": l.Addr().String()}).Info()
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Temporary() {
+					continue
+				}
+				return
+			}
+			if !s.trackConn(c) {
+				return
+			}
+			go s.handleConn(proto, c)
+		}
+	}()
+}
+
+// authenticate returns the credential for a sender, or nil if it isn't
+// allowed to send logs.
+func (s *syslogServer) authenticate(addr net.Addr, state *tls.ConnectionState) *credential {
+	if state != nil && len(state.VerifiedChains) > 0 {
+		return &credential{Name: state.PeerCertificates[0].Subject.CommonName, Stage: "syslog-tls"}
+	}
+
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	}
+	for _, n := range s.allowed {
+		if ip != nil && n.Contains(ip) {
+			return &credential{Name: n.String(), Stage: "syslog-cidr"}
+		}
+	}
+	return nil
+}
+
+func addrIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+func (s *syslogServer) handleConn(proto string, c net.Conn) {
+	defer s.Done()
+	defer s.untrack(c)
+	defer c.Close()
+
+	m := s.protocols[proto]
+	m.connections.Inc(1)
+	remoteAddr := addrIP(c.RemoteAddr())
+	logFields := log.Fields{"ns": "syslog", "proto": proto, "remote_addr": remoteAddr}
+
+	var state *tls.ConnectionState
+	if tc, ok := c.(*tls.Conn); ok {
+		tc.SetDeadline(time.Now().Add(syslogHandshakeTimeout))
+		if err := tc.Handshake(); err != nil {
+			m.errors.Inc(1)
+			log.WithFields(logFields).WithField("at", "handshake-failure").Info(err)
+			return
+		}
+		tc.SetDeadline(time.Time{})
+		cs := tc.ConnectionState()
+		state = &cs
+	}
+
+	cred := s.authenticate(c.RemoteAddr(), state)
+	if cred == nil {
+		m.authFailures.Inc(1)
+		log.WithFields(logFields).WithField("at", "auth-failure").Info()
+		return
+	}
+
+	br := bufio.NewReaderSize(c, syslogBatchBytes)
+	var batch bytes.Buffer
+	messages := 0
+	for {
+		msg, err := readSyslogMessage(br, s.Config.SyslogMaxMessageBytes)
+		if err == nil && len(msg) > 0 {
+			m.received.Inc(1)
+			appendLogplexFrame(&batch, msg)
+			messages++
+		}
+
+		if messages > 0 && (err != nil || br.Buffered() == 0 || messages >= syslogBatchMessages || batch.Len() >= syslogBatchBytes) {
+			s.process(proto, &batch, messages, remoteAddr, cred)
+			batch.Reset()
+			messages = 0
+		}
+
+		if err != nil {
+			if err != io.EOF && !isTimeout(err) {
+				m.errors.Inc(1)
+				log.WithFields(logFields).WithField("at", "read-error").Info(err)
+			}
+			return
+		}
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// readSyslogMessage reads a single message framed per RFC 6587: octet
+// counting if it starts with a digit, otherwise terminated by a newline.
+func readSyslogMessage(br *bufio.Reader, maxBytes int) ([]byte, error) {
+	first, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if first[0] >= '0' && first[0] <= '9' {
+		n, err := readSyslogLength(br, maxBytes)
+		if err != nil {
+			return nil, err
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(br, msg); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		return msg, nil
+	}
+
+	var msg []byte
+	for {
+		line, err := br.ReadSlice('\n')
+		msg = append(msg, line...)
+		if len(msg) > maxBytes+1 {
+			return nil, errSyslogMessageTooLong
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && len(msg) > 0 {
+			return bytes.TrimSuffix(msg, []byte("\r")), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		msg = bytes.TrimSuffix(msg, []byte("\n"))
+		return bytes.TrimSuffix(msg, []byte("\r")), nil
+	}
+}
+
+// readSyslogLength reads an octet count and the space after it a digit at a
+// time, so a count that's too long or isn't a number is rejected before it's
+// buffered.
+func readSyslogLength(br *bufio.Reader, maxBytes int) (int, error) {
+	n := 0
+	for digits := 0; ; digits++ {
+		c, err := br.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		switch {
+		case c == ' ' && digits > 0:
+			return n, nil
+		case c < '0' || c > '9' || (c == '0' && digits == 0):
+			return 0, fmt.Errorf("invalid message length: unexpected %q", c)
+		}
+		n = n*10 + int(c-'0')
+		if n > maxBytes {
+			return 0, errSyslogMessageTooLong
+		}
+	}
+}
+
+// appendLogplexFrame frames a syslog message the way logplex does, so it can
+// be handed to FixerFunc.
+func appendLogplexFrame(w *bytes.Buffer, msg []byte) {
+	w.WriteString(strconv.Itoa(len(msg)))
+	w.WriteString(" ")
+	w.Write(msg)
+}
+
+func (s *syslogServer) serveUDP(c net.PacketConn) {
+	if !s.trackListener(c) {
+		return
+	}
+	log.WithFields(log.Fields{"ns": "syslog", "at": "listen", "proto": "udp", "addr": c.LocalAddr().String()}).Info()
+
+	s.Add(1)
+	go func() {
+		defer s.Done()
+
+		m := s.protocols["udp"]
+		buf := make([]byte, 65536)
+		batches := make(map[string]*syslogUDPBatch)
+		var deadline time.Time
+
+		for {
+			if len(batches) > 0 {
+				c.SetReadDeadline(deadline)
+			} else {
+				c.SetReadDeadline(time.Time{})
+			}
+
+			n, addr, err := c.ReadFrom(buf)
+			msg := bytes.TrimRight(buf[:n], "\r\n")
+			if err == nil && len(msg) > 0 {
+				cred := s.authenticate(addr, nil)
+				if cred == nil {
+					m.authFailures.Inc(1)
+					continue
+				}
+				m.received.Inc(1)
+
+				remoteAddr := addrIP(addr)
+				b, ok := batches[remoteAddr]
+				if !ok {
+					if len(batches) == 0 {
+						deadline = time.Now().Add(syslogUDPBatchWait)
+					}
+					b = &syslogUDPBatch{cred: cred}
+					batches[remoteAddr] = b
+				}
+				appendLogplexFrame(&b.buf, msg)
+				b.messages++
+			}
+
+			if err != nil || time.Now().After(deadline) {
+				for remoteAddr, b := range batches {
+					s.process("udp", &b.buf, b.messages, remoteAddr, b.cred)
+				}
+				batches = make(map[string]*syslogUDPBatch)
+			}
+
+			if err != nil && !isTimeout(err) {
+				return
+			}
+		}
+	}()
+}
+
+type syslogUDPBatch struct {
+	buf      bytes.Buffer
+	messages int
+	cred     *credential
+}
+
+func (s *syslogServer) process(proto string, batch *bytes.Buffer, messages int, remoteAddr string, cred *credential) {
+	s.Add(1)
+	defer s.Done()
+
+	m := s.protocols[proto]
+	logFields := log.Fields{"ns": "syslog", "proto": proto, "remote_addr": remoteAddr}
+
+	body := batch.Bytes()
+	err := s.fixAndDeliver(m, logFields, body, messages, remoteAddr, cred)
+	if err == nil {
+		return
+	}
+	if messages == 1 {
+		m.errors.Inc(1)
+		log.WithFields(logFields).WithFields(log.Fields{"at": "fix-error", "messages": messages}).Error(err)
+		return
+	}
+
+	// One malformed message mustn't cost the rest of the batch, so they're
+	// fixed one at a time to find it
+	for _, frame := range splitLogplexFrames(body) {
+		if err := s.fixAndDeliver(m, logFields, frame, 1, remoteAddr, cred); err != nil {
+			m.errors.Inc(1)
+			log.WithFields(logFields).WithFields(log.Fields{"at": "fix-error", "messages": 1}).Error(err)
+		}
+	}
+}
+
+// fixAndDeliver fixes and delivers a batch of logplex frames, returning any
+// error from FixerFunc. Delivery errors are counted and logged here.
+func (s *syslogServer) fixAndDeliver(m *syslogMetrics, logFields log.Fields, body []byte, messages int, remoteAddr string, cred *credential) error {
+	r, err := s.FixerFunc(s.req, bytes.NewReader(body), remoteAddr, "", s.Config.MetadataId, cred, &s.Config)
+	if err != nil {
+		return err
+	}
+
+	p := NewPayload(remoteAddr, "", r.bytes)
+	p.NumLogs = r.numLogs - r.routedLogs
+	p.Routes = r.routes
+	if err := s.deliverer.Deliver(p); err != nil {
+		m.errors.Inc(1)
+		log.WithFields(logFields).WithFields(log.Fields{"at": "deliver-error", "messages": messages}).Error(err)
+		return nil
+	}
+	r.dedup.Commit()
+	m.sent.Inc(r.numLogs)
+	return nil
+}
+
+// splitLogplexFrames splits a batch built by appendLogplexFrame back into
+// its frames.
+func splitLogplexFrames(body []byte) [][]byte {
+	var frames [][]byte
+	for len(body) > 0 {
+		sp := bytes.IndexByte(body, ' ')
+		n, _ := strconv.Atoi(string(body[:sp]))
+		frames = append(frames, body[:sp+1+n])
+		body = body[sp+1+n:]
+	}
+	return frames
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/heroku/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+// captureDeliverer records delivered payloads.
+type captureDeliverer struct {
+	sync.Mutex
+	bodies []string
+}
+
+func (d *captureDeliverer) Deliver(p payload) error {
+	d.Lock()
+	defer d.Unlock()
+	d.bodies = append(d.bodies, string(p.Body))
+	return nil
+}
+
+func (d *captureDeliverer) Bodies() []string {
+	d.Lock()
+	defer d.Unlock()
+	return append([]string(nil), d.bodies...)
+}
+
+func (d *captureDeliverer) waitFor(t *testing.T, n int) []string {
+	for i := 0; i < 200; i++ {
+		if b := d.Bodies(); len(b) >= n {
+			return b
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d deliveries, got %v", n, d.Bodies())
+	return nil
+}
+
+func freePort(t *testing.T, network string) string {
+	var addr string
+	if network == "udp" {
+		c, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr = c.LocalAddr().String()
+		c.Close()
+	} else {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr = l.Addr().String()
+		l.Close()
+	}
+	_, port, _ := net.SplitHostPort(addr)
+	return port
+}
+
+func syslogTestConfig(t *testing.T) IssConfig {
+	config := *getConfig()
+	config.MetricsRegistry = metrics.NewRegistry()
+	config.SyslogAllowedCIDRs = []string{"127.0.0.0/8"}
+	config.SyslogMaxMessageBytes = 1024
+	return config
+}
+
+func TestReadSyslogMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	in := "14 <13>1 - - - -\n<14>1 lf framed\r\n9 <15>1 a b<16>1 no trailing newline"
+	br := bufio.NewReader(strings.NewReader(in))
+
+	var msgs []string
+	for {
+		msg, err := readSyslogMessage(br, 1024)
+		if err != nil {
+			break
+		}
+		msgs = append(msgs, string(msg))
+	}
+	assert.Equal([]string{"<13>1 - - - -\n", "<14>1 lf framed", "<15>1 a b", "<16>1 no trailing newline"}, msgs)
+
+	_, err := readSyslogMessage(bufio.NewReader(strings.NewReader("2000 <13>1")), 1024)
+	assert.Equal(errSyslogMessageTooLong, err)
+
+	_, err = readSyslogMessage(bufio.NewReader(strings.NewReader(strings.Repeat("a", 2000)+"\n")), 1024)
+	assert.Equal(errSyslogMessageTooLong, err)
+
+	_, err = readSyslogMessage(bufio.NewReader(strings.NewReader("12 <13>1")), 1024)
+	assert.Error(err)
+
+	// Lengths are rejected before they're read in full
+	r := strings.NewReader(strings.Repeat("9", 1<<20))
+	_, err = readSyslogMessage(bufio.NewReaderSize(r, 16), 1024)
+	assert.Equal(errSyslogMessageTooLong, err)
+	assert.True(r.Len() > 1<<19)
+
+	for in, unexpected := range map[string]string{"12a <13>1": "'a'", "01 <13>1": "'0'", "1\n<13>1": "'\\n'"} {
+		_, err = readSyslogMessage(bufio.NewReader(strings.NewReader(in)), 1024)
+		assert.EqualError(err, "invalid message length: unexpected "+unexpected, in)
+	}
+}
+
+func TestSyslogServerTCP(t *testing.T) {
+	assert := assert.New(t)
+	config := syslogTestConfig(t)
+	config.SyslogTcpPort = freePort(t, "tcp")
+
+	d := &captureDeliverer{}
+	s, err := newSyslogServer(config, fix, d)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.True(s.Enabled())
+	assert.NoError(s.Run())
+
+	c, err := net.Dial("tcp", "127.0.0.1:"+config.SyslogTcpPort)
+	if !assert.NoError(err) {
+		return
+	}
+	fmt.Fprint(c, "64 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - - hi\n")
+	fmt.Fprint(c, "<13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - - hello\n")
+	c.Close()
+
+	bodies := d.waitFor(t, 1)
+	assert.Equal("86 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [origin ip=\"127.0.0.1\"] hi\n"+
+		"88 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [origin ip=\"127.0.0.1\"] hello",
+		strings.Join(bodies, ""))
+	assert.Equal(int64(2), s.protocols["tcp"].received.Count())
+
+	s.shutdownCh <- struct{}{}
+	s.Wait()
+}
+
+// A malformed message is dropped without the rest of its batch.
+func TestSyslogServerMalformedMessage(t *testing.T) {
+	assert := assert.New(t)
+	config := syslogTestConfig(t)
+	config.SyslogTcpPort = freePort(t, "tcp")
+
+	// Batches are fixed whole, so one that includes the malformed message
+	// fails
+	fixer := func(req *http.Request, r io.Reader, remoteAddr string, drainToken string, metadataId string, cred *credential, config *IssConfig) (fixResult, error) {
+		b, _ := ioutil.ReadAll(r)
+		if bytes.Contains(b, []byte("garbage")) {
+			return fixResult{}, errors.New("malformed message")
+		}
+		return fix(req, bytes.NewReader(b), remoteAddr, drainToken, metadataId, cred, config)
+	}
+
+	d := &captureDeliverer{}
+	s, err := newSyslogServer(config, fixer, d)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NoError(s.Run())
+
+	c, err := net.Dial("tcp", "127.0.0.1:"+config.SyslogTcpPort)
+	if !assert.NoError(err) {
+		return
+	}
+	fmt.Fprint(c, "<13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - - hi\n"+
+		"garbage\n"+
+		"<13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - - bye\n")
+	c.Close()
+
+	bodies := d.waitFor(t, 2)
+	assert.Equal("85 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [origin ip=\"127.0.0.1\"] hi"+
+		"86 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [origin ip=\"127.0.0.1\"] bye",
+		strings.Join(bodies, ""))
+
+	s.shutdownCh <- struct{}{}
+	s.Wait()
+	m := s.protocols["tcp"]
+	assert.Equal(int64(3), m.received.Count())
+	assert.Equal(int64(2), m.sent.Count())
+	assert.Equal(int64(1), m.errors.Count())
+}
+
+func TestSyslogServerUDP(t *testing.T) {
+	assert := assert.New(t)
+	config := syslogTestConfig(t)
+	config.SyslogUdpPort = freePort(t, "udp")
+
+	d := &captureDeliverer{}
+	s, err := newSyslogServer(config, fix, d)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NoError(s.Run())
+
+	c, err := net.Dial("udp", "127.0.0.1:"+config.SyslogUdpPort)
+	if !assert.NoError(err) {
+		return
+	}
+	fmt.Fprint(c, "<13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - - hi\n")
+	c.Close()
+
+	bodies := d.waitFor(t, 1)
+	assert.Equal("85 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [origin ip=\"127.0.0.1\"] hi", bodies[0])
+
+	s.shutdownCh <- struct{}{}
+	s.Wait()
+}
+
+func TestSyslogServerRejectsUnknownSources(t *testing.T) {
+	assert := assert.New(t)
+	config := syslogTestConfig(t)
+	config.SyslogAllowedCIDRs = []string{"10.0.0.0/8"}
+	config.SyslogTcpPort = freePort(t, "tcp")
+
+	d := &captureDeliverer{}
+	s, err := newSyslogServer(config, fix, d)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NoError(s.Run())
+
+	c, err := net.Dial("tcp", "127.0.0.1:"+config.SyslogTcpPort)
+	if !assert.NoError(err) {
+		return
+	}
+	fmt.Fprint(c, "<13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - - hi\n")
+	// The server hangs up on us
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = c.Read(make([]byte, 1))
+	assert.Error(err)
+	c.Close()
+
+	assert.Empty(d.Bodies())
+	assert.Equal(int64(1), s.protocols["tcp"].authFailures.Count())
+
+	s.shutdownCh <- struct{}{}
+	s.Wait()
+}
+
+func TestSyslogServerConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	config := syslogTestConfig(t)
+	config.SyslogAllowedCIDRs = nil
+	config.SyslogTcpPort = "6514"
+	_, err := newSyslogServer(config, fix, &captureDeliverer{})
+	assert.Error(err)
+
+	config.SyslogAllowedCIDRs = []string{"not-a-cidr"}
+	_, err = newSyslogServer(config, fix, &captureDeliverer{})
+	assert.Error(err)
+
+	config = syslogTestConfig(t)
+	s, err := newSyslogServer(config, fix, &captureDeliverer{})
+	assert.NoError(err)
+	assert.False(s.Enabled())
+}
+
+// Connections share the request standing in for an HTTP one, so reading
+// metadata from it mustn't write to it.
+func TestSyslogServerParallelConnections(t *testing.T) {
+	assert := assert.New(t)
+	config := syslogTestConfig(t)
+	config.SyslogTcpPort = freePort(t, "tcp")
+	config.MetadataId = "metadata"
+	config.QueryParams = []string{"index"}
+
+	d := &captureDeliverer{}
+	s, err := newSyslogServer(config, fix, d)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NoError(s.Run())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := net.Dial("tcp", "127.0.0.1:"+config.SyslogTcpPort)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			fmt.Fprint(c, "<13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - - hi\n")
+			c.Close()
+		}()
+	}
+	wg.Wait()
+	d.waitFor(t, 2)
+
+	s.shutdownCh <- struct{}{}
+	s.Wait()
+}
+
+func TestShutdownWithSyslogDisabled(t *testing.T) {
+	s, err := newSyslogServer(IssConfig{MetricsRegistry: metrics.NewRegistry()}, fix, &captureDeliverer{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.False(t, s.Enabled())
+
+	sigCh := make(chan os.Signal, 1)
+	sigCh <- syscall.SIGTERM
+	close(sigCh)
+	mainCh := make(shutdownCh, 1)
+
+	done := make(chan struct{})
+	go func() {
+		notifyShutdown(sigCh, s.ShutdownCh(), mainCh)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("shutdown blocked on the syslog server")
+	}
+	assert.Len(t, mainCh, 1)
+}
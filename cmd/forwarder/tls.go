@@ -0,0 +1,269 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/heroku/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// Values for FORWARD_TLS_VERIFY
+const (
+	tlsVerifyFull = "full" // verify the certificate chain and the server name
+	tlsVerifyCA   = "ca"   // verify the certificate chain only
+	tlsVerifyNone = "none" // don't verify the server certificate at all
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsSettings are the file locations and policy used to build the
+// tls.Config that forwarders use to connect to FORWARD_DEST.
+type tlsSettings struct {
+	CAFile       string
+	CertFile     string
+	KeyFile      string
+	ServerName   string
+	Verify       string
+	MinVersion   uint16
+	CipherSuites []uint16
+}
+
+// tlsReloader builds the tls.Config that forwarders use to connect to
+// FORWARD_DEST and rebuilds it when the certificate files change on disk, so
+// that certificates can be rotated without a restart. It is safe for
+// concurrent use.
+type tlsReloader struct {
+	sync.RWMutex
+	settings       tlsSettings
+	checkInterval  time.Duration
+	config         *tls.Config
+	modTimes       map[string]time.Time
+	checked        time.Time
+	now            func() time.Time
+	reloads        metrics.Counter // counts successful certificate reloads
+	reloadFailures metrics.Counter // counts failed certificate reloads
+}
+
+func newTLSReloader(settings tlsSettings, checkInterval time.Duration, registry metrics.Registry) (*tlsReloader, error) {
+	if settings.Verify == "" {
+		settings.Verify = tlsVerifyFull
+	}
+	switch settings.Verify {
+	case tlsVerifyFull, tlsVerifyCA, tlsVerifyNone:
+	default:
+		return nil, fmt.Errorf("Unknown TLS verify mode: %s", settings.Verify)
+	}
+	if (settings.CertFile == "") != (settings.KeyFile == "") {
+		return nil, fmt.Errorf("Both a TLS certificate and key must be set to use client certificates")
+	}
+
+	tr := &tlsReloader{
+		settings:       settings,
+		checkInterval:  checkInterval,
+		now:            time.Now,
+		reloads:        metrics.GetOrRegisterCounter("log-iss.forwarder.tls.reloads.g", registry),
+		reloadFailures: metrics.GetOrRegisterCounter("log-iss.forwarder.tls.reload.failures.g", registry),
+	}
+
+	config, modTimes, err := tr.load()
+	if err != nil {
+		return nil, err
+	}
+	tr.config = config
+	tr.modTimes = modTimes
+	tr.checked = tr.now()
+	return tr, nil
+}
+
+func (tr *tlsReloader) files() []string {
+	files := make([]string, 0, 3)
+	for _, f := range []string{tr.settings.CAFile, tr.settings.CertFile, tr.settings.KeyFile} {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// load reads the certificate files and builds a tls.Config from them.
+func (tr *tlsReloader) load() (*tls.Config, map[string]time.Time, error) {
+	s := tr.settings
+	modTimes := make(map[string]time.Time)
+	for _, f := range tr.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Unable to read %s: %s", f, err)
+		}
+		modTimes[f] = fi.ModTime()
+	}
+
+	config := &tls.Config{
+		ServerName:   s.ServerName,
+		MinVersion:   s.MinVersion,
+		CipherSuites: s.CipherSuites,
+	}
+
+	if s.CAFile != "" {
+		pemFileData, err := ioutil.ReadFile(s.CAFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Unable to read pemfile: %s", err)
+		}
+
+		cp := x509.NewCertPool()
+		if ok := cp.AppendCertsFromPEM(pemFileData); !ok {
+			return nil, nil, fmt.Errorf("Error parsing PEM: %s", s.CAFile)
+		}
+		config.RootCAs = cp
+	}
+
+	if s.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Unable to load TLS client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	switch s.Verify {
+	case tlsVerifyNone:
+		config.InsecureSkipVerify = true
+	case tlsVerifyCA:
+		// Skip the built in verification, which includes the server name,
+		// and verify the chain ourselves.
+		config.InsecureSkipVerify = true
+		roots := config.RootCAs
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyChain(rawCerts, roots)
+		}
+	}
+
+	return config, modTimes, nil
+}
+
+func verifyChain(rawCerts [][]byte, roots *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("no server certificate presented")
+	}
+
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+	return err
+}
+
+// changed returns true if any of the certificate files have been modified
+// since they were last loaded.
+func (tr *tlsReloader) changed() bool {
+	for _, f := range tr.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			// Possibly mid-rotation; try again on the next check.
+			continue
+		}
+		if !fi.ModTime().Equal(tr.modTimes[f]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Config returns the current tls.Config, first reloading it if the
+// certificate files have changed and it's been at least checkInterval since
+// they were last checked.
+func (tr *tlsReloader) Config() *tls.Config {
+	tr.RLock()
+	due := tr.checkInterval > 0 && tr.now().Sub(tr.checked) >= tr.checkInterval
+	config := tr.config
+	tr.RUnlock()
+
+	if !due {
+		return config
+	}
+
+	tr.Lock()
+	defer tr.Unlock()
+	tr.checked = tr.now()
+	if !tr.changed() {
+		return tr.config
+	}
+	tr.reload()
+	return tr.config
+}
+
+// Reload unconditionally reloads the certificate files.
+func (tr *tlsReloader) Reload() error {
+	tr.Lock()
+	defer tr.Unlock()
+	return tr.reload()
+}
+
+// reload must be called with the lock held. The previous config is kept if
+// the new one can't be loaded.
+func (tr *tlsReloader) reload() error {
+	config, modTimes, err := tr.load()
+	if err != nil {
+		tr.reloadFailures.Inc(1)
+		log.WithFields(log.Fields{"ns": "tls", "at": "reload-failure", "message": err.Error()}).Error()
+		return err
+	}
+
+	tr.config = config
+	tr.modTimes = modTimes
+	tr.reloads.Inc(1)
+	log.WithFields(log.Fields{"ns": "tls", "at": "reload"}).Info()
+	return nil
+}
+
+func parseTLSVersion(v string) (uint16, error) {
+	version, ok := tlsVersions[v]
+	if !ok {
+		return 0, fmt.Errorf("Unknown TLS version: %s", v)
+	}
+	return version, nil
+}
+
+// parseCipherSuites converts cipher suite names, as used by crypto/tls, to
+// their IDs.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	known := make(map[string]uint16)
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[cs.Name] = cs.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("Unknown TLS cipher suite: %s", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/heroku/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func (tc testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	c, err := tls.X509KeyPair(tc.certPEM, tc.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// newTestCert creates a certificate signed by parent, or a self signed CA
+// certificate if parent is nil.
+func newTestCert(t *testing.T, cn string, parent *testCert) testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func writeTestFile(t *testing.T, dir, name string, b []byte) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// tlsTestServer accepts connections that present a client certificate
+// signed by ca, reporting the client's common name on the returned channel.
+func tlsTestServer(t *testing.T, ca testCert, server testCert) (string, chan string, func()) {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{server.tlsCertificate(t)},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clients := make(chan string, 10)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			tc := c.(*tls.Conn)
+			if err := tc.Handshake(); err == nil {
+				clients <- tc.ConnectionState().PeerCertificates[0].Subject.CommonName
+			}
+			c.Close()
+		}
+	}()
+	return l.Addr().String(), clients, func() { l.Close() }
+}
+
+func TestTLSReloaderMutualTLS(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "log-iss-tls")
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", nil)
+	server := newTestCert(t, "syslog.example.com", &ca)
+	client := newTestCert(t, "log-iss", &ca)
+
+	addr, clients, stop := tlsTestServer(t, ca, server)
+	defer stop()
+
+	settings := tlsSettings{
+		CAFile:     writeTestFile(t, dir, "ca.pem", ca.certPEM),
+		CertFile:   writeTestFile(t, dir, "client.pem", client.certPEM),
+		KeyFile:    writeTestFile(t, dir, "client.key", client.keyPEM),
+		ServerName: "syslog.example.com",
+		MinVersion: tls.VersionTLS12,
+	}
+	tr, err := newTLSReloader(settings, time.Minute, metrics.NewRegistry())
+	if !assert.NoError(err) {
+		return
+	}
+
+	c, err := tls.Dial("tcp", addr, tr.Config())
+	if assert.NoError(err) {
+		assert.NoError(c.Handshake())
+		c.Close()
+		assert.Equal("log-iss", <-clients)
+	}
+
+	// Without the server name override, verification fails
+	settings.ServerName = ""
+	tr, err = newTLSReloader(settings, time.Minute, metrics.NewRegistry())
+	assert.NoError(err)
+	_, err = tls.Dial("tcp", addr, tr.Config())
+	assert.Error(err)
+
+	// ... unless only the chain is verified
+	settings.Verify = tlsVerifyCA
+	tr, err = newTLSReloader(settings, time.Minute, metrics.NewRegistry())
+	assert.NoError(err)
+	c, err = tls.Dial("tcp", addr, tr.Config())
+	if assert.NoError(err) {
+		c.Close()
+	}
+
+	// A server signed by another CA is still rejected in that mode
+	otherCA := newTestCert(t, "other-ca", nil)
+	otherServer := newTestCert(t, "syslog.example.com", &otherCA)
+	otherAddr, _, otherStop := tlsTestServer(t, ca, otherServer)
+	defer otherStop()
+	_, err = tls.Dial("tcp", otherAddr, tr.Config())
+	assert.Error(err)
+}
+
+func TestTLSReloaderReloadsChangedCertificates(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "log-iss-tls")
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", nil)
+	client := newTestCert(t, "log-iss", &ca)
+	settings := tlsSettings{
+		CAFile:   writeTestFile(t, dir, "ca.pem", ca.certPEM),
+		CertFile: writeTestFile(t, dir, "client.pem", client.certPEM),
+		KeyFile:  writeTestFile(t, dir, "client.key", client.keyPEM),
+	}
+
+	registry := metrics.NewRegistry()
+	tr, err := newTLSReloader(settings, time.Minute, registry)
+	if !assert.NoError(err) {
+		return
+	}
+	now := time.Now()
+	tr.now = func() time.Time { return now }
+	first := tr.Config()
+
+	rolled := newTestCert(t, "log-iss-rolled", &ca)
+	writeTestFile(t, dir, "client.pem", rolled.certPEM)
+	writeTestFile(t, dir, "client.key", rolled.keyPEM)
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(settings.CertFile, future, future)
+	os.Chtimes(settings.KeyFile, future, future)
+
+	// Not due for a check yet
+	assert.Equal(first, tr.Config())
+
+	now = now.Add(2 * time.Minute)
+	second := tr.Config()
+	assert.NotEqual(first, second)
+	leaf, _ := x509.ParseCertificate(second.Certificates[0].Certificate[0])
+	assert.Equal("log-iss-rolled", leaf.Subject.CommonName)
+	assert.Equal(int64(1), tr.reloads.Count())
+
+	// A broken key keeps the previous config
+	writeTestFile(t, dir, "client.key", []byte("garbage"))
+	assert.Error(tr.Reload())
+	assert.Equal(second, tr.Config())
+	assert.Equal(int64(1), tr.reloadFailures.Count())
+}
+
+func TestTLSSettingsValidation(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := newTLSReloader(tlsSettings{CertFile: "client.pem"}, 0, metrics.NewRegistry())
+	assert.Error(err)
+
+	_, err = newTLSReloader(tlsSettings{Verify: "sometimes"}, 0, metrics.NewRegistry())
+	assert.Error(err)
+
+	_, err = parseTLSVersion("1.4")
+	assert.Error(err)
+
+	ids, err := parseCipherSuites([]string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"})
+	assert.NoError(err)
+	assert.Equal([]uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, ids)
+
+	_, err = parseCipherSuites([]string{"TLS_MADE_UP"})
+	assert.Error(err)
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	mrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/heroku/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// Span kinds, as numbered by OTLP
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+)
+
+// spanStatusError is the OTLP status code for failed spans
+const spanStatusError = 2
+
+const (
+	traceBatchSize     = 512
+	traceQueueSize     = 2048
+	traceFlushInterval = 5 * time.Second
+)
+
+type traceID [16]byte
+type spanID [8]byte
+
+// spanContext identifies a span, and is what gets propagated in the W3C
+// traceparent header.
+type spanContext struct {
+	TraceID traceID
+	SpanID  spanID
+	Sampled bool
+}
+
+func (sc spanContext) IsValid() bool {
+	return sc.TraceID != traceID{} && sc.SpanID != spanID{}
+}
+
+// Traceparent formats sc as a version 00 traceparent header.
+func (sc spanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + flags
+}
+
+// parseTraceparent parses a traceparent header per
+// https://www.w3.org/TR/trace-context/#traceparent-header
+func parseTraceparent(h string) (spanContext, bool) {
+	var sc spanContext
+
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	// Version 00 has exactly four fields, later versions may add more
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	if _, err := hex.Decode(make([]byte, 1), []byte(parts[0])); err != nil {
+		return sc, false
+	}
+
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return sc, false
+	}
+	sc.Sampled = flags&1 == 1
+
+	return sc, sc.IsValid()
+}
+
+type spanAttribute struct {
+	Key   string
+	Value interface{} // string, int, int64, bool or float64
+}
+
+// span is a single timed operation. All methods are safe to call on a nil
+// *span, which is what's used when tracing is disabled.
+type span struct {
+	tracer     *tracer
+	Name       string
+	Kind       int
+	Context    spanContext
+	Parent     spanID
+	StartTime  time.Time
+	EndTime    time.Time
+	Attributes []spanAttribute
+	Status     int
+	StatusMsg  string
+}
+
+// SpanContext returns the span's context, or the zero value for a nil span.
+func (s *span) SpanContext() spanContext {
+	if s == nil {
+		return spanContext{}
+	}
+	return s.Context
+}
+
+func (s *span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.Attributes = append(s.Attributes, spanAttribute{key, value})
+}
+
+// SetError marks the span as failed if err isn't nil.
+func (s *span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.Status = spanStatusError
+	s.StatusMsg = err.Error()
+}
+
+func (s *span) End() {
+	s.EndAt(time.Now())
+}
+
+// EndAt ends the span at t and queues it for export if it's sampled.
+func (s *span) EndAt(t time.Time) {
+	if s == nil || s.tracer == nil {
+		return
+	}
+	s.EndTime = t
+	if s.Context.Sampled {
+		s.tracer.enqueue(s)
+	}
+}
+
+type spanContextKey struct{}
+
+// spanFromContext returns the span stored in ctx, or nil.
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanContextKey{}).(*span)
+	return s
+}
+
+// startSpan starts a child of the span in ctx, with the same tracer. It
+// returns a nil span if there's no span in ctx.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	parent := spanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	return parent.tracer.Start(ctx, name, kind)
+}
+
+// spanExporter sends finished spans somewhere.
+type spanExporter interface {
+	ExportSpans(spans []*span) error
+}
+
+// tracer creates spans and exports the sampled ones in batches. All methods
+// are safe to call on a nil *tracer, which is what's used when tracing is
+// disabled.
+type tracer struct {
+	Exporter    spanExporter
+	SampleRatio float64 // fraction of traces started here that are sampled
+
+	queue    chan *span
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+
+	exported metrics.Counter // counts exported spans
+	dropped  metrics.Counter // counts spans dropped because the queue was full
+	errors   metrics.Counter // counts failed exports
+}
+
+func newTracer(exporter spanExporter, sampleRatio float64, registry metrics.Registry) *tracer {
+	t := &tracer{
+		Exporter:    exporter,
+		SampleRatio: sampleRatio,
+		queue:       make(chan *span, traceQueueSize),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+		exported:    metrics.GetOrRegisterCounter("log-iss.tracing.exported.g", registry),
+		dropped:     metrics.GetOrRegisterCounter("log-iss.tracing.dropped.g", registry),
+		errors:      metrics.GetOrRegisterCounter("log-iss.tracing.errors.g", registry),
+	}
+	go t.run()
+	return t
+}
+
+// Extract returns ctx with the remote parent from a traceparent header, if
+// the header is valid, for spans started from it.
+func (t *tracer) Extract(ctx context.Context, traceparent string) context.Context {
+	if t == nil {
+		return ctx
+	}
+	sc, ok := parseTraceparent(traceparent)
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, spanContextKey{}, &span{tracer: t, Context: sc})
+}
+
+// Start starts a span as a child of the span in ctx, or a new trace if
+// there isn't one, and returns a copy of ctx holding the new span.
+func (t *tracer) Start(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if t == nil {
+		return ctx, nil
+	}
+	s := t.StartAt(spanFromContext(ctx).SpanContext(), name, kind, time.Now())
+	return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+// StartAt starts a span as a child of parent, or a new trace if parent isn't
+// valid, as of start.
+func (t *tracer) StartAt(parent spanContext, name string, kind int, start time.Time) *span {
+	if t == nil {
+		return nil
+	}
+
+	s := &span{tracer: t, Name: name, Kind: kind, StartTime: start}
+	if parent.IsValid() {
+		s.Context.TraceID = parent.TraceID
+		s.Context.Sampled = parent.Sampled
+		s.Parent = parent.SpanID
+	} else {
+		rand.Read(s.Context.TraceID[:])
+		s.Context.Sampled = mrand.Float64() < t.SampleRatio
+	}
+	rand.Read(s.Context.SpanID[:])
+	return s
+}
+
+func (t *tracer) enqueue(s *span) {
+	select {
+	case t.queue <- s:
+	default:
+		t.dropped.Inc(1)
+	}
+}
+
+func (t *tracer) run() {
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+	defer close(t.done)
+
+	batch := make([]*span, 0, traceBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.Exporter.ExportSpans(batch); err != nil {
+			t.errors.Inc(1)
+			log.WithFields(log.Fields{"ns": "tracing", "at": "export-error", "spans": len(batch)}).Error(err)
+		} else {
+			t.exported.Inc(int64(len(batch)))
+		}
+		batch = make([]*span, 0, traceBatchSize)
+	}
+
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) >= traceBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-t.stop:
+			for {
+				select {
+				case s := <-t.queue:
+					batch = append(batch, s)
+					if len(batch) >= traceBatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// Shutdown exports any spans still queued.
+func (t *tracer) Shutdown() {
+	if t == nil {
+		return
+	}
+	t.stopOnce.Do(func() { close(t.stop) })
+	<-t.done
+}
+
+// otlpExporter sends spans to an OpenTelemetry collector using OTLP/HTTP
+// with JSON encoding.
+type otlpExporter struct {
+	URL         string // eg. http://localhost:4318/v1/traces
+	ServiceName string
+	Client      *http.Client
+}
+
+func newOTLPExporter(endpoint string, serviceName string) *otlpExporter {
+	return &otlpExporter{
+		URL:         strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		ServiceName: serviceName,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+// otlpValue converts an attribute value to an OTLP AnyValue. 64 bit integers
+// are strings in the JSON encoding.
+func otlpValue(v interface{}) map[string]interface{} {
+	switch v := v.(type) {
+	case string:
+		return map[string]interface{}{"stringValue": v}
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": v}
+	default:
+		return map[string]interface{}{"stringValue": fmt.Sprint(v)}
+	}
+}
+
+func (e *otlpExporter) encode(spans []*span) ([]byte, error) {
+	var rs otlpResourceSpans
+	rs.Resource.Attributes = []otlpKeyValue{{Key: "service.name", Value: otlpValue(e.ServiceName)}}
+
+	var ss otlpScopeSpans
+	ss.Scope.Name = "log-iss"
+	for _, s := range spans {
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.Context.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.Context.SpanID[:]),
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.StartTime.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.EndTime.UnixNano(), 10),
+			Status:            otlpStatus{Code: s.Status, Message: s.StatusMsg},
+		}
+		if s.Parent != (spanID{}) {
+			o.ParentSpanID = hex.EncodeToString(s.Parent[:])
+		}
+		for _, a := range s.Attributes {
+			o.Attributes = append(o.Attributes, otlpKeyValue{Key: a.Key, Value: otlpValue(a.Value)})
+		}
+		ss.Spans = append(ss.Spans, o)
+	}
+	rs.ScopeSpans = []otlpScopeSpans{ss}
+
+	return json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{rs}})
+}
+
+func (e *otlpExporter) ExportSpans(spans []*span) error {
+	body, err := e.encode(spans)
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.Client.Post(e.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("OTLP export to %s failed with status %d", e.URL, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/heroku/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryExporter keeps exported spans for tests.
+type memoryExporter struct {
+	sync.Mutex
+	spans []*span
+}
+
+func (e *memoryExporter) ExportSpans(spans []*span) error {
+	e.Lock()
+	defer e.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+// Spans returns the exported spans by name.
+func (e *memoryExporter) Spans() map[string]*span {
+	e.Lock()
+	defer e.Unlock()
+	m := make(map[string]*span)
+	for _, s := range e.spans {
+		m[s.Name] = s
+	}
+	return m
+}
+
+func newTestTracer() (*tracer, *memoryExporter) {
+	e := &memoryExporter{}
+	return newTracer(e, 1, metrics.NewRegistry()), e
+}
+
+func spanAttr(s *span, key string) interface{} {
+	for _, a := range s.Attributes {
+		if a.Key == key {
+			return a.Value
+		}
+	}
+	return nil
+}
+
+func TestParseTraceparent(t *testing.T) {
+	assert := assert.New(t)
+
+	h := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := parseTraceparent(h)
+	assert.True(ok)
+	assert.True(sc.Sampled)
+	assert.Equal(h, sc.Traceparent())
+
+	sc, ok = parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	assert.True(ok)
+	assert.False(sc.Sampled)
+
+	// Future versions may carry more fields
+	_, ok = parseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra")
+	assert.True(ok)
+
+	for _, h := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01",
+	} {
+		_, ok = parseTraceparent(h)
+		assert.False(ok, h)
+	}
+}
+
+func TestTracerSampling(t *testing.T) {
+	assert := assert.New(t)
+	tr, e := newTestTracer()
+	tr.SampleRatio = 0
+
+	_, root := tr.Start(context.Background(), "root", spanKindInternal)
+	root.End()
+
+	// A sampled remote parent is followed regardless of the ratio
+	ctx := tr.Extract(context.Background(), "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, parent := tr.Start(ctx, "parent", spanKindServer)
+	_, child := startSpan(ctx, "child", spanKindInternal)
+	child.End()
+	parent.End()
+
+	tr.Shutdown()
+	spans := e.Spans()
+	assert.Len(spans, 2)
+	assert.Equal("4bf92f3577b34da6a3ce929d0e0e4736", spans["parent"].Context.Traceparent()[3:35])
+	assert.Equal(parent.Context.SpanID, spans["child"].Parent)
+	assert.Equal(parent.Context.TraceID, spans["child"].Context.TraceID)
+}
+
+func TestNilTracer(t *testing.T) {
+	var tr *tracer
+	ctx, s := tr.Start(context.Background(), "nothing", spanKindInternal)
+	s.SetAttribute("key", "value")
+	s.End()
+	_, s = startSpan(ctx, "nothing", spanKindInternal)
+	assert.Nil(t, s)
+	tr.Shutdown()
+}
+
+func TestHTTPProcessSpans(t *testing.T) {
+	assert := assert.New(t)
+	config := getConfig()
+	tr, e := newTestTracer()
+	config.Tracer = tr
+	d := &captureDeliverer{}
+	s := newHTTPServer(*config, nil, fix, d)
+
+	ctx, root := tr.Start(context.Background(), "POST /logs", spanKindServer)
+	req := simpleHttpRequest().WithContext(ctx)
+	in := []byte("64 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - - hi\n")
+	err, _ := s.process(req, bytes.NewReader(in), "1.2.3.4", "", "", "", nil)
+	assert.NoError(err)
+	root.End()
+
+	tr.Shutdown()
+	spans := e.Spans()
+	fixSpan := spans["FixerFunc"]
+	if assert.NotNil(fixSpan) {
+		assert.Equal(root.Context.SpanID, fixSpan.Parent)
+		assert.Equal(int64(1), spanAttr(fixSpan, "log_iss.log_count"))
+		assert.Equal(int64(0), spanAttr(fixSpan, "log_iss.truncations"))
+		assert.NotNil(spanAttr(fixSpan, "log_iss.bytes"))
+	}
+	assert.Equal(int64(1), spanAttr(spans["POST /logs"], "log_iss.log_count"))
+}
+
+func TestAuthenticateSpan(t *testing.T) {
+	assert := assert.New(t)
+	tr, e := newTestTracer()
+	ba := defaultCreds()
+
+	ctx, root := tr.Start(context.Background(), "POST /logs", spanKindServer)
+	req, _ := http.NewRequest("POST", "/logs", nil)
+	req.SetBasicAuth("user", "password")
+	assert.NotNil(ba.Authenticate(req.WithContext(ctx)))
+	root.End()
+
+	tr.Shutdown()
+	s := e.Spans()["BasicAuth.Authenticate"]
+	if assert.NotNil(s) {
+		assert.Equal(root.Context.SpanID, s.Parent)
+		assert.Equal("user", spanAttr(s, "log_iss.auth_user"))
+		assert.Equal(true, spanAttr(s, "log_iss.authenticated"))
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	assert := assert.New(t)
+
+	var got otlpRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("/v1/traces", r.URL.Path)
+		assert.Equal("application/json", r.Header.Get("Content-Type"))
+		b, _ := ioutil.ReadAll(r.Body)
+		assert.NoError(json.Unmarshal(b, &got))
+	}))
+	defer srv.Close()
+
+	tr, _ := newTestTracer()
+	defer tr.Shutdown()
+	s := tr.StartAt(spanContext{}, "forwarder.write", spanKindInternal, time.Unix(1, 0))
+	s.SetAttribute("log_iss.forwarder_id", 3)
+	s.SetError(errQueueFull)
+	s.EndTime = time.Unix(2, 0)
+
+	e := newOTLPExporter(srv.URL+"/", "log-iss-test")
+	assert.NoError(e.ExportSpans([]*span{s}))
+
+	if assert.Len(got.ResourceSpans, 1) {
+		rs := got.ResourceSpans[0]
+		assert.Equal("log-iss-test", rs.Resource.Attributes[0].Value["stringValue"])
+		o := rs.ScopeSpans[0].Spans[0]
+		assert.Equal("forwarder.write", o.Name)
+		assert.Equal("1000000000", o.StartTimeUnixNano)
+		assert.Equal("2000000000", o.EndTimeUnixNano)
+		assert.Equal("", o.ParentSpanID)
+		assert.Len(o.TraceID, 32)
+		assert.Equal("3", o.Attributes[0].Value["intValue"])
+		assert.Equal(spanStatusError, o.Status.Code)
+	}
+
+	srv.Close()
+	assert.Error(e.ExportSpans([]*span{s}))
+}
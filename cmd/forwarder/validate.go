@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/heroku/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// Values for VALIDATION_MODE
+const (
+	validationOff    = "off"    // forward frames without checking them
+	validationWarn   = "warn"   // count and log violations, forwarding frames as they are
+	validationRepair = "repair" // fix violations where possible, dropping frames that can't be
+	validationReject = "reject" // drop frames with violations
+)
+
+// Kinds of violation, as used in metric names
+const (
+	violationPri            = "pri"
+	violationVersion        = "version"
+	violationTimestamp      = "timestamp"
+	violationHostname       = "hostname"
+	violationAppname        = "app_name"
+	violationProcid         = "procid"
+	violationMsgid          = "msgid"
+	violationStructuredData = "structured_data"
+	violationLength         = "length"
+)
+
+var violationKinds = []string{
+	violationPri, violationVersion, violationTimestamp, violationHostname,
+	violationAppname, violationProcid, violationMsgid, violationStructuredData,
+	violationLength,
+}
+
+// Priority given to frames whose PRI can't be repaired, user.notice, as RFC
+// 3164 section 4.3.3 has relays do for messages without one.
+const repairPriority = 13
+
+// invalidFramesError is returned for requests with frames that failed
+// validation in reject mode when VALIDATION_REJECT_REQUESTS is set.
+type invalidFramesError struct {
+	Frames []invalidFrame
+}
+
+// invalidFrame is a frame that failed validation, by its index in the request.
+type invalidFrame struct {
+	Index      int
+	Violations []string
+}
+
+func (e invalidFramesError) Error() string {
+	frames := make([]string, len(e.Frames))
+	for i, f := range e.Frames {
+		frames[i] = fmt.Sprintf("%d (%s)", f.Index, strings.Join(f.Violations, ","))
+	}
+	return "invalid frames: " + strings.Join(frames, ", ")
+}
+
+// validator checks fixed frames against RFC 5424 before they are forwarded,
+// counting violations by kind. It is safe for concurrent use.
+type validator struct {
+	Mode           string
+	RejectRequests bool // in reject mode, fail the whole request rather than dropping frames
+	violations     map[string]metrics.Counter
+	invalidFrames  metrics.Counter // counts frames with at least one violation
+	repaired       metrics.Counter // counts frames that were repaired
+	dropped        metrics.Counter // counts frames that were dropped
+	rejections     metrics.Counter // counts requests that were refused
+}
+
+func newValidator(mode string, rejectRequests bool, registry metrics.Registry) (*validator, error) {
+	switch mode {
+	case validationOff, validationWarn, validationRepair, validationReject:
+	default:
+		return nil, fmt.Errorf("Unknown validation mode: %s", mode)
+	}
+
+	v := &validator{
+		Mode:           mode,
+		RejectRequests: rejectRequests,
+		violations:     make(map[string]metrics.Counter, len(violationKinds)),
+		invalidFrames:  metrics.GetOrRegisterCounter("log-iss.validation.invalid_frames.g", registry),
+		repaired:       metrics.GetOrRegisterCounter("log-iss.validation.repaired.g", registry),
+		dropped:        metrics.GetOrRegisterCounter("log-iss.validation.dropped.g", registry),
+		rejections:     metrics.GetOrRegisterCounter("log-iss.validation.rejections.g", registry),
+	}
+	for _, kind := range violationKinds {
+		v.violations[kind] = metrics.GetOrRegisterCounter(fmt.Sprintf("log-iss.validation.violations.%s.g", kind), registry)
+	}
+	return v, nil
+}
+
+// enabled returns true if frames should be checked at all.
+func (v *validator) enabled() bool {
+	return v != nil && v.Mode != validationOff
+}
+
+// Check validates f, the frame at index in its request, and handles any
+// violations according to Mode, repairing f in place in repair mode. Returns
+// the violations found, and whether f should be forwarded.
+func (v *validator) Check(f *syslogFrame, index int, now time.Time) ([]string, bool) {
+	violations := frameViolations(f)
+	if len(violations) == 0 {
+		return nil, true
+	}
+
+	v.invalidFrames.Inc(1)
+	for _, kind := range violations {
+		v.violations[kind].Inc(1)
+	}
+
+	keep := true
+	switch v.Mode {
+	case validationWarn:
+		log.WithFields(log.Fields{"ns": "validate", "at": "violation", "frame": index, "violations": strings.Join(violations, ",")}).Warn()
+	case validationRepair:
+		repairFrame(f, now)
+		if keep = len(frameViolations(f)) == 0; keep {
+			v.repaired.Inc(1)
+		}
+	case validationReject:
+		keep = false
+	}
+	if !keep {
+		v.dropped.Inc(1)
+	}
+	return violations, keep
+}
+
+// frameViolations lists the ways f doesn't conform to RFC 5424.
+func frameViolations(f *syslogFrame) []string {
+	var violations []string
+
+	pri, version := splitPrivalVersion(f.PrivalVersion)
+	if _, ok := parsePrival(pri); !ok {
+		violations = append(violations, violationPri)
+	}
+	if string(version) != "1" {
+		violations = append(violations, violationVersion)
+	}
+	if !validTimestamp(f.Time) {
+		violations = append(violations, violationTimestamp)
+	}
+
+	for _, h := range []struct {
+		kind  string
+		value []byte
+	}{
+		{violationHostname, f.Hostname},
+		{violationAppname, f.Appname},
+		{violationProcid, f.Procid},
+		{violationMsgid, f.Msgid},
+	} {
+		if !validHeaderField(h.value) {
+			violations = append(violations, h.kind)
+		}
+	}
+
+	if !validMsgStructuredData(f.Msg) {
+		violations = append(violations, violationStructuredData)
+	}
+
+	// The message of a frame whose octet count doesn't cover its header is
+	// lost, so this can't be repaired
+	if f.LengthMismatch {
+		violations = append(violations, violationLength)
+	}
+	return violations
+}
+
+// splitPrivalVersion splits "<PRI>VERSION" after the closing bracket.
+func splitPrivalVersion(b []byte) ([]byte, []byte) {
+	i := bytes.IndexByte(b, '>')
+	if i < 0 {
+		return b, nil
+	}
+	return b[:i+1], b[i+1:]
+}
+
+// validTimestamp returns true for the NILVALUE or an RFC 3339 timestamp as
+// restricted by RFC 5424 section 6.2.3: upper case "T" and "Z", and at most
+// six digits of fractional seconds.
+func validTimestamp(b []byte) bool {
+	if len(b) == 1 && b[0] == '-' {
+		return true
+	}
+	if bytes.ContainsAny(b, "tz") {
+		return false
+	}
+	if i := bytes.IndexByte(b, '.'); i >= 0 {
+		digits := 0
+		for _, c := range b[i+1:] {
+			if c < '0' || c > '9' {
+				break
+			}
+			digits++
+		}
+		if digits == 0 || digits > 6 {
+			return false
+		}
+	}
+	_, err := time.Parse(time.RFC3339Nano, string(b))
+	return err == nil
+}
+
+// validHeaderField returns true if b is a non-empty header field of printable
+// US-ASCII, per RFC 5424 section 6. Lengths are left to truncateField.
+func validHeaderField(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	for _, c := range b {
+		if c < 33 || c > 126 {
+			return false
+		}
+	}
+	return true
+}
+
+// validMsgStructuredData returns true if msg starts with well-formed
+// STRUCTURED-DATA, followed by nothing or a space and the MSG. An empty msg
+// is fine, as the structured data added by log-iss comes before it.
+func validMsgStructuredData(msg []byte) bool {
+	if len(msg) == 0 {
+		return true
+	}
+	elements, rest, err := parseStructuredData(msg)
+	if err != nil {
+		return false
+	}
+	if len(rest) > 0 && rest[0] != ' ' {
+		return false
+	}
+	for _, e := range elements {
+		if !validSDName(e.ID) {
+			return false
+		}
+		for _, p := range e.Params {
+			if !validSDName(p.Name) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// repairFrame replaces the parts of f that violate RFC 5424: a bad PRI with
+// repairPriority, a bad version with 1, a bad timestamp with now, invalid
+// characters in header fields with '_' and empty ones with the NILVALUE.
+// Malformed structured data is kept as part of the MSG, after a NILVALUE.
+func repairFrame(f *syslogFrame, now time.Time) {
+	pri, version := splitPrivalVersion(f.PrivalVersion)
+	_, priOK := parsePrival(pri)
+	if !priOK || string(version) != "1" {
+		if !priOK {
+			pri = []byte("<" + strconv.Itoa(repairPriority) + ">")
+		}
+		f.PrivalVersion = append(append([]byte{}, pri...), '1')
+	}
+
+	if !validTimestamp(f.Time) {
+		f.Time = []byte(now.UTC().Format(jsonTimeFormat))
+	}
+
+	for _, h := range []*[]byte{&f.Hostname, &f.Appname, &f.Procid, &f.Msgid} {
+		if !validHeaderField(*h) {
+			*h = repairHeaderField(*h)
+		}
+	}
+
+	if !validMsgStructuredData(f.Msg) {
+		msg := make([]byte, 0, len(f.Msg)+2)
+		msg = append(msg, nilVal...)
+		f.Msg = append(msg, f.Msg...)
+	}
+}
+
+func repairHeaderField(b []byte) []byte {
+	if len(b) == 0 {
+		return nilVal[:1]
+	}
+	out := make([]byte, len(b))
+	for i, c := range b {
+		if c < 33 || c > 126 {
+			c = '_'
+		}
+		out[i] = c
+	}
+	return out
+}
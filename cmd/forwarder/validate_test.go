@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/heroku/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+// logplexFrames octet-counts each of msgs into a logplex body.
+func logplexFrames(msgs ...string) []byte {
+	var b bytes.Buffer
+	for _, m := range msgs {
+		fmt.Fprintf(&b, "%d %s", len(m), m)
+	}
+	return b.Bytes()
+}
+
+const validFrame = "<13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [meta sequenceId=\"hello\"] hi\n"
+
+func TestFrameViolations(t *testing.T) {
+	for name, tc := range map[string]struct {
+		msg        string
+		violations []string
+	}{
+		"valid":                 {validFrame, nil},
+		"nil values":            {"<13>1 - - - - - - hi\n", nil},
+		"no message":            {"<13>1 2013-06-07T13:17:49Z host heroku web.7 - ", nil},
+		"pri out of range":      {"<192>1 2013-06-07T13:17:49Z host heroku web.7 - - hi", []string{violationPri}},
+		"missing pri":           {"1 2013-06-07T13:17:49Z host heroku web.7 - - hi", []string{violationPri, violationVersion}},
+		"version":               {"<13>2 2013-06-07T13:17:49Z host heroku web.7 - - hi", []string{violationVersion}},
+		"rfc 3164 timestamp":    {"<13>1 Jun__7_13:17:49 host heroku web.7 - - hi", []string{violationTimestamp}},
+		"lower case t":          {"<13>1 2013-06-07t13:17:49Z host heroku web.7 - - hi", []string{violationTimestamp}},
+		"nanoseconds":           {"<13>1 2013-06-07T13:17:49.123456789Z host heroku web.7 - - hi", []string{violationTimestamp}},
+		"non-ascii hostname":    {"<13>1 2013-06-07T13:17:49Z hôst heroku web.7 - - hi", []string{violationHostname}},
+		"control char msgid":    {"<13>1 2013-06-07T13:17:49Z host heroku web.7 a\x01b - hi", []string{violationMsgid}},
+		"missing sd":            {"<13>1 2013-06-07T13:17:49Z host heroku web.7 - hi", []string{violationStructuredData}},
+		"unterminated sd":       {"<13>1 2013-06-07T13:17:49Z host heroku web.7 - [meta a=\"b] hi", []string{violationStructuredData}},
+		"no space after sd":     {"<13>1 2013-06-07T13:17:49Z host heroku web.7 - [meta a=\"b\"]hi", []string{violationStructuredData}},
+		"invalid sd param name": {"<13>1 2013-06-07T13:17:49Z host heroku web.7 - [meta " + strings.Repeat("a", 33) + "=\"b\"] hi", []string{violationStructuredData}},
+	} {
+		lp := newLpxFrame(t, tc.msg)
+		assert.Equal(t, tc.violations, frameViolations(&lp), name)
+	}
+}
+
+// newLpxFrame reads msg into a syslogFrame the way fix does.
+func newLpxFrame(t *testing.T, msg string) syslogFrame {
+	var frame syslogFrame
+	config := &IssConfig{OutputEncoder: &outputEncoder{
+		Format: func(w *bytes.Buffer, f *syslogFrame) { frame = *f },
+		Frame:  func(dst *bytes.Buffer, msg *bytes.Buffer) {},
+	}}
+	if _, err := fix(simpleHttpRequest(), bytes.NewReader(logplexFrames(msg)), "", "", "", nil, config); err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func TestValidatorModes(t *testing.T) {
+	assert := assert.New(t)
+	invalid := "<13>1 Jun__7_13:17:49 host heroku web.7 - - hi\n"
+	body := logplexFrames(validFrame, invalid)
+
+	for _, tc := range []struct {
+		mode             string
+		numLogs          int64
+		repaired         int64
+		dropped          int64
+		invalidTimestamp bool
+	}{
+		{validationOff, 2, 0, 0, true},
+		{validationWarn, 2, 0, 0, true},
+		{validationRepair, 2, 1, 0, false},
+		{validationReject, 1, 0, 1, false},
+	} {
+		registry := metrics.NewRegistry()
+		v, err := newValidator(tc.mode, false, registry)
+		if !assert.NoError(err) {
+			return
+		}
+		config := &IssConfig{Validator: v}
+		r, err := fix(simpleHttpRequest(), bytes.NewReader(body), "1.2.3.4", "", "", nil, config)
+		if !assert.NoError(err, tc.mode) {
+			continue
+		}
+
+		assert.Equal(tc.numLogs, r.numLogs, tc.mode)
+		assert.Equal(tc.invalidTimestamp, strings.Contains(string(r.bytes), "Jun__7"), tc.mode)
+		assert.Equal(tc.repaired, v.repaired.Count(), tc.mode)
+		assert.Equal(tc.dropped, v.dropped.Count(), tc.mode)
+		if tc.mode != validationOff {
+			assert.Equal([]invalidFrame{{Index: 1, Violations: []string{violationTimestamp}}}, r.invalidFrames, tc.mode)
+			assert.Equal(int64(1), v.violations[violationTimestamp].Count(), tc.mode)
+		}
+	}
+}
+
+func TestValidatorLengthMismatch(t *testing.T) {
+	assert := assert.New(t)
+	header := "<13>1 2013-06-07T13:17:49Z host heroku web.7 - "
+
+	// A frame counting fewer octets than its header has them all read anyway
+	body := append(logplexFrames(validFrame), fmt.Sprintf("%d %s", len(header)-5, header)...)
+	body = append(body, logplexFrames(validFrame)...)
+	for _, mode := range []string{validationWarn, validationRepair} {
+		v, _ := newValidator(mode, false, metrics.NewRegistry())
+		r, err := fix(simpleHttpRequest(), bytes.NewReader(body), "1.2.3.4", "", "", nil, &IssConfig{Validator: v})
+		if !assert.NoError(err, mode) {
+			continue
+		}
+		assert.Equal([]invalidFrame{{Index: 1, Violations: []string{violationLength}}}, r.invalidFrames, mode)
+		assert.Equal(int64(1), v.violations[violationLength].Count(), mode)
+		if mode == validationRepair {
+			assert.Equal(int64(2), r.numLogs, "the lost message can't be repaired")
+			assert.Equal(int64(1), v.dropped.Count())
+		}
+	}
+
+	// As does one with a negative count
+	v, _ := newValidator(validationWarn, false, metrics.NewRegistry())
+	r, err := fix(simpleHttpRequest(), bytes.NewReader([]byte("-1 "+header)), "1.2.3.4", "", "", nil, &IssConfig{Validator: v})
+	if assert.NoError(err) {
+		assert.Equal([]invalidFrame{{Index: 0, Violations: []string{violationLength}}}, r.invalidFrames)
+	}
+}
+
+func TestValidatorRejectRequests(t *testing.T) {
+	assert := assert.New(t)
+	v, _ := newValidator(validationReject, true, metrics.NewRegistry())
+	config := &IssConfig{Validator: v}
+	body := logplexFrames(
+		"<13>2 2013-06-07T13:17:49Z host heroku web.7 - - hi\n",
+		validFrame,
+		"<13>1 2013-06-07T13:17:49Z host heroku web.7 - hi\n",
+	)
+
+	_, err := fix(simpleHttpRequest(), bytes.NewReader(body), "1.2.3.4", "", "", nil, config)
+	assert.EqualError(err, "invalid frames: 0 (version), 2 (structured_data)")
+	assert.Equal(int64(1), v.rejections.Count())
+
+	_, err = fix(simpleHttpRequest(), bytes.NewReader(logplexFrames(validFrame)), "1.2.3.4", "", "", nil, config)
+	assert.NoError(err)
+}
+
+func TestRepairFrame(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Date(2020, 1, 2, 3, 4, 5, 6000, time.UTC)
+	f := syslogFrame{
+		PrivalVersion: []byte("<999>7"),
+		Time:          []byte("yesterday"),
+		Hostname:      []byte("hôst"),
+		Appname:       []byte("app"),
+		Procid:        []byte{},
+		Msgid:         []byte("-"),
+		Msg:           []byte("[oops hi"),
+	}
+	repairFrame(&f, now)
+	assert.Nil(frameViolations(&f))
+	assert.Equal("<13>1", string(f.PrivalVersion))
+	assert.Equal("2020-01-02T03:04:05.000006Z", string(f.Time))
+	assert.Equal("h__st", string(f.Hostname))
+	assert.Equal("-", string(f.Procid))
+	assert.Equal("- [oops hi", string(f.Msg))
+}
+
+func TestNewValidatorUnknownMode(t *testing.T) {
+	_, err := newValidator("strict", false, metrics.NewRegistry())
+	assert.Error(t, err)
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// credential is a credential as stored in the Redis hash, a JSON array of
+// which is kept per user. It must match the credential type of
+// cmd/forwarder, which reads them.
+type credential struct {
+	Name            string     `json:"name"`
+	Stage           string     `json:"stage"`
+	Deprecated      bool       `json:"deprecated"`
+	Hmac            string     `json:"hmac"`
+	RateLimit       string     `json:"rate_limit,omitempty"`
+	NotBefore       *time.Time `json:"not_before,omitempty"`
+	ExpiresAt       *time.Time `json:"expires_at,omitempty"`
+	DeprecatedAfter *time.Time `json:"deprecated_after,omitempty"`
+}
+
+// hashStore is the subset of Redis commands admin uses.
+type hashStore interface {
+	HGet(key, field string) *redis.StringCmd
+	HGetAll(key string) *redis.StringStringMapCmd
+	Eval(script string, keys []string, args ...interface{}) *redis.Cmd
+	Publish(channel string, message interface{}) *redis.IntCmd
+}
+
+// compareAndSetScript replaces the field ARGV[1] of the hash KEYS[1] with
+// ARGV[3], or removes it if that's empty, as long as it still holds ARGV[2],
+// where empty means it's missing. It returns 1 if the field was replaced, and
+// 0 if it had been changed in the meantime.
+const compareAndSetScript = `
+local current = redis.call('HGET', KEYS[1], ARGV[1]) or ''
+if current ~= ARGV[2] then
+  return 0
+end
+if ARGV[3] == '' then
+  redis.call('HDEL', KEYS[1], ARGV[1])
+else
+  redis.call('HSET', KEYS[1], ARGV[1], ARGV[3])
+end
+return 1
+`
+
+// maxUpdateAttempts is how many times a change is tried when the
+// credentials keep being changed concurrently.
+const maxUpdateAttempts = 5
+
+// errConflict is returned by store when the credentials it would replace
+// were changed since they were loaded.
+var errConflict = errors.New("The credentials were changed concurrently")
+
+// admin manages the credentials log-iss reads from a Redis hash.
+type admin struct {
+	Client  hashStore
+	Key     string // the Redis hash, REDIS_KEY
+	HmacKey string
+	Channel string    // announces changes, as CREDENTIAL_CHANNEL, if set
+	DryRun  bool      // print changes instead of making them
+	In      io.Reader // passwords are read from, rather than taken as arguments
+	Out     io.Writer
+	rand    io.Reader
+	now     func() time.Time
+}
+
+func newAdmin(client hashStore, key string, hmacKey string, out io.Writer) *admin {
+	return &admin{
+		Client:  client,
+		Key:     key,
+		HmacKey: hmacKey,
+		Out:     out,
+		rand:    rand.Reader,
+		now:     time.Now,
+	}
+}
+
+// generatePassword returns a random password of n bytes, base64 encoded.
+func (a *admin) generatePassword(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(a.rand, b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// readPassword reads a password from the first line of In, so that it isn't
+// left in the process list or shell history.
+func (a *admin) readPassword() (string, error) {
+	if a.In == nil {
+		return "", errors.New("No password was given")
+	}
+	line, err := bufio.NewReader(a.In).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", errors.New("No password was given")
+	}
+	return password, nil
+}
+
+// Generate prints a new random password and its HMAC.
+func (a *admin) Generate(n int) error {
+	password, err := a.generatePassword(n)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(a.Out, "password: %s\nhmac: %s\n", password, hmacEncode(a.HmacKey, password))
+	return nil
+}
+
+// load returns the credentials stored for user, if any, and the entry they
+// were parsed from, which is empty if there's none.
+func (a *admin) load(user string) ([]credential, string, error) {
+	v, err := a.Client.HGet(a.Key, user).Result()
+	if err == redis.Nil {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	var creds []credential
+	if err := json.Unmarshal([]byte(v), &creds); err != nil {
+		return nil, "", fmt.Errorf("Unable to parse credentials of %s: %s", user, err)
+	}
+	return creds, v, nil
+}
+
+// store replaces the credentials of user, removing the user once none are
+// left, and announces the change on Channel. It returns errConflict, and
+// changes nothing, if the entry for user is no longer old.
+func (a *admin) store(user string, old string, creds []credential) error {
+	if a.DryRun {
+		if len(creds) == 0 {
+			fmt.Fprintf(a.Out, "dry run: would remove %s from %s\n", user, a.Key)
+			return nil
+		}
+		b, err := json.MarshalIndent(creds, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(a.Out, "dry run: would set %s in %s to\n%s\n", user, a.Key, b)
+		return nil
+	}
+
+	var v string
+	if len(creds) > 0 {
+		b, err := json.Marshal(creds)
+		if err != nil {
+			return err
+		}
+		v = string(b)
+	}
+	set, err := a.Client.Eval(compareAndSetScript, []string{a.Key}, user, old, v).Int64()
+	if err != nil {
+		return err
+	}
+	if set == 0 {
+		return errConflict
+	}
+
+	if a.Channel != "" {
+		if err := a.Client.Publish(a.Channel, a.now().Format(time.RFC3339Nano)).Err(); err != nil {
+			return fmt.Errorf("Credentials were changed but not announced: %s", err)
+		}
+	}
+	return nil
+}
+
+// modify stores the credentials f makes from those of user, loading them
+// again and retrying if they're changed by someone else in the meantime, so
+// that concurrent changes aren't lost.
+func (a *admin) modify(user string, f func(creds []credential) ([]credential, error)) error {
+	for attempt := 1; ; attempt++ {
+		creds, old, err := a.load(user)
+		if err != nil {
+			return err
+		}
+		creds, err = f(creds)
+		if err != nil {
+			return err
+		}
+		err = a.store(user, old, creds)
+		if err != errConflict || attempt == maxUpdateAttempts {
+			return err
+		}
+	}
+}
+
+// Add adds cred for user with the given password, generating one if it's
+// empty. A generated password is printed.
+func (a *admin) Add(user string, password string, cred credential) error {
+	if cred.Stage == "" {
+		return errors.New("A stage is required")
+	}
+
+	generated := password == ""
+	if generated {
+		var err error
+		if password, err = a.generatePassword(32); err != nil {
+			return err
+		}
+	}
+	cred.Hmac = hmacEncode(a.HmacKey, password)
+
+	err := a.modify(user, func(creds []credential) ([]credential, error) {
+		for _, c := range creds {
+			if c.Stage == cred.Stage {
+				return nil, fmt.Errorf("%s already has a %s credential", user, cred.Stage)
+			}
+		}
+		return append(creds, cred), nil
+	})
+	if err == nil && generated {
+		fmt.Fprintf(a.Out, "password: %s\n", password)
+	}
+	return err
+}
+
+// update applies f to the credentials of user with the given stage, or all
+// of them if stage is empty, and stores the credentials f keeps.
+func (a *admin) update(user string, stage string, f func(c *credential) (keep bool)) (int, error) {
+	var n int
+	err := a.modify(user, func(creds []credential) ([]credential, error) {
+		kept := make([]credential, 0, len(creds))
+		n = 0
+		for _, c := range creds {
+			if stage == "" || c.Stage == stage {
+				n++
+				if !f(&c) {
+					continue
+				}
+			}
+			kept = append(kept, c)
+		}
+		if n == 0 {
+			return nil, fmt.Errorf("%s has no matching credentials", user)
+		}
+		return kept, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Deprecate marks the credentials of user with the given stage, or all of
+// them if all is set, deprecated, now or, if after isn't zero, from then on.
+// Deprecating every credential has to be asked for, as it includes the one
+// in use.
+func (a *admin) Deprecate(user string, stage string, all bool, after time.Time) (int, error) {
+	if stage == "" && !all {
+		return 0, errors.New("A stage is required, or all to deprecate every credential")
+	}
+	if stage != "" && all {
+		return 0, errors.New("A stage can't be given with all")
+	}
+	return a.update(user, stage, func(c *credential) bool {
+		if after.IsZero() {
+			c.Deprecated = true
+		} else {
+			c.DeprecatedAfter = &after
+		}
+		return true
+	})
+}
+
+// Remove removes the credentials of user with the given stage.
+func (a *admin) Remove(user string, stage string) (int, error) {
+	if stage == "" {
+		return 0, errors.New("A stage is required")
+	}
+	return a.update(user, stage, func(c *credential) bool { return false })
+}
+
+// Verify returns the credential of user that password matches.
+func (a *admin) Verify(user string, password string) (*credential, error) {
+	creds, _, err := a.load(user)
+	if err != nil {
+		return nil, err
+	}
+	h := hmacEncode(a.HmacKey, password)
+	for _, c := range creds {
+		if c.Hmac == h {
+			return &c, nil
+		}
+	}
+	return nil, fmt.Errorf("The password doesn't match any credential of %s", user)
+}
+
+// List prints the credentials of user, or of every user if user is empty,
+// without their HMACs.
+func (a *admin) List(user string) error {
+	all := make(map[string][]credential)
+	if user != "" {
+		creds, _, err := a.load(user)
+		if err != nil {
+			return err
+		}
+		all[user] = creds
+	} else {
+		m, err := a.Client.HGetAll(a.Key).Result()
+		if err != nil {
+			return err
+		}
+		for u, v := range m {
+			var creds []credential
+			if err := json.Unmarshal([]byte(v), &creds); err != nil {
+				return fmt.Errorf("Unable to parse credentials of %s: %s", u, err)
+			}
+			all[u] = creds
+		}
+	}
+
+	users := make([]string, 0, len(all))
+	for u := range all {
+		users = append(users, u)
+	}
+	sort.Strings(users)
+
+	now := a.now()
+	fmt.Fprintln(a.Out, "USER\tSTAGE\tNAME\tSTATUS\tNOT_BEFORE\tEXPIRES_AT\tDEPRECATED_AFTER")
+	for _, u := range users {
+		for _, c := range all[u] {
+			fmt.Fprintf(a.Out, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", u, c.Stage, c.Name, c.status(now),
+				formatTime(c.NotBefore), formatTime(c.ExpiresAt), formatTime(c.DeprecatedAfter))
+		}
+	}
+	return nil
+}
+
+// status describes c as log-iss would treat it at now.
+func (c credential) status(now time.Time) string {
+	switch {
+	case c.NotBefore != nil && now.Before(*c.NotBefore):
+		return "not-yet-valid"
+	case c.ExpiresAt != nil && !now.Before(*c.ExpiresAt):
+		return "expired"
+	case c.Deprecated || (c.DeprecatedAfter != nil && !now.Before(*c.DeprecatedAfter)):
+		return "deprecated"
+	}
+	return "active"
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// parseTime parses an RFC 3339 timestamp, or a duration from now such as
+// "72h".
+func parseTime(s string, now time.Time) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(d).UTC().Truncate(time.Second), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+// testStore is a client of a miniredis server, so admin's scripts run as
+// they would against Redis.
+type testStore struct {
+	*redis.Client
+	m         *miniredis.Miniredis
+	messages  chan string
+	beforeSet func() // called before compareAndSetScript runs, to race it
+}
+
+func newTestStore(t *testing.T) *testStore {
+	m := miniredis.RunT(t)
+	s := &testStore{
+		Client:   redis.NewClient(&redis.Options{Addr: m.Addr()}),
+		m:        m,
+		messages: make(chan string, 16),
+	}
+	sub := m.NewSubscriber()
+	sub.Subscribe("credentials")
+	go func() {
+		for msg := range sub.Messages() {
+			s.messages <- msg.Channel + " " + msg.Message
+		}
+	}()
+	return s
+}
+
+func (s *testStore) Eval(script string, keys []string, args ...interface{}) *redis.Cmd {
+	if s.beforeSet != nil {
+		s.beforeSet()
+	}
+	return s.Client.Eval(script, keys, args...)
+}
+
+// published returns the messages published since it was last called.
+func (s *testStore) published() []string {
+	var messages []string
+	for {
+		select {
+		case msg := <-s.messages:
+			messages = append(messages, msg)
+		case <-time.After(50 * time.Millisecond):
+			return messages
+		}
+	}
+}
+
+func (s *testStore) credentials(t *testing.T, user string) []credential {
+	var creds []credential
+	if v := s.m.HGet("creds", user); v != "" {
+		if err := json.Unmarshal([]byte(v), &creds); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return creds
+}
+
+var testNow = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func newTestAdmin(t *testing.T) (*admin, *testStore, *bytes.Buffer) {
+	store := newTestStore(t)
+	out := new(bytes.Buffer)
+	a := newAdmin(store, "creds", "hmacKey", out)
+	a.rand = strings.NewReader(strings.Repeat("x", 1024))
+	a.now = func() time.Time { return testNow }
+	return a, store, out
+}
+
+func TestAdminGenerate(t *testing.T) {
+	a, _, out := newTestAdmin(t)
+	assert.NoError(t, run(a, []string{"generate", "-bytes", "3"}))
+	assert.Equal(t, "password: eHh4\nhmac: "+hmacEncode("hmacKey", "eHh4")+"\n", out.String())
+}
+
+func TestAdminAdd(t *testing.T) {
+	assert := assert.New(t)
+	a, store, out := newTestAdmin(t)
+	a.Channel = "credentials"
+
+	assert.NoError(run(a, []string{"add", "-stage", "current", "-name", "shuttle", "-expires-at", "24h", "user"}))
+	password := strings.TrimSpace(strings.TrimPrefix(out.String(), "password: "))
+	expires := testNow.Add(24 * time.Hour)
+	assert.Equal([]credential{
+		{Name: "shuttle", Stage: "current", Hmac: hmacEncode("hmacKey", password), ExpiresAt: &expires},
+	}, store.credentials(t, "user"))
+	assert.Equal([]string{"credentials " + testNow.Format(time.RFC3339Nano)}, store.published())
+
+	a.In = strings.NewReader("secret\n")
+	assert.NoError(run(a, []string{"add", "-stage", "next", "-password-stdin", "user"}))
+	creds := store.credentials(t, "user")
+	if assert.Len(creds, 2) {
+		assert.Equal(hmacEncode("hmacKey", "secret"), creds[1].Hmac)
+	}
+
+	assert.Error(run(a, []string{"add", "-stage", "next", "user"}), "the stage is taken")
+	assert.Error(run(a, []string{"add", "user"}), "a stage is required")
+	a.In = strings.NewReader("\n")
+	assert.Error(run(a, []string{"add", "-stage", "other", "-password-stdin", "user"}), "the password is empty")
+	assert.Len(store.credentials(t, "user"), 2)
+}
+
+func TestAdminConcurrentChanges(t *testing.T) {
+	assert := assert.New(t)
+	a, store, _ := newTestAdmin(t)
+	a.Add("user", "old", credential{Stage: "previous"})
+
+	// Someone else adds a credential after ours are loaded, but before
+	// they're stored, which isn't lost
+	other, _, _ := newTestAdmin(t)
+	other.Client = store.Client
+	store.beforeSet = func() {
+		store.beforeSet = nil
+		assert.NoError(other.Add("user", "next", credential{Stage: "next"}))
+	}
+	assert.NoError(a.Add("user", "new", credential{Stage: "current"}))
+	var stages []string
+	for _, c := range store.credentials(t, "user") {
+		stages = append(stages, c.Stage)
+	}
+	assert.Equal([]string{"previous", "next", "current"}, stages)
+
+	// Changes are given up on if they keep conflicting
+	attempts := 0
+	store.beforeSet = func() {
+		attempts++
+		store.m.HSet("creds", "user", strings.Replace(store.m.HGet("creds", "user"), "}", ",\"name\":\"\"}", 1))
+	}
+	_, err := a.Remove("user", "previous")
+	assert.Equal(errConflict, err)
+	assert.Equal(maxUpdateAttempts, attempts)
+	assert.Len(store.credentials(t, "user"), 3)
+}
+
+func TestAdminDeprecateAndRemove(t *testing.T) {
+	assert := assert.New(t)
+	a, store, out := newTestAdmin(t)
+	a.Add("user", "old", credential{Stage: "previous"})
+	a.Add("user", "new", credential{Stage: "current"})
+
+	assert.NoError(run(a, []string{"deprecate", "-stage", "previous", "user"}))
+	assert.Equal("deprecated 1 credentials\n", out.String())
+	assert.NoError(run(a, []string{"deprecate", "-stage", "current", "-after", "2020-02-01T00:00:00Z", "user"}))
+	creds := store.credentials(t, "user")
+	if assert.Len(creds, 2) {
+		assert.True(creds[0].Deprecated)
+		assert.False(creds[1].Deprecated)
+		if assert.NotNil(creds[1].DeprecatedAfter) {
+			assert.Equal(time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC), *creds[1].DeprecatedAfter)
+		}
+	}
+	assert.Error(run(a, []string{"deprecate", "-stage", "missing", "user"}))
+	assert.Error(run(a, []string{"deprecate", "user"}), "a stage or -all is required")
+	assert.Error(run(a, []string{"deprecate", "-all", "-stage", "current", "user"}))
+	assert.NoError(run(a, []string{"deprecate", "-all", "user"}))
+	assert.True(store.credentials(t, "user")[1].Deprecated)
+
+	assert.NoError(run(a, []string{"remove", "-stage", "previous", "user"}))
+	assert.Len(store.credentials(t, "user"), 1)
+	assert.Error(run(a, []string{"remove", "user"}), "a stage is required")
+
+	// The user is removed with their last credential
+	assert.NoError(run(a, []string{"remove", "-stage", "current", "user"}))
+	assert.False(store.m.Exists("creds"))
+}
+
+func TestAdminDryRun(t *testing.T) {
+	assert := assert.New(t)
+	a, store, out := newTestAdmin(t)
+	a.Channel = "credentials"
+
+	a.In = strings.NewReader("secret\n")
+	assert.NoError(run(a, []string{"add", "-dry-run", "-stage", "current", "-password-stdin", "user"}))
+	assert.Contains(out.String(), "dry run: would set user in creds to")
+	assert.Contains(out.String(), hmacEncode("hmacKey", "secret"))
+	assert.False(store.m.Exists("creds"))
+	assert.Empty(store.published())
+
+	a.DryRun = false
+	a.Add("user", "secret", credential{Stage: "current"})
+	store.published()
+	out.Reset()
+	assert.NoError(run(a, []string{"remove", "-dry-run", "-stage", "current", "user"}))
+	assert.Contains(out.String(), "dry run: would remove user from creds")
+	assert.Len(store.credentials(t, "user"), 1)
+	assert.Empty(store.published())
+}
+
+func TestAdminVerify(t *testing.T) {
+	assert := assert.New(t)
+	a, _, out := newTestAdmin(t)
+	a.Add("user", "secret", credential{Stage: "current", ExpiresAt: &testNow})
+
+	a.In = strings.NewReader("secret\n")
+	assert.NoError(run(a, []string{"verify", "user"}))
+	assert.Equal("ok: stage current, expired\n", out.String())
+	a.In = strings.NewReader("wrong\n")
+	assert.Error(run(a, []string{"verify", "user"}))
+	a.In = strings.NewReader("secret")
+	assert.Error(run(a, []string{"verify", "nobody"}))
+	assert.Error(run(a, []string{"verify", "user", "secret"}), "passwords aren't taken as arguments")
+}
+
+func TestAdminList(t *testing.T) {
+	assert := assert.New(t)
+	a, _, out := newTestAdmin(t)
+	later := testNow.Add(time.Hour)
+	a.Add("b", "secret", credential{Stage: "current", Name: "shuttle"})
+	a.Add("a", "secret", credential{Stage: "next", NotBefore: &later})
+	a.Add("a", "other", credential{Stage: "previous", Deprecated: true})
+
+	assert.NoError(run(a, []string{"list"}))
+	assert.Equal(`USER	STAGE	NAME	STATUS	NOT_BEFORE	EXPIRES_AT	DEPRECATED_AFTER
+a	next		not-yet-valid	2020-01-02T04:04:05Z	-	-
+a	previous		deprecated	-	-	-
+b	current	shuttle	active	-	-	-
+`, out.String())
+	assert.NotContains(out.String(), hmacEncode("hmacKey", "secret"))
+
+	out.Reset()
+	assert.NoError(run(a, []string{"list", "b"}))
+	assert.Equal(2, strings.Count(out.String(), "\n"))
+}
+
+func TestAdminErrors(t *testing.T) {
+	assert := assert.New(t)
+	a, store, _ := newTestAdmin(t)
+	store.m.SetError("connection refused")
+	assert.EqualError(a.Add("user", "secret", credential{Stage: "current"}), "connection refused")
+	assert.Error(a.List(""))
+
+	// Credential subcommands need Redis
+	a.Client = nil
+	assert.Error(run(a, []string{"list"}))
+
+	// Hashing passwords needs the key log-iss uses
+	a, store, out := newTestAdmin(t)
+	a.HmacKey = ""
+	for _, args := range [][]string{{"generate"}, {"add", "-stage", "current", "user"}, {"verify", "user"}, {"hmac", "secret"}, {"secret"}} {
+		a.In = strings.NewReader("secret\n")
+		assert.EqualError(run(a, args), "HMAC_KEY must be set to hash passwords", args[0])
+	}
+	assert.Empty(out.String())
+	assert.Empty(store.credentials(t, "user"))
+	assert.NoError(run(a, []string{"list"}))
+}
+
+func TestAdminHash(t *testing.T) {
+	assert := assert.New(t)
+	a, _, out := newTestAdmin(t)
+	assert.NoError(run(a, []string{"password"}))
+	assert.Equal(hmacEncode("hmacKey", "password"), out.String())
+
+	// Passwords named like subcommands need hmac
+	out.Reset()
+	assert.NoError(run(a, []string{"hmac", "list"}))
+	assert.Equal(hmacEncode("hmacKey", "list"), out.String())
+
+	out.Reset()
+	a.In = strings.NewReader("generate\r\n")
+	assert.NoError(run(a, []string{"hmac"}))
+	assert.Equal(hmacEncode("hmacKey", "generate"), out.String())
+}
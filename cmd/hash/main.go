@@ -4,17 +4,40 @@ import (
 	"crypto/hmac"
 	"crypto/sha512"
 	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"time"
 
+	"github.com/go-redis/redis"
 	"github.com/joeshaw/envdecode"
 )
 
 type AuthConfig struct {
-	HmacKey string `env:"HMAC_KEY"`
+	HmacKey           string `env:"HMAC_KEY"`
+	RedisUrl          string `env:"REDIS_URL"`
+	RedisKey          string `env:"REDIS_KEY"`
+	CredentialChannel string `env:"CREDENTIAL_CHANNEL"`
 }
 
+const usage = `Usage:
+  hash hmac [PASSWORD]            print the HMAC of PASSWORD, read from stdin if not given
+  hash PASSWORD                   print the HMAC of PASSWORD, unless it's a subcommand
+  hash generate [-bytes N]        print a random password and its HMAC
+  hash add [flags] USER           add a credential for USER, generating a password unless -password-stdin is given
+  hash list [USER]                list the credentials of USER, or of everyone
+  hash deprecate [flags] USER     deprecate the credentials of USER with -stage STAGE, or -all of them
+  hash remove -stage STAGE USER   remove the credentials of USER with STAGE
+  hash verify USER                check a password read from stdin against the credentials of USER
+
+Subcommands that change credentials take -dry-run to print the result instead.
+HMAC_KEY, REDIS_URL and REDIS_KEY are read from the environment, and changes
+are announced on CREDENTIAL_CHANNEL if set. Subcommands that hash passwords
+fail without HMAC_KEY.
+`
+
 func hmacEncode(key string, value string) string {
 	secret := []byte(key)
 	message := []byte(value)
@@ -23,6 +46,172 @@ func hmacEncode(key string, value string) string {
 	return hex.EncodeToString(hash.Sum(nil))
 }
 
+// timeFlag is a flag holding an RFC 3339 timestamp or a duration from now.
+type timeFlag struct {
+	a *admin
+	t time.Time
+}
+
+func (f *timeFlag) String() string {
+	if f.t.IsZero() {
+		return ""
+	}
+	return f.t.Format(time.RFC3339)
+}
+
+func (f *timeFlag) Set(s string) error {
+	t, err := parseTime(s, f.a.now())
+	f.t = t
+	return err
+}
+
+func (f *timeFlag) ptr() *time.Time {
+	if f.t.IsZero() {
+		return nil
+	}
+	return &f.t
+}
+
+// run runs the subcommand in args with a.
+func run(a *admin, args []string) error {
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	fs.SetOutput(a.Out)
+
+	switch args[0] {
+	case "add", "list", "deprecate", "remove", "verify":
+		if a.Client == nil || a.Key == "" {
+			return errors.New("REDIS_URL and REDIS_KEY must be set to manage credentials")
+		}
+	}
+
+	// A hash made without the key log-iss uses could never match
+	switch args[0] {
+	case "list", "deprecate", "remove":
+	default:
+		if a.HmacKey == "" {
+			return errors.New("HMAC_KEY must be set to hash passwords")
+		}
+	}
+
+	switch args[0] {
+	case "generate":
+		n := fs.Int("bytes", 32, "random bytes in the password")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		return a.Generate(*n)
+
+	case "add":
+		fs.BoolVar(&a.DryRun, "dry-run", false, "print changes instead of making them")
+		var cred credential
+		var notBefore, expiresAt, deprecatedAfter = &timeFlag{a: a}, &timeFlag{a: a}, &timeFlag{a: a}
+		passwordStdin := fs.Bool("password-stdin", false, "read the password from stdin instead of generating one")
+		fs.StringVar(&cred.Stage, "stage", "", "stage of the credential, eg. current")
+		fs.StringVar(&cred.Name, "name", "", "name of the credential")
+		fs.BoolVar(&cred.Deprecated, "deprecated", false, "add the credential deprecated")
+		fs.StringVar(&cred.RateLimit, "rate-limit", "", "rate limit for the user, as in RATE_LIMITS")
+		fs.Var(notBefore, "not-before", "time, or duration from now, the credential is valid from")
+		fs.Var(expiresAt, "expires-at", "time, or duration from now, the credential expires")
+		fs.Var(deprecatedAfter, "deprecated-after", "time, or duration from now, the credential is deprecated")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			return errors.New(usage)
+		}
+		cred.NotBefore, cred.ExpiresAt, cred.DeprecatedAfter = notBefore.ptr(), expiresAt.ptr(), deprecatedAfter.ptr()
+		var password string
+		if *passwordStdin {
+			var err error
+			if password, err = a.readPassword(); err != nil {
+				return err
+			}
+		}
+		return a.Add(fs.Arg(0), password, cred)
+
+	case "list":
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		return a.List(fs.Arg(0))
+
+	case "deprecate":
+		fs.BoolVar(&a.DryRun, "dry-run", false, "print changes instead of making them")
+		after := &timeFlag{a: a}
+		stage := fs.String("stage", "", "stage of the credentials to deprecate")
+		all := fs.Bool("all", false, "deprecate every credential of the user, instead of those of one stage")
+		fs.Var(after, "after", "deprecate from this time, or duration from now, instead of right away")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			return errors.New(usage)
+		}
+		n, err := a.Deprecate(fs.Arg(0), *stage, *all, after.t)
+		if err == nil {
+			fmt.Fprintf(a.Out, "deprecated %d credentials\n", n)
+		}
+		return err
+
+	case "remove":
+		fs.BoolVar(&a.DryRun, "dry-run", false, "print changes instead of making them")
+		stage := fs.String("stage", "", "stage of the credentials to remove")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			return errors.New(usage)
+		}
+		n, err := a.Remove(fs.Arg(0), *stage)
+		if err == nil {
+			fmt.Fprintf(a.Out, "removed %d credentials\n", n)
+		}
+		return err
+
+	case "verify":
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			return errors.New(usage)
+		}
+		password, err := a.readPassword()
+		if err != nil {
+			return err
+		}
+		c, err := a.Verify(fs.Arg(0), password)
+		if err == nil {
+			fmt.Fprintf(a.Out, "ok: stage %s, %s\n", c.Stage, c.status(a.now()))
+		}
+		return err
+
+	case "hmac":
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		password := fs.Arg(0)
+		switch {
+		case fs.NArg() > 1:
+			return errors.New(usage)
+		case fs.NArg() == 0:
+			var err error
+			if password, err = a.readPassword(); err != nil {
+				return err
+			}
+		}
+		fmt.Fprint(a.Out, hmacEncode(a.HmacKey, password))
+		return nil
+	}
+
+	// Without a subcommand, hash the password as before
+	fmt.Fprint(a.Out, hmacEncode(a.HmacKey, args[0]))
+	return nil
+}
+
 func main() {
 	var config AuthConfig
 	err := envdecode.Decode(&config)
@@ -30,6 +219,22 @@ func main() {
 		log.Fatalln(err)
 	}
 
-	password := os.Args[1]
-	fmt.Printf(hmacEncode(config.HmacKey, password))
+	var client hashStore
+	if config.RedisUrl != "" {
+		opt, err := redis.ParseURL(config.RedisUrl)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		client = redis.NewClient(opt)
+	}
+
+	a := newAdmin(client, config.RedisKey, config.HmacKey, os.Stdout)
+	a.Channel = config.CredentialChannel
+	a.In = os.Stdin
+	if err := run(a, os.Args[1:]); err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(1)
+	}
 }
@@ -3,16 +3,16 @@ module github.com/heroku/log-iss
 go 1.12
 
 require (
-	github.com/alicebob/gopher-json v0.0.0-20180125190556-5a6b3ba71ee6 // indirect
-	github.com/alicebob/miniredis v2.4.6+incompatible // indirect
+	github.com/alicebob/miniredis v2.5.0+incompatible // indirect
+	github.com/alicebob/miniredis/v2 v2.30.0
 	github.com/bmizerany/lpx v0.0.0-20130503172629-af85cf24c156
 	github.com/crewjam/rfc5424 v0.1.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/elliotchance/redismock v1.4.0
 	github.com/go-redis/redis v0.0.0-20190121142748-40336e5ef891
 	github.com/gomodule/redigo v2.0.0+incompatible // indirect
-	github.com/heroku/go-metrics-librato v0.0.0-20211022152347-534bef0d5ab9
 	github.com/heroku/go-metrics v0.0.0-20211022150449-c92400eb6c66
+	github.com/heroku/go-metrics-librato v0.0.0-20211022152347-534bef0d5ab9
 	github.com/heroku/rollrus v0.0.0-20170818212624-8c4f82380151
 	github.com/joeshaw/envdecode v0.0.0-20180312135643-c9e015854467
 	github.com/onsi/ginkgo v1.8.0 // indirect
@@ -23,7 +23,7 @@ require (
 	github.com/stretchr/objx v0.0.0-20180426105006-a5cfa15c000a // indirect
 	github.com/stretchr/testify v0.0.0-20180319223459-c679ae2cc0cb
 	github.com/stvp/roll v0.0.0-20170522205222-3627a5cbeaea // indirect
-	github.com/yuin/gopher-lua v0.0.0-20190206043414-8bfc7677f583 // indirect
+	github.com/yuin/gopher-lua v0.0.0-20220504180219-658193537a64 // indirect
 	golang.org/x/crypto v0.0.0-20180206190813-d9133f546934 // indirect
 	gopkg.in/airbrake/gobrake.v2 v2.0.9 // indirect
 	gopkg.in/gemnasium/logrus-airbrake-hook.v2 v2.1.2 // indirect